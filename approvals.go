@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/FactomProject/chihaya/middleware/infohashapproval"
+)
+
+// newApprovalsCmd returns the commands reading the approved infohashes of a
+// running tracker, through its admin server.
+func newApprovalsCmd() *cobra.Command {
+	approvalsCmd := &cobra.Command{
+		Use:   "approvals",
+		Short: "Inspect the infohashes approved by the tracker",
+	}
+	approvalsCmd.PersistentFlags().String("admin", "", "URL of the admin server, from admin.addr in the config by default")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the approved infohashes with their signer and metadata",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := approvalsListRun(cmd); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	approvalsCmd.AddCommand(listCmd)
+	return approvalsCmd
+}
+
+func approvalsListRun(cmd *cobra.Command) error {
+	body, err := adminRequest(cmd, "GET", "/admin/approvals", nil)
+	if err != nil {
+		return err
+	}
+
+	var approvals []infohashapproval.Record
+	if err := json.Unmarshal(body, &approvals); err != nil {
+		return errors.New("invalid response from admin server: " + err.Error())
+	}
+
+	for _, r := range approvals {
+		line := fmt.Sprintf("%x", r.InfoHash)
+		if r.Signer != "" {
+			line += "  signer " + r.Signer
+		}
+		if !r.ApprovedAt.IsZero() {
+			line += "  approved " + r.ApprovedAt.Format(time.RFC3339)
+		}
+		if m := r.ParseMetadata(); m != nil {
+			if m.Name != "" {
+				line += fmt.Sprintf("  %q", m.Name)
+			}
+			if m.Size != 0 {
+				line += fmt.Sprintf("  %d bytes", m.Size)
+			}
+			if m.Version != "" {
+				line += "  " + m.Version
+			}
+		}
+		fmt.Println(line)
+	}
+	log.Infof("%d approved infohashes", len(approvals))
+	return nil
+}
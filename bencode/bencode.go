@@ -0,0 +1,108 @@
+// Package bencode decodes the bencoded data of announce responses and
+// .torrent files.
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// MaxDepth bounds the nesting of lists and dictionaries, so malicious data
+// can't exhaust the stack.
+const MaxDepth = 64
+
+// Decode decodes a single bencoded value into an int64, a string, a
+// []interface{} or a map[string]interface{}.
+func Decode(b []byte) (interface{}, error) {
+	v, rest, err := DecodeValue(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after bencoded value")
+	}
+	return v, nil
+}
+
+// DecodeValue decodes the bencoded value at the start of b like Decode,
+// returning what follows it.
+func DecodeValue(b []byte) (interface{}, []byte, error) {
+	return decodeValue(b, 1)
+}
+
+func decodeValue(b []byte, depth int) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errors.New("unexpected end of bencoded data")
+	}
+	if depth > MaxDepth {
+		return nil, nil, errors.New("bencoded data nested too deep")
+	}
+
+	switch b[0] {
+	case 'i':
+		end := bytes.IndexByte(b, 'e')
+		if end < 0 {
+			return nil, nil, errors.New("unterminated bencoded integer")
+		}
+		n, err := strconv.ParseInt(string(b[1:end]), 10, 64)
+		if err != nil {
+			return nil, nil, errors.New("invalid bencoded integer: " + err.Error())
+		}
+		return n, b[end+1:], nil
+
+	case 'l':
+		list := []interface{}{}
+		b = b[1:]
+		for len(b) > 0 && b[0] != 'e' {
+			v, rest, err := decodeValue(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			list = append(list, v)
+			b = rest
+		}
+		if len(b) == 0 {
+			return nil, nil, errors.New("unterminated bencoded list")
+		}
+		return list, b[1:], nil
+
+	case 'd':
+		dict := map[string]interface{}{}
+		b = b[1:]
+		for len(b) > 0 && b[0] != 'e' {
+			k, rest, err := DecodeString(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			v, rest, err := decodeValue(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			dict[k] = v
+			b = rest
+		}
+		if len(b) == 0 {
+			return nil, nil, errors.New("unterminated bencoded dictionary")
+		}
+		return dict, b[1:], nil
+
+	default:
+		return DecodeString(b)
+	}
+}
+
+// DecodeString decodes the bencoded string at the start of b, such as a
+// dictionary key, returning what follows it.
+func DecodeString(b []byte) (string, []byte, error) {
+	colon := bytes.IndexByte(b, ':')
+	if colon < 0 {
+		return "", nil, errors.New("invalid bencoded string")
+	}
+	n, err := strconv.Atoi(string(b[:colon]))
+	if err != nil || n < 0 || n > len(b)-colon-1 {
+		return "", nil, errors.New("invalid bencoded string length")
+	}
+	b = b[colon+1:]
+	return string(b[:n]), b[n:], nil
+}
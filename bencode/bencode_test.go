@@ -0,0 +1,64 @@
+package bencode
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		data string
+		want interface{}
+	}{
+		{"i42e", int64(42)},
+		{"i-3e", int64(-3)},
+		{"4:spam", "spam"},
+		{"0:", ""},
+		{"le", []interface{}{}},
+		{"l4:spami7ee", []interface{}{"spam", int64(7)}},
+		{"d8:intervali1800e5:peers0:e", map[string]interface{}{"interval": int64(1800), "peers": ""}},
+		{"d1:ld1:xleee", map[string]interface{}{"l": map[string]interface{}{"x": []interface{}{}}}},
+	}
+	for _, tt := range tests {
+		got, err := Decode([]byte(tt.data))
+		if err != nil {
+			t.Errorf("%q: %v", tt.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q decoded to %#v, want %#v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"i42",
+		"ixe",
+		"5:spam",
+		"-1:",
+		"spam",
+		"l4:spam",
+		"d4:spam",
+		"di1ei2ee",
+		"i1ei2e",
+	} {
+		if v, err := Decode([]byte(data)); err == nil {
+			t.Errorf("%q decoded to %#v", data, v)
+		}
+	}
+}
+
+func TestDecodeDepth(t *testing.T) {
+	deepest := strings.Repeat("l", MaxDepth) + strings.Repeat("e", MaxDepth)
+	if _, err := Decode([]byte(deepest)); err != nil {
+		t.Errorf("lists nested %d deep: %v", MaxDepth, err)
+	}
+
+	tooDeep := strings.Repeat("l", MaxDepth+1) + strings.Repeat("e", MaxDepth+1)
+	if _, err := Decode([]byte(tooDeep)); err == nil {
+		t.Errorf("decoded lists nested %d deep", MaxDepth+1)
+	}
+}
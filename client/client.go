@@ -0,0 +1,105 @@
+// Package client registers infohashes with a Factom chihaya tracker. It signs
+// an infohash with an ed25519 key and announces it over HTTP or UDP with the
+// sig parameter the infohash approval hook verifies, so a service can add
+// torrents without depending on factomd-torrent.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+const defaultPort = 6881
+
+// Client announces infohashes to trackers. The zero value is ready to use.
+type Client struct {
+	// PeerID announced to the tracker, random when zero
+	PeerID [20]byte
+	// Port announced to the tracker, 6881 when zero
+	Port uint16
+	// HTTPClient used for HTTP announces, http.DefaultClient when nil
+	HTTPClient *http.Client
+	// SignatureHeader, when set, carries the signature of HTTP announces
+	// instead of the query string. It must match the signature_header of
+	// the tracker's http frontend.
+	SignatureHeader string
+}
+
+// Response is the tracker's answer to an announce.
+type Response struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	Seeders     int
+	Leechers    int
+	Peers       []Peer
+}
+
+// Peer is a peer returned by the tracker.
+type Peer struct {
+	IP   net.IP
+	Port uint16
+}
+
+// Sign signs an infohash with an ed25519 private key, returning the value of
+// the sig parameter: the hex signature of the raw 20 byte infohash.
+func Sign(privateKey *[ed.PrivateKeySize]byte, infohash [20]byte) string {
+	return hex.EncodeToString(ed.Sign(privateKey, infohash[:])[:])
+}
+
+// Announce announces infohash to the tracker at announceURL, an http, https
+// or udp URL, as a seeder that just started. The infohash is signed with
+// privateKey, unless it is nil. A failure reason sent by the tracker is
+// returned as a FailureError. A new infohash is approved in the background,
+// so its first signed announce returns ErrUnapproved, see there.
+func (c *Client) Announce(ctx context.Context, announceURL string, infohash [20]byte, privateKey *[ed.PrivateKeySize]byte) (*Response, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, errors.New("invalid announce URL: " + err.Error())
+	}
+
+	a := announce{
+		infohash: infohash,
+		peerID:   c.PeerID,
+		port:     c.Port,
+	}
+	if a.peerID == [20]byte{} {
+		if _, err := rand.Read(a.peerID[:]); err != nil {
+			return nil, errors.New("failed to generate peer id: " + err.Error())
+		}
+	}
+	if a.port == 0 {
+		a.port = defaultPort
+	}
+	if privateKey != nil {
+		a.sig = Sign(privateKey, infohash)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		httpClient := c.HTTPClient
+		if httpClient == nil {
+			httpClient = http.DefaultClient
+		}
+		return announceHTTP(ctx, httpClient, c.SignatureHeader, u, a)
+	case "udp":
+		return announceUDP(ctx, u, a)
+	default:
+		return nil, errors.New("unsupported announce URL scheme " + u.Scheme)
+	}
+}
+
+// announce is what a Client sends for an infohash.
+type announce struct {
+	infohash [20]byte
+	peerID   [20]byte
+	port     uint16
+	sig      string
+}
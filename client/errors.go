@@ -0,0 +1,43 @@
+package client
+
+// FailureError is a failure reason sent by the tracker in response to an
+// announce. The reasons the infohash approval hook sends are the Err values
+// below, so they can be compared with ==.
+type FailureError string
+
+// Error implements the error interface for FailureError.
+func (e FailureError) Error() string { return "tracker failure: " + string(e) }
+
+// Temporary returns true when the same announce may succeed if retried
+// later.
+func (e FailureError) Temporary() bool {
+	return e == ErrBanned || e == ErrVerifierOverloaded || e == ErrVerifierStopped
+}
+
+// These are the failure reasons of the infohash approval hook, and must be
+// kept in sync with its errors.
+var (
+	// ErrUnapproved is returned for an announce of an infohash the tracker
+	// has not approved: unsigned, signed with a key that isn't one of its
+	// signers, or blacklisted. The first announce with a valid signature
+	// gets it too, as the tracker approves the infohash in the background;
+	// announcing again shortly after succeeds.
+	ErrUnapproved = FailureError("unapproved infohash")
+
+	// ErrInvalidSignature is returned for an announce whose sig parameter
+	// isn't a hex ed25519 signature. A well-formed signature by the wrong
+	// key gets ErrUnapproved instead.
+	ErrInvalidSignature = FailureError("Invalid Signature")
+
+	// ErrBanned is returned when the announcing IP sent too many invalid
+	// signatures and is banned for a while.
+	ErrBanned = FailureError("too many invalid signatures, try again later")
+
+	// ErrVerifierOverloaded is returned when the tracker sheds the announce
+	// because too many signatures are waiting to be verified.
+	ErrVerifierOverloaded = FailureError("signature verification overloaded, try again later")
+
+	// ErrVerifierStopped is returned when the tracker stopped or reloaded
+	// while the signature was waiting to be verified.
+	ErrVerifierStopped = FailureError("signature verification stopped, try again later")
+)
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/FactomProject/chihaya/bencode"
+)
+
+// maxResponseSize bounds the body read from an HTTP announce.
+const maxResponseSize = 1 << 20
+
+func announceHTTP(ctx context.Context, httpClient *http.Client, signatureHeader string, u *url.URL, a announce) (*Response, error) {
+	q := u.Query()
+	q.Set("info_hash", string(a.infohash[:]))
+	q.Set("peer_id", string(a.peerID[:]))
+	q.Set("port", strconv.Itoa(int(a.port)))
+	q.Set("uploaded", "0")
+	q.Set("downloaded", "0")
+	q.Set("left", "0")
+	q.Set("event", "started")
+	q.Set("compact", "1")
+	if a.sig != "" && signatureHeader == "" {
+		q.Set("sig", a.sig)
+	}
+
+	reqURL := *u
+	reqURL.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", reqURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if a.sig != "" && signatureHeader != "" {
+		req.Header.Set(signatureHeader, a.sig)
+	}
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, errors.New("failed to read announce response: " + err.Error())
+	}
+
+	v, err := bencode.Decode(body)
+	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New("announce failed: " + resp.Status)
+		}
+		return nil, errors.New("invalid announce response: " + err.Error())
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid announce response: not a dictionary")
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, FailureError(reason)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("announce failed: " + resp.Status)
+	}
+
+	return parseHTTPResponse(dict)
+}
+
+func parseHTTPResponse(dict map[string]interface{}) (*Response, error) {
+	interval, _ := dict["interval"].(int64)
+	minInterval, _ := dict["min interval"].(int64)
+	complete, _ := dict["complete"].(int64)
+	incomplete, _ := dict["incomplete"].(int64)
+	r := &Response{
+		Interval:    time.Duration(interval) * time.Second,
+		MinInterval: time.Duration(minInterval) * time.Second,
+		Seeders:     int(complete),
+		Leechers:    int(incomplete),
+	}
+
+	switch peers := dict["peers"].(type) {
+	case string:
+		compact, err := compactPeers([]byte(peers), net.IPv4len)
+		if err != nil {
+			return nil, err
+		}
+		r.Peers = append(r.Peers, compact...)
+	case []interface{}:
+		for _, p := range peers {
+			peer, ok := p.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("invalid peer in announce response")
+			}
+			ipString, _ := peer["ip"].(string)
+			port, _ := peer["port"].(int64)
+			ip := net.ParseIP(ipString)
+			if ip == nil || port <= 0 || port > 65535 {
+				return nil, errors.New("invalid peer in announce response")
+			}
+			r.Peers = append(r.Peers, Peer{IP: ip, Port: uint16(port)})
+		}
+	}
+
+	if peers6, ok := dict["peers6"].(string); ok {
+		compact, err := compactPeers([]byte(peers6), net.IPv6len)
+		if err != nil {
+			return nil, err
+		}
+		r.Peers = append(r.Peers, compact...)
+	}
+
+	return r, nil
+}
+
+// compactPeers decodes peers of ipLen bytes followed by a 2 byte port, as in
+// compact HTTP and UDP responses.
+func compactPeers(b []byte, ipLen int) ([]Peer, error) {
+	size := ipLen + 2
+	if len(b)%size != 0 {
+		return nil, errors.New("invalid compact peers in announce response")
+	}
+
+	peers := make([]Peer, 0, len(b)/size)
+	for i := 0; i < len(b); i += size {
+		ip := make(net.IP, ipLen)
+		copy(ip, b[i:i+ipLen])
+		peers = append(peers, Peer{
+			IP:   ip,
+			Port: binary.BigEndian.Uint16(b[i+ipLen : i+size]),
+		})
+	}
+	return peers, nil
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+// Metadata describes the torrent of an infohash uploaded to the tracker.
+type Metadata struct {
+	Name    string
+	Size    int64
+	Version string
+	// Torrent is the .torrent file, optional. The tracker checks that it
+	// hashes to the infohash, and takes the name and size from it when not
+	// given.
+	Torrent []byte
+}
+
+type metadataUpload struct {
+	InfoHash string `json:"infohash"`
+	Name     string `json:"name,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Torrent  []byte `json:"torrent,omitempty"`
+}
+
+// UploadMetadata approves infohash on the tracker at announceURL, an http or
+// https URL, saving its metadata. The upload is signed with privateKey,
+// which must belong to one of the tracker's signers, and the tracker must
+// have metadata_upload enabled. Unlike an announce, the upload is approved
+// before the tracker responds, and a key that isn't one of its signers is
+// refused with ErrInvalidSignature. A blacklisted infohash is refused with
+// ErrUnapproved.
+func (c *Client) UploadMetadata(ctx context.Context, announceURL string, infohash [20]byte, m Metadata, privateKey *[ed.PrivateKeySize]byte) error {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return errors.New("invalid announce URL: " + err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("metadata is uploaded over http or https, not " + u.Scheme)
+	}
+
+	body, err := json.Marshal(metadataUpload{
+		InfoHash: hex.EncodeToString(infohash[:]),
+		Name:     m.Name,
+		Size:     m.Size,
+		Version:  m.Version,
+		Torrent:  m.Torrent,
+	})
+	if err != nil {
+		return err
+	}
+
+	reqURL := url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/metadata"}
+	req, err := http.NewRequest("POST", reqURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chihaya-Signature", hex.EncodeToString(ed.Sign(privateKey, body)[:]))
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	reason := FailureError(strings.TrimSpace(string(msg)))
+	// The upload endpoint verifies the signature against the signers
+	// itself, so here ErrInvalidSignature covers unknown keys too.
+	if reason == ErrInvalidSignature || reason == ErrUnapproved {
+		return reason
+	}
+	return errors.New("metadata upload failed: " + resp.Status + ": " + string(reason))
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+)
+
+// UDP tracker protocol, from BEP 15, with the URL data option of BEP 41 that
+// carries the sig parameter.
+const (
+	udpProtocolID = 0x41727101980
+
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionError    = 3
+
+	optionEndOfOptions = 0x0
+	optionURLData      = 0x2
+
+	eventStarted = 2
+
+	// udpAttempts is how many times a request is sent before giving up,
+	// waiting twice as long each time from udpTimeout.
+	udpAttempts = 4
+	udpTimeout  = 2 * time.Second
+)
+
+func announceUDP(ctx context.Context, u *url.URL, a announce) (*Response, error) {
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Unblock reads when the context is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	resp, err := udpAnnounce(conn, u, a)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+func udpAnnounce(conn net.Conn, u *url.URL, a announce) (*Response, error) {
+	connect := make([]byte, 16)
+	binary.BigEndian.PutUint64(connect[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(connect[8:12], actionConnect)
+	reply, err := udpRoundTrip(conn, connect, actionConnect, 16)
+	if err != nil {
+		return nil, err
+	}
+	connectionID := reply[8:16]
+
+	var packet bytes.Buffer
+	packet.Write(connectionID)
+	binary.Write(&packet, binary.BigEndian, uint32(actionAnnounce))
+	packet.Write(make([]byte, 4)) // transaction ID, set by udpRoundTrip
+	packet.Write(a.infohash[:])
+	packet.Write(a.peerID[:])
+	binary.Write(&packet, binary.BigEndian, uint64(0)) // downloaded
+	binary.Write(&packet, binary.BigEndian, uint64(0)) // left
+	binary.Write(&packet, binary.BigEndian, uint64(0)) // uploaded
+	binary.Write(&packet, binary.BigEndian, uint32(eventStarted))
+	binary.Write(&packet, binary.BigEndian, uint32(0)) // IP, the sender's
+	key := make([]byte, 4)
+	rand.Read(key)
+	packet.Write(key)
+	binary.Write(&packet, binary.BigEndian, int32(-1)) // numwant, the default
+	binary.Write(&packet, binary.BigEndian, a.port)
+
+	if a.sig != "" {
+		q := u.Query()
+		q.Set("sig", a.sig)
+		path := u.EscapedPath()
+		if path == "" {
+			path = "/"
+		}
+		writeURLData(&packet, []byte(path+"?"+q.Encode()))
+	}
+
+	reply, err = udpRoundTrip(conn, packet.Bytes(), actionAnnounce, 20)
+	if err != nil {
+		return nil, err
+	}
+
+	ipLen := net.IPv4len
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		ipLen = net.IPv6len
+	}
+	peers, err := compactPeers(reply[20:], ipLen)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{
+		Interval: time.Duration(binary.BigEndian.Uint32(reply[8:12])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(reply[12:16])),
+		Seeders:  int(binary.BigEndian.Uint32(reply[16:20])),
+		Peers:    peers,
+	}, nil
+}
+
+// writeURLData appends data as URL data options of at most 255 bytes each,
+// followed by the end of options.
+func writeURLData(packet *bytes.Buffer, data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > 255 {
+			n = 255
+		}
+		packet.WriteByte(optionURLData)
+		packet.WriteByte(byte(n))
+		packet.Write(data[:n])
+		data = data[n:]
+	}
+	packet.WriteByte(optionEndOfOptions)
+}
+
+// udpRoundTrip sends request with a new transaction ID until a reply to it
+// arrives, and returns the reply once it is known to be for action and at
+// least minLen long. A tracker error is returned as a FailureError.
+func udpRoundTrip(conn net.Conn, request []byte, action uint32, minLen int) ([]byte, error) {
+	transactionID := make([]byte, 4)
+	if _, err := rand.Read(transactionID); err != nil {
+		return nil, err
+	}
+	copy(request[12:16], transactionID)
+
+	buf := make([]byte, 2048)
+	timeout := udpTimeout
+	for attempt := 0; attempt < udpAttempts; attempt++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(timeout)
+		timeout *= 2
+		for {
+			conn.SetReadDeadline(deadline)
+			n, err := conn.Read(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			reply := buf[:n]
+			if n < 8 || !bytes.Equal(reply[4:8], transactionID) {
+				// A reply to another request, or garbage
+				continue
+			}
+
+			switch binary.BigEndian.Uint32(reply[0:4]) {
+			case actionError:
+				return nil, FailureError(bytes.TrimRight(reply[8:], "\x00"))
+			case action:
+				if n < minLen {
+					return nil, errors.New("truncated reply from tracker")
+				}
+				return append([]byte(nil), reply...), nil
+			default:
+				return nil, errors.New("unexpected action in reply from tracker")
+			}
+		}
+	}
+	return nil, errors.New("no reply from tracker")
+}
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+
+	"github.com/FactomProject/chihaya/tracker"
+)
+
+const udpConfigTemplate = `chihaya:
+  announce_interval: 15m
+  max_numwant: 50
+  default_numwant: 25
+
+  udp:
+    addr: %s
+    private_key: udpapproval
+    max_clock_skew: 10s
+
+  storage:
+    gc_interval: 14m
+    peer_lifetime: 15m
+    shards: 1
+
+  prehooks:
+  - name: infohash approval
+    config:
+      database: Map
+      signers:
+      - key: %s
+`
+
+// TestUDPApproval announces to a tracker running only the UDP frontend, so
+// signatures travel as BEP 41 URL data, and checks the errors the tracker
+// returns. Every step uses a new infohash, as a failed signature is cached.
+func TestUDPApproval(t *testing.T) {
+	pub, priv, err := ed.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := ed.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, announceURL, stop := startUDPTracker(t, hex.EncodeToString(pub[:]))
+	defer stop()
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		sig  func(ih [20]byte) string
+		want error
+	}{
+		{"unsigned", func([20]byte) string { return "" }, ErrUnapproved},
+		{"unknown key", func(ih [20]byte) string { return Sign(otherPriv, ih) }, ErrUnapproved},
+		{"malformed signature", func([20]byte) string { return "not hex" }, ErrInvalidSignature},
+		{"short signature", func([20]byte) string { return "abcd" }, ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		ih := randomInfohash(t)
+		_, err := announceUDPWithSig(u, ih, tt.sig(ih))
+		if err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+		if tr.Approvals().Approved(ih) {
+			t.Errorf("%s: infohash was approved", tt.name)
+		}
+	}
+
+	// The approval is written in the background, so the signed announce
+	// itself may still be refused as unapproved.
+	ih := randomInfohash(t)
+	if _, err := announceUDPWithSig(u, ih, Sign(priv, ih)); err != nil && err != ErrUnapproved {
+		t.Fatalf("signed announce: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !tr.Approvals().Approved(ih) {
+		if time.Now().After(deadline) {
+			t.Fatal("signed announce: infohash was not approved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := announceUDPWithSig(u, ih, ""); err != nil {
+		t.Fatalf("unsigned announce of the approved infohash: %v", err)
+	}
+}
+
+// startUDPTracker runs a tracker with only a UDP frontend and the approval
+// hook trusting signer, and returns once it answers announces, with a
+// function stopping it.
+func startUDPTracker(t *testing.T, signer string) (*tracker.Tracker, string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	dir, err := ioutil.TempDir("", "udpapproval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := func() { os.RemoveAll(dir) }
+	path := filepath.Join(dir, "chihaya.yaml")
+	config := fmt.Sprintf(udpConfigTemplate, addr, signer)
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+
+	cfg, err := tracker.ParseConfigFile(path)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	tr, err := tracker.New(cfg)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	if err := tr.Start(); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	stop = func() {
+		tr.Stop()
+		os.RemoveAll(dir)
+	}
+
+	// The frontend binds in the background, until then reads are refused
+	u := &url.URL{Scheme: "udp", Host: addr, Path: "/announce"}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := announceUDPWithSig(u, randomInfohash(t), "")
+		if _, ok := err.(FailureError); ok || err == nil {
+			return tr, u.String(), stop
+		}
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatalf("tracker did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// announceUDPWithSig announces with sig as it is, so malformed signatures
+// can be sent.
+func announceUDPWithSig(u *url.URL, ih [20]byte, sig string) (*Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a := announce{infohash: ih, port: defaultPort, sig: sig}
+	rand.Read(a.peerID[:])
+	return announceUDP(ctx, u, a)
+}
+
+func randomInfohash(t *testing.T) [20]byte {
+	var ih [20]byte
+	if _, err := rand.Read(ih[:]); err != nil {
+		t.Fatal(err)
+	}
+	return ih
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/FactomProject/chihaya/middleware/infohashapproval"
+	"github.com/FactomProject/chihaya/tracker"
+)
+
+// newDBCmd returns the commands working on the infohash approval database
+// configured in the config file. The Bolt and LDB databases are locked
+// while the tracker runs, so stop it first or use the admin endpoints.
+func newDBCmd() *cobra.Command {
+	dbCmd := &cobra.Command{
+		Use:   "db",
+		Short: "Manage the infohash approval database",
+	}
+
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write a backup of the whitelist and blacklist",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := dbExportRun(cmd); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	exportCmd.Flags().String("format", "json", "backup format, json or binary")
+	exportCmd.Flags().String("output", "-", "file to write the backup to, - for stdout")
+
+	importCmd := &cobra.Command{
+		Use:   "import",
+		Short: "Restore a backup written by export, in either format",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := dbImportRun(cmd); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	importCmd.Flags().String("input", "-", "file to read the backup from, - for stdin")
+
+	checkCmd := &cobra.Command{
+		Use:   "check",
+		Short: "Validate the database, optionally repairing or compacting it",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := dbCheckRun(cmd); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	checkCmd.Flags().Bool("repair", false, "fix the problems found")
+	checkCmd.Flags().Bool("compact", false, "rewrite a Bolt file without its free pages")
+
+	dbCmd.AddCommand(exportCmd, importCmd, checkCmd)
+	return dbCmd
+}
+
+func dbExportRun(cmd *cobra.Command) error {
+	format, _ := cmd.Flags().GetString("format")
+	output, _ := cmd.Flags().GetString("output")
+	if format != "json" && format != "binary" {
+		return errors.New("format must be json or binary")
+	}
+
+	db, err := openApprovalDatabase(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	b, err := infohashapproval.ExportBackup(db)
+	if err != nil {
+		return errors.New("failed to read database: " + err.Error())
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := infohashapproval.EncodeBackup(w, b, format); err != nil {
+		return errors.New("failed to write backup: " + err.Error())
+	}
+	log.Infof("exported %d approved and %d blacklisted infohashes", len(b.Whitelist), len(b.Blacklist))
+	return nil
+}
+
+func dbImportRun(cmd *cobra.Command) error {
+	input, _ := cmd.Flags().GetString("input")
+
+	var r io.Reader = os.Stdin
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	b, err := infohashapproval.DecodeBackup(r)
+	if err != nil {
+		return err
+	}
+
+	db, err := openApprovalDatabase(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := infohashapproval.ImportBackup(db, b); err != nil {
+		return errors.New("failed to write database: " + err.Error())
+	}
+	log.Infof("imported %d approved and %d blacklisted infohashes", len(b.Whitelist), len(b.Blacklist))
+	return nil
+}
+
+func dbCheckRun(cmd *cobra.Command) error {
+	repair, _ := cmd.Flags().GetBool("repair")
+	compact, _ := cmd.Flags().GetBool("compact")
+
+	iaCfg, err := approvalConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	report, err := infohashapproval.CheckDatabase(iaCfg, repair)
+	if err != nil {
+		return errors.New("failed to check database: " + err.Error())
+	}
+
+	unrepaired := 0
+	for _, p := range report.Problems {
+		log.Warnln(p.String())
+		if !p.Repaired {
+			unrepaired++
+		}
+	}
+	log.Infof("%d approved, %d blacklisted, %d banned, %d pending and %d outbox entries; %d problems, %d left unrepaired",
+		report.Whitelisted, report.Blacklisted, report.Bans, report.Pending, report.Outbox, len(report.Problems), unrepaired)
+
+	if compact {
+		if iaCfg.Database != "Bolt" {
+			return errors.New("only Bolt databases can be compacted")
+		}
+		before, after, err := infohashapproval.CompactBoltDatabase(infohashapproval.DatabasePath(iaCfg))
+		if err != nil {
+			return errors.New("failed to compact database: " + err.Error())
+		}
+		log.Infof("compacted database from %d to %d bytes", before, after)
+	}
+
+	if unrepaired > 0 && repair {
+		return errors.New("database has problems that can't be repaired, restore a backup with db import")
+	}
+	if unrepaired > 0 {
+		return errors.New("database has problems, run with --repair to fix them")
+	}
+	return nil
+}
+
+// approvalConfig reads the config of the infohash approval hook from the
+// config file.
+func approvalConfig(cmd *cobra.Command) (infohashapproval.Config, error) {
+	configFilePath, _ := cmd.Flags().GetString("config")
+	configFile, err := tracker.ParseConfigFile(configFilePath)
+	if err != nil {
+		return infohashapproval.Config{}, errors.New("failed to read config: " + err.Error())
+	}
+	return configFile.InfohashApprovalConfig()
+}
+
+// openApprovalDatabase opens the database of the infohash approval hook in
+// the config file.
+func openApprovalDatabase(cmd *cobra.Command) (infohashapproval.Database, error) {
+	iaCfg, err := approvalConfig(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := infohashapproval.OpenDatabase(iaCfg)
+	if err != nil {
+		return nil, err
+	}
+	if db == nil {
+		return nil, errors.New("the infohash approval hook has no database")
+	}
+	return db, nil
+}
@@ -0,0 +1,158 @@
+// Package http implements the HTTP frontend of the tracker. It serves
+// announces and scrapes like the chihaya HTTP frontend, whose parsing and
+// responses it reuses, and can also take the signature of a signed announce
+// from a request header instead of the query string.
+package http
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	httpfrontend "github.com/chihaya/chihaya/frontend/http"
+)
+
+// signatureParam is the announce parameter the infohash approval hook reads
+// the signature from.
+const signatureParam = "sig"
+
+// Config represents all of the configurable options for an HTTP frontend.
+type Config struct {
+	httpfrontend.Config `yaml:",inline"`
+
+	// SignatureHeader is a request header, such as X-Chihaya-Signature,
+	// whose value is passed to the hooks as the sig parameter, so the
+	// signature stays out of URLs and access logs. It is used when the
+	// query string has no sig.
+	SignatureHeader string `yaml:"signature_header"`
+}
+
+// Router is implemented by hooks serving more endpoints on the HTTP
+// frontend. Routes returns their handlers by path.
+type Router interface {
+	Routes() map[string]http.Handler
+}
+
+// Frontend serves announces and scrapes over HTTP.
+type Frontend struct {
+	srv   *http.Server
+	mux   *http.ServeMux
+	logic frontend.TrackerLogic
+	Config
+}
+
+// NewFrontend creates a new Frontend that asks logic to handle its requests.
+func NewFrontend(logic frontend.TrackerLogic, cfg Config) *Frontend {
+	f := &Frontend{
+		logic:  logic,
+		Config: cfg,
+	}
+
+	f.mux = http.NewServeMux()
+	f.mux.HandleFunc("/announce", f.announceRoute)
+	f.mux.HandleFunc("/scrape", f.scrapeRoute)
+
+	var handler http.Handler = f.mux
+	if cfg.RequestTimeout > 0 {
+		handler = http.TimeoutHandler(f.mux, cfg.RequestTimeout, "request timed out")
+	}
+
+	f.srv = &http.Server{
+		Addr:         cfg.Addr,
+		Handler:      handler,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+	}
+	return f
+}
+
+// Mount serves the routes of r, which must be done before ListenAndServe.
+func (f *Frontend) Mount(r Router) {
+	for path, handler := range r.Routes() {
+		f.mux.Handle(path, handler)
+	}
+}
+
+// ListenAndServe listens on the configured address and serves until Stop is
+// called.
+func (f *Frontend) ListenAndServe() error {
+	if err := f.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Stop stops serving, waiting a few seconds for requests in progress.
+func (f *Frontend) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := f.srv.Shutdown(ctx); err != nil {
+		f.srv.Close()
+	}
+}
+
+func (f *Frontend) announceRoute(w http.ResponseWriter, r *http.Request) {
+	req, err := httpfrontend.ParseAnnounce(r, f.RealIPHeader, f.AllowIPSpoofing)
+	if err != nil {
+		httpfrontend.WriteError(w, err)
+		return
+	}
+
+	if f.SignatureHeader != "" {
+		if sig := r.Header.Get(f.SignatureHeader); sig != "" {
+			if _, ok := req.Params.String(signatureParam); !ok {
+				req.Params = signatureParams{Params: req.Params, sig: sig}
+			}
+		}
+	}
+
+	resp, err := f.logic.HandleAnnounce(context.Background(), req)
+	if err != nil {
+		httpfrontend.WriteError(w, err)
+		return
+	}
+
+	if err := httpfrontend.WriteAnnounceResponse(w, resp); err != nil {
+		httpfrontend.WriteError(w, err)
+		return
+	}
+
+	go f.logic.AfterAnnounce(context.Background(), req, resp)
+}
+
+func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request) {
+	req, err := httpfrontend.ParseScrape(r)
+	if err != nil {
+		httpfrontend.WriteError(w, err)
+		return
+	}
+
+	resp, err := f.logic.HandleScrape(context.Background(), req)
+	if err != nil {
+		httpfrontend.WriteError(w, err)
+		return
+	}
+
+	if err := httpfrontend.WriteScrapeResponse(w, resp); err != nil {
+		httpfrontend.WriteError(w, err)
+		return
+	}
+
+	go f.logic.AfterScrape(context.Background(), req, resp)
+}
+
+// signatureParams adds a signature taken from a header to the parameters of
+// an announce.
+type signatureParams struct {
+	bittorrent.Params
+	sig string
+}
+
+func (p signatureParams) String(key string) (string, bool) {
+	if key == signatureParam {
+		return p.sig, true
+	}
+	return p.Params.String(key)
+}
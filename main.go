@@ -2,24 +2,20 @@ package main
 
 import (
 	"errors"
-	"net/http"
+	"fmt"
 	"os"
 	"os/signal"
 	"runtime/pprof"
 	"syscall"
+	"time"
 
 	// Logging used by Chihaya, should keep
 	// to utilize their logging
 	log "github.com/Sirupsen/logrus"
 
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 
-	httpfrontend "github.com/chihaya/chihaya/frontend/http"
-	udpfrontend "github.com/chihaya/chihaya/frontend/udp"
-	"github.com/chihaya/chihaya/middleware"
-	"github.com/chihaya/chihaya/storage"
-	"github.com/chihaya/chihaya/storage/memory"
+	"github.com/FactomProject/chihaya/tracker"
 )
 
 func rootCmdRun(cmd *cobra.Command, args []string) error {
@@ -43,161 +39,82 @@ func rootCmdRun(cmd *cobra.Command, args []string) error {
 	}
 
 	configFilePath, _ := cmd.Flags().GetString("config")
-	configFile, err := ParseConfigFile(configFilePath)
+	if errs := tracker.ValidateConfigFile(configFilePath); len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+		}
+		return errors.New("invalid config, see chihaya check-config")
+	}
+	configFile, err := tracker.ParseConfigFile(configFilePath)
 	if err != nil {
 		return errors.New("failed to read config: " + err.Error())
 	}
-	cfg := configFile.MainConfigBlock
-
-	go func() {
-		promServer := http.Server{
-			Addr:    cfg.PrometheusAddr,
-			Handler: prometheus.Handler(),
-		}
-		log.Infoln("started serving prometheus stats on", cfg.PrometheusAddr)
-		if err := promServer.ListenAndServe(); err != nil {
-			log.Fatalln("failed to start prometheus server:", err.Error())
-		}
-	}()
 
-	peerStore, err := memory.New(cfg.Storage)
+	t, err := tracker.New(configFile)
 	if err != nil {
-		return errors.New("failed to create memory storage: " + err.Error())
+		return err
 	}
-
-	preHooks, postHooks, err := configFile.CreateHooks()
-	if err != nil {
-		return errors.New("failed to create hooks: " + err.Error())
+	if err := t.Start(); err != nil {
+		return err
 	}
 
-	logic := middleware.NewLogic(cfg.Config, peerStore, preHooks, postHooks)
-
-	errChan := make(chan error)
-
-	httpFrontend, udpFrontend := startFrontends(cfg.HTTPConfig, cfg.UDPConfig, logic, errChan)
-
-	shutdown := make(chan struct{})
 	quit := make(chan os.Signal)
 	restart := make(chan os.Signal)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	signal.Notify(restart, syscall.SIGUSR1)
 
-	go func() {
-		for {
-			select {
-			case <-restart:
-				log.Info("Got signal to restart")
-
-				// Reload config
-				configFile, err = ParseConfigFile(configFilePath)
-				if err != nil {
-					log.Error("failed to read config: " + err.Error())
-				}
-				cfg = configFile.MainConfigBlock
-
-				preHooks, postHooks, err = configFile.CreateHooks()
-				if err != nil {
-					log.Error("failed to create hooks: " + err.Error())
-				}
-
-				// Stop frontends and logic
-				stopFrontends(udpFrontend, httpFrontend)
-
-				stopLogic(logic, errChan)
-
-				// Restart
-				log.Debug("Restarting logic")
-				logic = middleware.NewLogic(cfg.Config, peerStore, preHooks, postHooks)
-
-				log.Debug("Restarting frontends")
-				httpFrontend, udpFrontend = startFrontends(cfg.HTTPConfig, cfg.UDPConfig, logic, errChan)
-
-				log.Debug("Successfully restarted")
+	// The config, and the files it references, are only watched when asked
+	// to. A nil channel never receives.
+	var changed <-chan struct{}
+	var watcher *fileWatcher
+	done := make(chan struct{})
+	defer close(done)
+	if watch, _ := cmd.Flags().GetBool("watch"); watch {
+		interval, _ := cmd.Flags().GetDuration("watch-interval")
+		watcher = newFileWatcher(configFile.WatchedFiles(configFilePath), interval)
+		changed = watcher.Changed()
+		go watcher.Run(done)
+		log.Infoln("watching config file", configFilePath, "for changes")
+	}
 
-			case <-quit:
-				stop(udpFrontend, httpFrontend, logic, errChan, peerStore)
-			case <-shutdown:
-				stop(udpFrontend, httpFrontend, logic, errChan, peerStore)
-			}
+	reload := func() {
+		if err := t.ReloadFile(configFilePath); err != nil {
+			log.Error("Reload failed, keeping the running config: " + err.Error())
+			return
 		}
-	}()
-
-	closed := false
-	var bufErr error
-	for err = range errChan {
-		if err != nil {
-			if !closed {
-				close(shutdown)
-				closed = true
-			} else {
-				log.Infoln(bufErr)
-			}
-			bufErr = err
+		if watcher != nil {
+			watcher.SetPaths(t.Config().WatchedFiles(configFilePath))
 		}
 	}
 
-	return bufErr
-}
-
-func stopFrontends(udpFrontend *udpfrontend.Frontend, httpFrontend *httpfrontend.Frontend) {
-	log.Debug("Stopping frontends")
-	if udpFrontend != nil {
-		udpFrontend.Stop()
-	}
-
-	if httpFrontend != nil {
-		httpFrontend.Stop()
-	}
-}
-
-func stopLogic(logic *middleware.Logic, errChan chan error) {
-	log.Debug("Stopping logic")
-	errs := logic.Stop()
-	for _, err := range errs {
-		errChan <- err
-	}
-}
-
-func stop(udpFrontend *udpfrontend.Frontend, httpFrontend *httpfrontend.Frontend, logic *middleware.Logic, errChan chan error, peerStore storage.PeerStore) {
-	stopFrontends(udpFrontend, httpFrontend)
-
-	stopLogic(logic, errChan)
-
-	// Stop storage
-	log.Debug("Stopping storage")
-	for err := range peerStore.Stop() {
-		if err != nil {
-			errChan <- err
+	var failure error
+	for failure == nil {
+		select {
+		case <-restart:
+			log.Info("Got signal to restart")
+			reload()
+		case <-changed:
+			log.Info("Config file changed, reloading")
+			reload()
+		case <-quit:
+			return stop(t, nil)
+		case failure = <-t.Errors():
 		}
 	}
-
-	close(errChan)
+	return stop(t, failure)
 }
 
-func startFrontends(httpConfig httpfrontend.Config, udpConfig udpfrontend.Config, logic *middleware.Logic, errChan chan<- error) (httpFrontend *httpfrontend.Frontend, udpFrontend *udpfrontend.Frontend) {
-	if httpConfig.Addr != "" {
-		httpFrontend = httpfrontend.NewFrontend(logic, httpConfig)
-
-		go func() {
-			log.Infoln("started serving HTTP on", httpConfig.Addr)
-			if err := httpFrontend.ListenAndServe(); err != nil {
-				errChan <- errors.New("failed to cleanly shutdown HTTP frontend: " + err.Error())
-			}
-		}()
-	}
-
-	if udpConfig.Addr != "" {
-		udpFrontend = udpfrontend.NewFrontend(logic, udpConfig)
-
-		go func() {
-			log.Infoln("started serving UDP on", udpConfig.Addr)
-			if err := udpFrontend.ListenAndServe(); err != nil {
-				errChan <- errors.New("failed to cleanly shutdown UDP frontend: " + err.Error())
-			}
-		}()
+// stop stops the tracker, returning the error that made it stop, or else
+// the first met while stopping.
+func stop(t *tracker.Tracker, failure error) error {
+	for _, err := range t.Stop() {
+		if failure == nil {
+			failure = err
+		} else {
+			log.Infoln(err)
+		}
 	}
-
-	return
+	return failure
 }
 
 func main() {
@@ -211,9 +128,29 @@ func main() {
 			}
 		},
 	}
-	rootCmd.Flags().String("config", "/etc/chihaya.yaml", "location of configuration file")
+	rootCmd.PersistentFlags().String("config", "/etc/chihaya.yaml", "location of configuration file")
 	rootCmd.Flags().String("cpuprofile", "", "location to save a CPU profile")
 	rootCmd.Flags().Bool("debug", false, "enable debug logging")
+	rootCmd.Flags().Bool("watch", false, "reload when the config file, or a file it references, changes")
+	rootCmd.Flags().Duration("watch-interval", 2*time.Second, "how often to check the watched files")
+	rootCmd.AddCommand(newDBCmd())
+	rootCmd.AddCommand(newPendingCmd())
+	rootCmd.AddCommand(newApprovalsCmd())
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "check-config",
+		Short: "Strictly validate the config file, printing every problem",
+		Run: func(cmd *cobra.Command, args []string) {
+			configFilePath, _ := cmd.Flags().GetString("config")
+			errs := tracker.ValidateConfigFile(configFilePath)
+			for _, err := range errs {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if len(errs) > 0 {
+				log.Fatalf("%s has %d problems", configFilePath, len(errs))
+			}
+			log.Infof("%s is valid", configFilePath)
+		},
+	})
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
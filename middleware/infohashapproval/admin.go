@@ -0,0 +1,240 @@
+package infohashapproval
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// maxImportSize bounds the backups accepted by /admin/import.
+const maxImportSize = 512 << 20
+
+// AdminConfig configures the admin HTTP server. Every request must use
+// basic authentication with Username and Password.
+type AdminConfig struct {
+	// Addr is where the admin server listens, disabled when empty
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// startAdmin serves the admin endpoints until the hook stops:
+//
+//	GET  /admin/export?format=json|binary  backup of both lists
+//	POST /admin/import                     restores a backup
+//	GET  /admin/approvals                  approved infohashes and their metadata
+//	GET  /admin/pending                    unknown infohashes waiting for review
+//	POST /admin/pending/approve?infohash=  whitelists a pending infohash
+//	POST /admin/pending/reject?infohash=   blacklists a pending infohash
+func (h *hook) startAdmin(cfg AdminConfig) error {
+	if cfg.Username == "" || cfg.Password == "" {
+		return errors.New("admin requires a username and password")
+	}
+	h.adminUser = cfg.Username
+	h.adminPassword = cfg.Password
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/export", h.adminAuth(h.serveExport))
+	mux.HandleFunc("/admin/import", h.adminAuth(h.serveImport))
+	mux.HandleFunc("/admin/approvals", h.adminAuth(h.serveApprovals))
+	mux.HandleFunc("/admin/pending", h.adminAuth(h.servePending))
+	mux.HandleFunc("/admin/pending/approve", h.adminAuth(h.servePendingReview(h.ApprovePending)))
+	mux.HandleFunc("/admin/pending/reject", h.adminAuth(h.servePendingReview(h.RejectPending)))
+	if err := h.serveShared("admin", cfg.Addr, mux); err != nil {
+		return err
+	}
+	h.adminAddr = cfg.Addr
+	return nil
+}
+
+func (h *hook) stopAdmin() {
+	if h.adminAddr != "" {
+		h.releaseServer(h.adminAddr)
+	}
+}
+
+func (h *hook) adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(h.adminUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(h.adminPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chihaya"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// serveExport writes a backup of the database, or of the in-memory lists
+// when running without one. No approval is saved while it is read, so the
+// backup is consistent.
+func (h *hook) serveExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "binary" {
+		http.Error(w, "format must be json or binary", http.StatusBadRequest)
+		return
+	}
+
+	b, err := h.Backup()
+	if err != nil {
+		log.Println("Failed to export infohash database: " + err.Error())
+		http.Error(w, "failed to read database", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="chihaya-approvals-`+time.Now().UTC().Format("20060102T150405Z")+`.`+format+`"`)
+	if err := EncodeBackup(w, b, format); err != nil {
+		log.Println("Failed to write infohash export: " + err.Error())
+	}
+}
+
+// serveImport restores a backup in either format into the database and the
+// in-memory lists. Imports are not pushed to replication peers.
+func (h *hook) serveImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := DecodeBackup(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Restore(b); err != nil {
+		log.Println("Failed to import infohash backup: " + err.Error())
+		http.Error(w, "failed to write database", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Imported %d approved and %d blacklisted infohashes\n", len(b.Whitelist), len(b.Blacklist))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveApprovals lists the records of the whitelist as JSON, with the
+// metadata uploaded by signers.
+func (h *hook) serveApprovals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := h.Backup()
+	if err != nil {
+		log.Println("Failed to read infohash database: " + err.Error())
+		http.Error(w, "failed to read database", http.StatusInternalServerError)
+		return
+	}
+
+	approvals := b.Whitelist
+	if approvals == nil {
+		approvals = []Record{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(approvals); err != nil {
+		log.Println("Failed to write approvals: " + err.Error())
+	}
+}
+
+// servePending lists the pending infohashes as JSON, oldest first.
+func (h *hook) servePending(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pending := h.Pending()
+	if pending == nil {
+		pending = []PendingInfohash{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(pending); err != nil {
+		log.Println("Failed to write pending infohashes: " + err.Error())
+	}
+}
+
+// servePendingReview approves or rejects the pending infohash in the
+// infohash parameter with review.
+func (h *hook) servePendingReview(review func(bittorrent.InfoHash) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ihString := r.FormValue("infohash")
+		if err := validInfohash(ihString); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ihBytes, _ := hex.DecodeString(ihString)
+		var ih bittorrent.InfoHash
+		copy(ih[:], ihBytes)
+
+		if !review(ih) {
+			http.Error(w, "infohash is not pending", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *hook) Backup() (*Backup, error) {
+	h.dbLock.Lock()
+	defer h.dbLock.Unlock()
+
+	if h.MiddleWareDatabase == nil {
+		return &Backup{Whitelist: recordsOf(h.approved), Blacklist: recordsOf(h.unapproved)}, nil
+	}
+	return ExportBackup(h.MiddleWareDatabase)
+}
+
+func (h *hook) Restore(b *Backup) error {
+	h.dbLock.Lock()
+	defer h.dbLock.Unlock()
+
+	if h.MiddleWareDatabase != nil {
+		if err := ImportBackup(h.MiddleWareDatabase, b); err != nil {
+			return err
+		}
+	}
+
+	// Changed in bulk so each shard is only copied once
+	whitelist := make([]bittorrent.InfoHash, len(b.Whitelist))
+	for i, r := range b.Whitelist {
+		whitelist[i] = r.InfoHash
+	}
+	blacklist := make([]bittorrent.InfoHash, len(b.Blacklist))
+	for i, r := range b.Blacklist {
+		blacklist[i] = r.InfoHash
+	}
+
+	h.approved.Add(whitelist...)
+	h.unapproved.Remove(whitelist...)
+	h.approved.Remove(blacklist...)
+	h.unapproved.Add(blacklist...)
+	chihayaWhitelistCount.Set(float64(h.approved.Len()))
+	return nil
+}
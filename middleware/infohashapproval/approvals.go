@@ -0,0 +1,75 @@
+package infohashapproval
+
+import (
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// Approvals is the state of a running infohash approval hook, for programs
+// running the tracker in-process. Changes are saved and replicated like
+// those made through announces.
+type Approvals interface {
+	// Approved returns true if the infohash is whitelisted.
+	Approved(ih bittorrent.InfoHash) bool
+
+	// Blacklisted returns true if announces for the infohash are refused.
+	Blacklisted(ih bittorrent.InfoHash) bool
+
+	// Approve whitelists an infohash without a signature. Blacklisted
+	// infohashes are left blacklisted.
+	Approve(ih bittorrent.InfoHash)
+
+	// Revoke moves an infohash from the whitelist to the blacklist.
+	Revoke(ih bittorrent.InfoHash)
+
+	// Backup and Restore work like the admin export and import.
+	Backup() (*Backup, error)
+	Restore(b *Backup) error
+
+	// Pending lists the unknown infohashes waiting for review, oldest
+	// first. ApprovePending whitelists one of them, and RejectPending
+	// blacklists it; both return false if the infohash isn't pending.
+	Pending() []PendingInfohash
+	ApprovePending(ih bittorrent.InfoHash) bool
+	RejectPending(ih bittorrent.InfoHash) bool
+}
+
+var _ Approvals = (*hook)(nil)
+
+func (h *hook) Approved(ih bittorrent.InfoHash) bool {
+	return h.approved.Contains(ih)
+}
+
+func (h *hook) Blacklisted(ih bittorrent.InfoHash) bool {
+	return h.unapproved.Contains(ih)
+}
+
+func (h *hook) Approve(ih bittorrent.InfoHash) {
+	h.approve(approval{infohash: ih})
+}
+
+func (h *hook) Revoke(ih bittorrent.InfoHash) {
+	h.revoke(ih, false)
+}
+
+func (h *hook) Pending() []PendingInfohash {
+	if h.pending == nil {
+		return nil
+	}
+	return h.pending.List()
+}
+
+func (h *hook) ApprovePending(ih bittorrent.InfoHash) bool {
+	if !h.removePending(ih) {
+		return false
+	}
+	h.approve(approval{infohash: ih})
+	return true
+}
+
+func (h *hook) RejectPending(ih bittorrent.InfoHash) bool {
+	if !h.removePending(ih) {
+		return false
+	}
+	h.revoke(ih, false)
+	return true
+}
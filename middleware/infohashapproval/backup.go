@@ -0,0 +1,319 @@
+package infohashapproval
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/FactomProject/factomd/common/interfaces"
+
+	ed "github.com/FactomProject/ed25519"
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// backupMagic starts every backup in the binary format, followed by
+// backupVersion.
+var backupMagic = []byte("CHBK")
+
+const backupVersion = 1
+
+// maxRecordSize bounds the records read from a binary backup.
+const maxRecordSize = 1 << 20
+
+// Backup is a snapshot of the whitelist and blacklist of an approval
+// database, with the details of every approval. It is written as JSON, or
+// in a portable binary format:
+//
+//	"CHBK", version byte
+//	for the whitelist, then the blacklist:
+//	    uint32 count
+//	    count times: 20 byte infohash, uint32 length, encoded Record
+//
+// Integers are big endian, and Records are encoded as in the key/value
+// databases, so a backup can be restored into any database type.
+type Backup struct {
+	Whitelist []Record `json:"whitelist"`
+	Blacklist []Record `json:"blacklist"`
+}
+
+// ExportBackup reads both lists of db.
+func ExportBackup(db Database) (*Backup, error) {
+	whitelist, err := readRecords(db, []byte("whitelist"))
+	if err != nil {
+		return nil, err
+	}
+	blacklist, err := readRecords(db, []byte("blacklist"))
+	if err != nil {
+		return nil, err
+	}
+	return &Backup{Whitelist: whitelist, Blacklist: blacklist}, nil
+}
+
+// ImportBackup saves the records of b in db, replacing any with the same
+// infohash. Whitelisted infohashes are removed from the blacklist, and
+// blacklisted ones from the whitelist; an infohash in both lists of b is
+// only blacklisted. The whole backup is checked before anything is saved,
+// and it is saved in one transaction where db supports it.
+func ImportBackup(db Database, b *Backup) error {
+	if err := b.validate(); err != nil {
+		return err
+	}
+	puts, deletes := b.changes()
+
+	if bw, ok := db.(batchWriter); ok {
+		return bw.WriteBatch(puts, deletes)
+	}
+
+	// Saved before the deletes, so a failed import leaves an infohash in
+	// both lists, where the blacklist wins, rather than in neither
+	if bp, ok := db.(batchPutter); ok {
+		if err := bp.PutInBatch(puts); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range puts {
+			if err := putRecord(db, p.Bucket, *p.Data.(*Record)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, d := range deletes {
+		if err := db.Delete(d.Bucket, d.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate checks that every record of b can be saved.
+func (b *Backup) validate() error {
+	for _, list := range []struct {
+		name    string
+		records []Record
+	}{{"whitelist", b.Whitelist}, {"blacklist", b.Blacklist}} {
+		for i := range list.records {
+			r := &list.records[i]
+			if signer, err := hex.DecodeString(r.Signer); err != nil || (len(signer) != 0 && len(signer) != ed.PublicKeySize) {
+				return fmt.Errorf("invalid %s record for %x: signer %q is not a hex public key", list.name, r.InfoHash, r.Signer)
+			}
+			if len(r.Metadata) > maxRecordSize {
+				return fmt.Errorf("invalid %s record for %x: %d bytes of metadata", list.name, r.InfoHash, len(r.Metadata))
+			}
+		}
+	}
+	return nil
+}
+
+// changes returns the records b saves and the ones it deletes.
+func (b *Backup) changes() (puts, deletes []interfaces.Record) {
+	blacklisted := make(map[bittorrent.InfoHash]bool, len(b.Blacklist))
+	for _, r := range b.Blacklist {
+		blacklisted[r.InfoHash] = true
+	}
+
+	for i := range b.Whitelist {
+		r := &b.Whitelist[i]
+		if blacklisted[r.InfoHash] {
+			continue
+		}
+		puts = append(puts, interfaces.Record{Bucket: []byte("whitelist"), Key: r.InfoHash[:], Data: r})
+		deletes = append(deletes, interfaces.Record{Bucket: []byte("blacklist"), Key: r.InfoHash[:]})
+	}
+	for i := range b.Blacklist {
+		r := &b.Blacklist[i]
+		puts = append(puts, interfaces.Record{Bucket: []byte("blacklist"), Key: r.InfoHash[:], Data: r})
+		deletes = append(deletes, interfaces.Record{Bucket: []byte("whitelist"), Key: r.InfoHash[:]})
+	}
+	return puts, deletes
+}
+
+// readRecords returns every Record of the whitelist or blacklist of db,
+// including expired ones.
+func readRecords(db Database, bucket []byte) ([]Record, error) {
+	if rs, ok := db.(recordStore); ok {
+		return rs.Records(bucket)
+	}
+
+	keys, err := db.ListAllKeys(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		if len(key) != 20 {
+			return nil, fmt.Errorf("%s key %x is not a 20 byte infohash", bucket, key)
+		}
+
+		r := new(Record)
+		copy(r.InfoHash[:], key)
+		found, err := db.Get(bucket, key, r)
+		if err != nil {
+			return nil, err
+		}
+		if found == nil {
+			// Deleted since it was listed
+			continue
+		}
+		records = append(records, *r)
+	}
+	return records, nil
+}
+
+// EncodeBackup writes b to w in format, "json" or "binary".
+func EncodeBackup(w io.Writer, b *Backup, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(b)
+	case "binary":
+		return encodeBinaryBackup(w, b)
+	}
+	return errors.New("unknown backup format " + format)
+}
+
+// DecodeBackup reads a backup written by EncodeBackup in either format.
+func DecodeBackup(r io.Reader) (*Backup, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(backupMagic))
+	if err == nil && bytes.Equal(magic, backupMagic) {
+		return decodeBinaryBackup(br)
+	}
+
+	b := new(Backup)
+	if err := json.NewDecoder(br).Decode(b); err != nil {
+		return nil, errors.New("invalid backup: " + err.Error())
+	}
+	return b, nil
+}
+
+func encodeBinaryBackup(w io.Writer, b *Backup) error {
+	bw := bufio.NewWriter(w)
+	bw.Write(backupMagic)
+	bw.WriteByte(backupVersion)
+
+	for _, records := range [][]Record{b.Whitelist, b.Blacklist} {
+		binary.Write(bw, binary.BigEndian, uint32(len(records)))
+		for i := range records {
+			data, err := records[i].MarshalBinary()
+			if err != nil {
+				return err
+			}
+			bw.Write(records[i].InfoHash[:])
+			binary.Write(bw, binary.BigEndian, uint32(len(data)))
+			bw.Write(data)
+		}
+	}
+	return bw.Flush()
+}
+
+func decodeBinaryBackup(r io.Reader) (*Backup, error) {
+	header := make([]byte, len(backupMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if v := header[len(backupMagic)]; v != backupVersion {
+		return nil, fmt.Errorf("unknown backup version %d", v)
+	}
+
+	b := new(Backup)
+	for _, records := range []*[]Record{&b.Whitelist, &b.Blacklist} {
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, errors.New("invalid backup: " + err.Error())
+		}
+
+		for i := uint32(0); i < count; i++ {
+			var rec Record
+			var n uint32
+			if _, err := io.ReadFull(r, rec.InfoHash[:]); err != nil {
+				return nil, errors.New("invalid backup: " + err.Error())
+			}
+			if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+				return nil, errors.New("invalid backup: " + err.Error())
+			}
+			if n > maxRecordSize {
+				return nil, fmt.Errorf("invalid backup: %d byte record for %x", n, rec.InfoHash)
+			}
+
+			data := make([]byte, n)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, errors.New("invalid backup: " + err.Error())
+			}
+			if _, err := rec.UnmarshalBinaryData(data); err != nil {
+				return nil, fmt.Errorf("invalid backup record for %x: %s", rec.InfoHash, err.Error())
+			}
+			*records = append(*records, rec)
+		}
+	}
+	return b, nil
+}
+
+// recordJSON is how a Record is written in JSON backups.
+type recordJSON struct {
+	InfoHash   string `json:"infohash"`
+	Signer     string `json:"signer,omitempty"`
+	ApprovedAt string `json:"approved_at,omitempty"`
+	ExpiresAt  string `json:"expires_at,omitempty"`
+	Metadata   string `json:"metadata,omitempty"`
+}
+
+// MarshalJSON writes the infohash in hex and the times in RFC3339,
+// leaving out unset fields.
+func (r Record) MarshalJSON() ([]byte, error) {
+	j := recordJSON{
+		InfoHash: hex.EncodeToString(r.InfoHash[:]),
+		Signer:   r.Signer,
+		Metadata: r.Metadata,
+	}
+	if !r.ApprovedAt.IsZero() {
+		j.ApprovedAt = r.ApprovedAt.UTC().Format(time.RFC3339)
+	}
+	if !r.ExpiresAt.IsZero() {
+		j.ExpiresAt = r.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return json.Marshal(j)
+}
+
+func (r *Record) UnmarshalJSON(data []byte) error {
+	var j recordJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	ih, err := hex.DecodeString(j.InfoHash)
+	if err != nil || len(ih) != 20 {
+		return errors.New("Infohash " + j.InfoHash + " must be 20 bytes")
+	}
+
+	*r = Record{Signer: j.Signer, Metadata: j.Metadata}
+	copy(r.InfoHash[:], ih)
+	if j.ApprovedAt != "" {
+		if r.ApprovedAt, err = time.Parse(time.RFC3339, j.ApprovedAt); err != nil {
+			return err
+		}
+	}
+	if j.ExpiresAt != "" {
+		if r.ExpiresAt, err = time.Parse(time.RFC3339, j.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordsOf returns Records without details for infohashes only held in
+// memory.
+func recordsOf(set *infohashSet) []Record {
+	var records []Record
+	set.Each(func(ih bittorrent.InfoHash) {
+		records = append(records, Record{InfoHash: ih})
+	})
+	return records
+}
@@ -0,0 +1,109 @@
+package infohashapproval
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testBackup() *Backup {
+	approved := time.Unix(1500000000, 0)
+	return &Backup{
+		Whitelist: []Record{
+			{InfoHash: testInfohash(1), Signer: strings.Repeat("ab", 32), ApprovedAt: approved, Metadata: `{"name":"one"}`},
+			{InfoHash: testInfohash(2), ApprovedAt: approved, ExpiresAt: approved.Add(time.Hour)},
+			{InfoHash: testInfohash(3)},
+		},
+		Blacklist: []Record{
+			{InfoHash: testInfohash(4), ApprovedAt: approved},
+		},
+	}
+}
+
+func sameRecords(t *testing.T, list string, got, want []Record) {
+	sort.Slice(got, func(i, j int) bool { return bytes.Compare(got[i].InfoHash[:], got[j].InfoHash[:]) < 0 })
+	if len(got) != len(want) {
+		t.Fatalf("%s has %d records, want %d", list, len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.InfoHash != w.InfoHash || g.Signer != w.Signer || g.Metadata != w.Metadata ||
+			!g.ApprovedAt.Equal(w.ApprovedAt) || !g.ExpiresAt.Equal(w.ExpiresAt) {
+			t.Errorf("%s record %d is %+v, want %+v", list, i, g, w)
+		}
+	}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	for _, format := range []string{"json", "binary"} {
+		t.Run(format, func(t *testing.T) {
+			from, _ := NewMapDB()
+			if err := ImportBackup(from, testBackup()); err != nil {
+				t.Fatal(err)
+			}
+			exported, err := ExportBackup(from)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			if err := EncodeBackup(&buf, exported, format); err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := DecodeBackup(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Imported over the opposite lists, which it replaces
+			to, _ := NewMapDB()
+			putRecord(to, []byte("blacklist"), Record{InfoHash: testInfohash(1)})
+			putRecord(to, []byte("whitelist"), Record{InfoHash: testInfohash(4)})
+			if err := ImportBackup(to, decoded); err != nil {
+				t.Fatal(err)
+			}
+
+			restored, err := ExportBackup(to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := testBackup()
+			sameRecords(t, "whitelist", restored.Whitelist, want.Whitelist)
+			sameRecords(t, "blacklist", restored.Blacklist, want.Blacklist)
+		})
+	}
+}
+
+func TestImportBackupInvalid(t *testing.T) {
+	db, _ := NewMapDB()
+	b := testBackup()
+	b.Blacklist[0].Signer = "not hex"
+
+	if err := ImportBackup(db, b); err == nil {
+		t.Fatal("imported a backup with an invalid signer")
+	}
+	exported, err := ExportBackup(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported.Whitelist) != 0 || len(exported.Blacklist) != 0 {
+		t.Errorf("invalid backup saved %d whitelist and %d blacklist records", len(exported.Whitelist), len(exported.Blacklist))
+	}
+}
+
+func TestImportBackupBothLists(t *testing.T) {
+	db, _ := NewMapDB()
+	ih := testInfohash(1)
+	b := &Backup{Whitelist: []Record{{InfoHash: ih}}, Blacklist: []Record{{InfoHash: ih}}}
+	if err := ImportBackup(db, b); err != nil {
+		t.Fatal(err)
+	}
+
+	white, _ := getRecord(db, []byte("whitelist"), ih)
+	black, _ := getRecord(db, []byte("blacklist"), ih)
+	if white != nil || black == nil {
+		t.Errorf("infohash in both lists of a backup was saved in the whitelist %t and blacklist %t", white != nil, black != nil)
+	}
+}
@@ -0,0 +1,392 @@
+package infohashapproval
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/FactomProject/bolt"
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// boltLockTimeout is how long the check waits for the Bolt file lock,
+// which is held for as long as a tracker runs.
+const boltLockTimeout = time.Second
+
+// Problem is something wrong found in a database by CheckDatabase.
+type Problem struct {
+	Bucket string
+	Key    []byte
+	Issue  string
+
+	// Repaired is set when CheckDatabase fixed it
+	Repaired bool
+}
+
+// String prints infohash keys in hex, and other keys as they are.
+func (p Problem) String() string {
+	var s string
+	switch {
+	case len(p.Key) == 0:
+		s = fmt.Sprintf("%s: %s", p.Bucket, p.Issue)
+	case len(p.Key) == 20:
+		s = fmt.Sprintf("%s %x: %s", p.Bucket, p.Key, p.Issue)
+	default:
+		s = fmt.Sprintf("%s %q: %s", p.Bucket, p.Key, p.Issue)
+	}
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// CheckReport is the outcome of CheckDatabase.
+type CheckReport struct {
+	Whitelisted int
+	Blacklisted int
+	Bans        int
+	Pending     int
+	Outbox      int
+	Problems    []Problem
+}
+
+func (r *CheckReport) add(bucket string, key []byte, repaired bool, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, Problem{
+		Bucket:   bucket,
+		Key:      append([]byte(nil), key...),
+		Issue:    fmt.Sprintf(format, args...),
+		Repaired: repaired,
+	})
+}
+
+// CheckDatabase validates the database configured for the hook, without
+// migrating it:
+//
+//   - the Bolt file's pages are consistent
+//   - every whitelist and blacklist key is a 20 byte infohash with a
+//     readable record
+//   - no infohash is in both lists
+//   - the schema version is readable and supported
+//   - every ban is for an IP with a readable, unexpired ban
+//   - every pending infohash is readable and in neither list
+//   - every webhook delivery in the outbox is readable
+//
+// With repair, malformed keys, orphaned bans, pending infohashes already
+// in a list and unreadable deliveries are deleted, unreadable
+// records are rewritten without details and infohashes in both lists are
+// removed from the whitelist, as the blacklist wins on announce. Corrupted
+// Bolt pages can't be repaired; restore a backup instead. The tracker must
+// not be running.
+func CheckDatabase(cfg Config, repair bool) (report *CheckReport, err error) {
+	report = new(CheckReport)
+
+	if cfg.Database == "Bolt" {
+		corrupt, err := checkBoltFile(DatabasePath(cfg), report)
+		if err != nil || corrupt {
+			return report, err
+		}
+	}
+
+	db, err := openDatabase(cfg)
+	if err != nil {
+		return report, err
+	}
+	if db == nil {
+		return report, errors.New("the infohash approval hook has no database")
+	}
+	defer db.Close()
+
+	if err := checkSchemaVersion(db, report); err != nil {
+		return report, err
+	}
+
+	blacklist, err := checkList(db, "blacklist", repair, report)
+	if err != nil {
+		return report, err
+	}
+	report.Blacklisted = len(blacklist)
+
+	whitelist, err := checkList(db, "whitelist", repair, report)
+	if err != nil {
+		return report, err
+	}
+	report.Whitelisted = len(whitelist)
+
+	for key := range whitelist {
+		if _, ok := blacklist[key]; !ok {
+			continue
+		}
+		repaired := false
+		if repair {
+			if err := db.Delete([]byte("whitelist"), []byte(key)); err != nil {
+				return report, err
+			}
+			repaired = true
+			report.Whitelisted--
+		}
+		report.add("whitelist", []byte(key), repaired, "also in the blacklist")
+	}
+
+	if err := checkBans(db, repair, report); err != nil {
+		return report, err
+	}
+	if err := checkPending(db, whitelist, blacklist, repair, report); err != nil {
+		return report, err
+	}
+	return report, checkOutbox(db, repair, report)
+}
+
+// checkBoltFile checks the pages of a Bolt file, reporting whether it is
+// corrupted.
+func checkBoltFile(path string, report *CheckReport) (corrupt bool, err error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			report.add(path, nil, false, "unreadable: %v", r)
+			corrupt, err = true, nil
+		}
+	}()
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltLockTimeout, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		return false, errors.New("the database is locked, stop the tracker first")
+	}
+	if err != nil {
+		report.add(path, nil, false, "unreadable: %s", err.Error())
+		return true, nil
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			corrupt = true
+			report.add(path, nil, false, "%s", err.Error())
+		}
+		return nil
+	})
+	return corrupt, err
+}
+
+func checkSchemaVersion(db Database, report *CheckReport) error {
+	if _, ok := db.(recordStore); ok {
+		return nil
+	}
+
+	version, err := readSchemaVersion(db)
+	if err != nil {
+		report.add("meta", []byte("schema_version"), false, "%s", err.Error())
+		return nil
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", version, schemaVersion)
+	}
+	// Older versions are migrated when the tracker starts
+	return nil
+}
+
+// checkList returns the valid keys of a list.
+func checkList(db Database, bucket string, repair bool, report *CheckReport) (map[string]struct{}, error) {
+	keys, err := db.ListAllKeys([]byte(bucket))
+	if err != nil {
+		return nil, err
+	}
+
+	valid := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if len(key) != 20 {
+			if repair {
+				if err := db.Delete([]byte(bucket), key); err != nil {
+					return nil, err
+				}
+			}
+			report.add(bucket, key, repair, "key is not a 20 byte infohash")
+			continue
+		}
+		valid[string(key)] = struct{}{}
+
+		if _, ok := db.(recordStore); ok {
+			// Rows are typed, there is no record to decode
+			continue
+		}
+
+		v := new(rawValue)
+		if _, err := db.Get([]byte(bucket), key, v); err != nil {
+			return nil, err
+		}
+		if _, err := new(Record).UnmarshalBinaryData(*v); err != nil {
+			if repair {
+				var ih bittorrent.InfoHash
+				copy(ih[:], key)
+				if err := db.Put([]byte(bucket), key, &Record{InfoHash: ih}); err != nil {
+					return nil, err
+				}
+			}
+			report.add(bucket, key, repair, "unreadable record: %s", err.Error())
+		}
+	}
+	return valid, nil
+}
+
+func checkBans(db Database, repair bool, report *CheckReport) error {
+	keys, err := db.ListAllKeys([]byte("bans"))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		issue := ""
+		ban := new(banRecord)
+		if net.ParseIP(string(key)) == nil {
+			issue = "key is not an IP"
+		} else if _, err := db.Get([]byte("bans"), key, ban); err != nil {
+			issue = "unreadable ban: " + err.Error()
+		} else if !ban.Until.After(now) {
+			issue = "ban expired " + ban.Until.Format(time.RFC3339)
+		}
+
+		if issue == "" {
+			report.Bans++
+			continue
+		}
+		if repair {
+			if err := db.Delete([]byte("bans"), key); err != nil {
+				return err
+			}
+		}
+		report.add("bans", key, repair, "%s", issue)
+	}
+	return nil
+}
+
+func checkPending(db Database, whitelist, blacklist map[string]struct{}, repair bool, report *CheckReport) error {
+	keys, err := db.ListAllKeys([]byte("pending"))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		issue := ""
+		if len(key) != 20 {
+			issue = "key is not a 20 byte infohash"
+		} else if _, err := db.Get([]byte("pending"), key, new(PendingInfohash)); err != nil {
+			issue = "unreadable pending infohash: " + err.Error()
+		} else if _, ok := whitelist[string(key)]; ok {
+			issue = "already whitelisted"
+		} else if _, ok := blacklist[string(key)]; ok {
+			issue = "already blacklisted"
+		}
+
+		if issue == "" {
+			report.Pending++
+			continue
+		}
+		if repair {
+			if err := db.Delete([]byte("pending"), key); err != nil {
+				return err
+			}
+		}
+		report.add("pending", key, repair, "%s", issue)
+	}
+	return nil
+}
+
+func checkOutbox(db Database, repair bool, report *CheckReport) error {
+	keys, err := db.ListAllKeys([]byte("outbox"))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		_, err := db.Get([]byte("outbox"), key, new(webhookDelivery))
+		if err == nil {
+			report.Outbox++
+			continue
+		}
+		if repair {
+			if err := db.Delete([]byte("outbox"), key); err != nil {
+				return err
+			}
+		}
+		report.add("outbox", key, repair, "unreadable webhook delivery: %s", err.Error())
+	}
+	return nil
+}
+
+// CompactBoltDatabase rewrites the Bolt file at path with only its live
+// pages, returning its size before and after. A file too damaged to read is
+// left as it is. The tracker must not be running.
+func CompactBoltDatabase(path string) (before, after int64, err error) {
+	src, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltLockTimeout, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		return 0, 0, errors.New("the database is locked, stop the tracker first")
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+
+	tmpPath := path + ".compact"
+	os.Remove(tmpPath)
+	dst, err := bolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = compactBolt(src, dst)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, 0, err
+	}
+
+	if fi, err := os.Stat(path); err == nil {
+		before = fi.Size()
+	}
+	if fi, err := os.Stat(tmpPath); err == nil {
+		after = fi.Size()
+	}
+	return before, after, os.Rename(tmpPath, path)
+}
+
+func compactBolt(src, dst *bolt.DB) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("database too damaged to copy: %v", r)
+		}
+	}()
+
+	return src.View(func(srcTx *bolt.Tx) error {
+		return dst.Update(func(dstTx *bolt.Tx) error {
+			return srcTx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				copied, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(b, copied)
+			})
+		})
+	})
+}
+
+func copyBucket(src, dst *bolt.Bucket) error {
+	// Written in key order, so full pages pack best
+	dst.FillPercent = 1
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			nested, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(src.Bucket(k), nested)
+		}
+		return dst.Put(k, v)
+	})
+}
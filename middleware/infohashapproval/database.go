@@ -1,15 +1,127 @@
 package infohashapproval
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/FactomProject/factomd/common/interfaces"
 	"github.com/FactomProject/factomd/database/hybridDB"
 	"github.com/FactomProject/factomd/database/mapdb"
 )
 
+// Database is the part of factomd's interfaces.IDatabase used by the hook,
+// so it can also be backed by stores that factomd doesn't provide.
+type Database interface {
+	Put(bucket, key []byte, data interfaces.BinaryMarshallable) error
+	Get(bucket, key []byte, destination interfaces.BinaryMarshallable) (interfaces.BinaryMarshallable, error)
+	Delete(bucket, key []byte) error
+	ListAllKeys(bucket []byte) ([][]byte, error)
+	Close() error
+}
+
+// subscriber is implemented by Databases shared between trackers, which
+// report the keys other trackers put or delete.
+type subscriber interface {
+	Subscribe(bucket []byte, closing <-chan struct{}, fn func(key []byte))
+}
+
+// leaser is implemented by Databases shared between trackers, which can
+// lease a key to one of them at a time. A lease ends on its own, so a key
+// leased by a tracker that died is taken up again.
+type leaser interface {
+	// Lease takes the lease on key until the given time, returning false
+	// if another holds it.
+	Lease(bucket, key []byte, until time.Time) (bool, error)
+
+	// Release ends a lease early.
+	Release(bucket, key []byte) error
+}
+
+// batchWriter is implemented by Databases that can make many changes in one
+// transaction.
+type batchWriter interface {
+	WriteBatch(puts, deletes []interfaces.Record) error
+}
+
+// batchPutter is implemented by the factomd databases, which can only put
+// in one transaction.
+type batchPutter interface {
+	PutInBatch(records []interfaces.Record) error
+}
+
+// OpenDatabase opens the database configured for the hook and migrates it
+// to the current schema. It returns nil when running without a database.
+func OpenDatabase(cfg Config) (Database, error) {
+	db, err := openDatabase(cfg)
+	if err != nil || db == nil {
+		return nil, err
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// DatabasePath returns the file of a Bolt or LDB database, or "" for the
+// other types.
+func DatabasePath(cfg Config) string {
+	switch cfg.Database {
+	case "Bolt":
+		return GetHomeDir() + boltPath
+	case "LDB":
+		return GetHomeDir() + ldbPath
+	}
+	return ""
+}
+
+func openDatabase(cfg Config) (Database, error) {
+	var db Database
+	var err error
+
+	switch cfg.Database {
+	case "Map":
+		log.Println("Infohash middleware is running without a database, and will not save")
+		return nil, nil
+	case "Bolt":
+		db, err = NewOrOpenBoltDB(DatabasePath(cfg))
+		if err != nil {
+			return nil, errors.New("Failed to create a bolt database, " + err.Error())
+		}
+
+	case "LDB":
+		db, err = NewOrOpenLevelDB(DatabasePath(cfg))
+		if err != nil {
+			return nil, errors.New("Failed to create a level database, " + err.Error())
+		}
+
+	case "Redis":
+		prefix := cfg.RedisPrefix
+		if prefix == "" {
+			prefix = "chihaya:approval:"
+		}
+		db, err = NewRedisDB(cfg.RedisAddr, cfg.RedisPassword, prefix)
+		if err != nil {
+			return nil, errors.New("Failed to connect to the redis database, " + err.Error())
+		}
+
+	case "SQL":
+		db, err = NewSQLDB(cfg.SQLDriver, os.ExpandEnv(cfg.SQLDSN))
+		if err != nil {
+			return nil, errors.New("Failed to open the sql database, " + err.Error())
+		}
+
+	default:
+		return nil, nil
+	}
+	return db, nil
+}
+
 func NewOrOpenLevelDB(ldbpath string) (interfaces.IDatabase, error) {
 	db, err := hybridDB.NewLevelMapHybridDB(ldbpath, false)
 	if err != nil {
@@ -32,7 +144,7 @@ func NewMapDB() (interfaces.IDatabase, error) {
 	return new(mapdb.MapDB), nil
 }
 
-func NewOrOpenBoltDB(boltPath string) (interfaces.IDatabase, error) {
+func NewOrOpenBoltDB(boltPath string) (db interfaces.IDatabase, err error) {
 	// check if the file exists or if it is a directory
 	fileInfo, err := os.Stat(boltPath)
 	if err == nil {
@@ -53,13 +165,13 @@ func NewOrOpenBoltDB(boltPath string) (interfaces.IDatabase, error) {
 		return nil, err
 	}
 
+	// A corrupted file panics, see chihaya db check
 	defer func() {
 		if r := recover(); r != nil {
-			fmt.Printf("Could not use wallet file \"%s\"\n%v\n", boltPath, r)
-			os.Exit(1)
+			db, err = nil, fmt.Errorf("could not use database file \"%s\": %v", boltPath, r)
 		}
 	}()
-	db := hybridDB.NewBoltMapHybridDB(nil, boltPath)
+	db = hybridDB.NewBoltMapHybridDB(nil, boltPath)
 
 	fmt.Println("Database started from: " + boltPath)
 	return db, nil
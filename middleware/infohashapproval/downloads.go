@@ -0,0 +1,143 @@
+package infohashapproval
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// DownloadsConfig serves the .torrent files and magnet links of approved
+// infohashes on the HTTP frontend.
+type DownloadsConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// AnnounceURLs are the trackers listed in magnet links, in order.
+	// Required, as the Host of a request is chosen by the client.
+	AnnounceURLs []string `yaml:"announce_urls"`
+}
+
+func (cfg DownloadsConfig) validate() error {
+	if cfg.Enabled && len(cfg.AnnounceURLs) == 0 {
+		return errors.New("announce_urls is required")
+	}
+	for _, announceURL := range cfg.AnnounceURLs {
+		u, err := url.Parse(announceURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp") || u.Host == "" {
+			return errors.New("announce url " + announceURL + " must be an http, https or udp URL")
+		}
+	}
+	return nil
+}
+
+// serveTorrent serves the .torrent file uploaded with the metadata of an
+// approved infohash, at /torrents/<hex infohash>.torrent.
+func (h *hook) serveTorrent(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/torrents/")
+	if !strings.HasSuffix(name, ".torrent") {
+		http.NotFound(w, r)
+		return
+	}
+	ih, record, ok := h.downloadable(w, r, strings.TrimSuffix(name, ".torrent"))
+	if !ok {
+		return
+	}
+	if h.MiddleWareDatabase == nil {
+		http.Error(w, "no torrent file for this infohash", http.StatusNotFound)
+		return
+	}
+
+	torrent := new(rawValue)
+	found, err := h.MiddleWareDatabase.Get([]byte("torrents"), ih[:], torrent)
+	if err != nil {
+		log.Printf("Failed to read torrent of %x from database: %s\n", ih, err.Error())
+		http.Error(w, "failed to read database", http.StatusInternalServerError)
+		return
+	}
+	if found == nil {
+		http.Error(w, "no torrent file for this infohash", http.StatusNotFound)
+		return
+	}
+
+	filename := hex.EncodeToString(ih[:])
+	if m := record.ParseMetadata(); m != nil && m.Name != "" {
+		filename = m.Name
+	}
+	chihayaDownloadCount.WithLabelValues("torrent").Inc()
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename + ".torrent"}))
+	w.Write(*torrent)
+}
+
+// serveMagnet serves the magnet URI of an approved infohash as text, at
+// /magnet/<hex infohash>. It works for infohashes without a .torrent too.
+func (h *hook) serveMagnet(w http.ResponseWriter, r *http.Request) {
+	ih, record, ok := h.downloadable(w, r, strings.TrimPrefix(r.URL.Path, "/magnet/"))
+	if !ok {
+		return
+	}
+
+	chihayaDownloadCount.WithLabelValues("magnet").Inc()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(magnetURI(ih, record.ParseMetadata(), h.announceURLs) + "\n"))
+}
+
+// downloadable parses the infohash of a download and checks that it is
+// approved, returning its Record, with no details for infohashes only held
+// in memory. Otherwise it writes the error and returns false.
+func (h *hook) downloadable(w http.ResponseWriter, r *http.Request, ihString string) (bittorrent.InfoHash, Record, bool) {
+	var ih bittorrent.InfoHash
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return ih, Record{}, false
+	}
+
+	ihBytes, err := hex.DecodeString(ihString)
+	if err != nil || len(ihBytes) != 20 {
+		http.NotFound(w, r)
+		return ih, Record{}, false
+	}
+	copy(ih[:], ihBytes)
+
+	// Unapproved infohashes get the same answer as unknown ones.
+	if !h.approved.Contains(ih) || h.unapproved.Contains(ih) {
+		http.NotFound(w, r)
+		return ih, Record{}, false
+	}
+
+	record := Record{InfoHash: ih}
+	if h.MiddleWareDatabase != nil {
+		stored, err := getRecord(h.MiddleWareDatabase, []byte("whitelist"), ih)
+		if err != nil {
+			log.Printf("Failed to read record of %x from database: %s\n", ih, err.Error())
+			http.Error(w, "failed to read database", http.StatusInternalServerError)
+			return ih, Record{}, false
+		}
+		if stored != nil {
+			record = *stored
+		}
+	}
+	return ih, record, true
+}
+
+// magnetURI returns a BEP 9 magnet link to ih, with its name and size when
+// known.
+func magnetURI(ih bittorrent.InfoHash, m *Metadata, announceURLs []string) string {
+	uri := "magnet:?xt=urn:btih:" + hex.EncodeToString(ih[:])
+	if m != nil && m.Name != "" {
+		uri += "&dn=" + url.QueryEscape(m.Name)
+	}
+	if m != nil && m.Size > 0 {
+		uri += "&xl=" + strconv.FormatInt(m.Size, 10)
+	}
+	for _, announceURL := range announceURLs {
+		uri += "&tr=" + url.QueryEscape(announceURL)
+	}
+	return uri
+}
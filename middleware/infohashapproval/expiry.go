@@ -0,0 +1,79 @@
+package infohashapproval
+
+import (
+	"log"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// maxApprovalExpiryInterval is the longest time between two checks for
+// expired approvals.
+const maxApprovalExpiryInterval = time.Hour
+
+// expireApprovals removes expired approvals from the whitelist on startup,
+// then every approval_ttl or hour, whichever is shorter.
+func (h *hook) expireApprovals() {
+	h.removeExpiredApprovals(time.Now())
+
+	interval := h.approvalTTL
+	if interval > maxApprovalExpiryInterval {
+		interval = maxApprovalExpiryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.removeExpiredApprovals(time.Now())
+		case <-h.closing:
+			return
+		}
+	}
+}
+
+// removeExpiredApprovals deletes the whitelist records whose expires_at is
+// before now, and removes their infohashes from the whitelist in memory.
+func (h *hook) removeExpiredApprovals(now time.Time) {
+	records, err := readRecords(h.MiddleWareDatabase, []byte("whitelist"))
+	if err != nil {
+		log.Printf("Failed to read whitelist database for expired approvals: %s\n", err.Error())
+		return
+	}
+
+	for _, r := range records {
+		if r.expired(now) && h.removeExpiredApproval(r.InfoHash, now) {
+			log.Printf("Approval of %x expired on %s\n", r.InfoHash, r.ExpiresAt.Format(time.RFC3339))
+		}
+	}
+}
+
+// removeExpiredApproval removes ih from the whitelist if its record is still
+// expired, as it may have been approved again since it was read.
+func (h *hook) removeExpiredApproval(ih bittorrent.InfoHash, now time.Time) bool {
+	h.dbLock.Lock()
+	defer h.dbLock.Unlock()
+
+	r, err := getRecord(h.MiddleWareDatabase, []byte("whitelist"), ih)
+	if err != nil {
+		log.Printf("Failed to read %x infohash from whitelist database: %s\n", ih, err.Error())
+		return false
+	}
+	if r == nil || !r.expired(now) {
+		return false
+	}
+
+	if err := h.MiddleWareDatabase.Delete([]byte("whitelist"), ih[:]); err != nil {
+		log.Printf("Failed to delete %x infohash from whitelist database: %s\n", ih, err.Error())
+		return false
+	}
+	if h.approved.Remove(ih) > 0 {
+		chihayaWhitelistCount.Dec()
+	}
+	return true
+}
+
+// expired returns true if the approval has an expiry that is not after now.
+func (r *Record) expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !r.ExpiresAt.After(now)
+}
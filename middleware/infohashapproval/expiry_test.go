@@ -0,0 +1,58 @@
+package infohashapproval
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestRemoveExpiredApprovals(t *testing.T) {
+	db, _ := NewMapDB()
+	h := &hook{MiddleWareDatabase: db, approvalTTL: time.Hour}
+	h.approved, _ = newInfohashSet("map")
+	h.unapproved, _ = newInfohashSet("map")
+
+	old, renewed, fresh, forever := testInfohash(1), testInfohash(2), testInfohash(3), testInfohash(4)
+	for _, ih := range []bittorrent.InfoHash{old, renewed, fresh} {
+		h.approve(approval{infohash: ih})
+	}
+	h.approvalTTL = 0
+	h.approve(approval{infohash: forever})
+
+	r, err := getRecord(db, []byte("whitelist"), fresh)
+	if err != nil || r == nil {
+		t.Fatalf("record not saved: %v", err)
+	}
+	if d := r.ExpiresAt.Sub(r.ApprovedAt); d != time.Hour {
+		t.Fatalf("approval expires after %s, want 1h", d)
+	}
+
+	// Approved two hours ago, and renewed since
+	for _, ih := range []bittorrent.InfoHash{old, renewed} {
+		r, _ := getRecord(db, []byte("whitelist"), ih)
+		r.ApprovedAt = r.ApprovedAt.Add(-2 * time.Hour)
+		r.ExpiresAt = r.ExpiresAt.Add(-2 * time.Hour)
+		if err := putRecord(db, []byte("whitelist"), *r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.approvalTTL = time.Hour
+	h.approve(approval{infohash: renewed})
+
+	h.removeExpiredApprovals(time.Now())
+	for ih, want := range map[bittorrent.InfoHash]bool{old: false, renewed: true, fresh: true, forever: true} {
+		if h.Approved(ih) != want {
+			t.Errorf("%x approved is %t, want %t", ih, !want, want)
+		}
+		r, _ := getRecord(db, []byte("whitelist"), ih)
+		if (r != nil) != want {
+			t.Errorf("%x record saved is %t, want %t", ih, r != nil, want)
+		}
+	}
+
+	// Renewed after the sweep read it as expired
+	if h.removeExpiredApproval(fresh, time.Now()) {
+		t.Error("removed an approval that hasn't expired")
+	}
+}
@@ -0,0 +1,60 @@
+package infohashapproval
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Files returns the files the config reads signers and infohashes from, so
+// they can be watched along with the config file.
+func (cfg Config) Files() []string {
+	var files []string
+	if cfg.SignersFile != "" {
+		files = append(files, os.ExpandEnv(cfg.SignersFile))
+	}
+	if cfg.WhitelistFile != "" {
+		files = append(files, os.ExpandEnv(cfg.WhitelistFile))
+	}
+	return files
+}
+
+// readSignersFile reads a keyring: a YAML list of signers, written like the
+// signers of the config.
+func readSignersFile(path string) ([]SignerConfig, error) {
+	contents, err := ioutil.ReadFile(os.ExpandEnv(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var signers []SignerConfig
+	if err := yaml.Unmarshal(contents, &signers); err != nil {
+		return nil, errors.New("invalid signers file " + path + ": " + err.Error())
+	}
+	return signers, nil
+}
+
+// readWhitelistFile reads hex infohashes, one per line. Blank lines and
+// lines starting with # are skipped.
+func readWhitelistFile(path string) ([]string, error) {
+	f, err := os.Open(os.ExpandEnv(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var infohashes []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		infohashes = append(infohashes, line)
+	}
+	return infohashes, scanner.Err()
+}
@@ -19,8 +19,6 @@ import (
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/middleware"
 	"github.com/chihaya/chihaya/pkg/stopper"
-
-	"github.com/FactomProject/factomd/common/interfaces"
 )
 
 // Valid public keys
@@ -39,38 +37,206 @@ var ErrInvalidSignature = bittorrent.ClientError("Invalid Signature")
 // Config represents all the values required by this middleware to validate
 // announce urls based on their BitTorrent Infohash.
 type Config struct {
-	Whitelist []string `yaml:"whitelist"`
-	Blacklist []string `yaml:"blacklist"`
-	Database  string   `yaml:"database"`
-	Signers   []string `yaml:"signers"`
+	Whitelist []string       `yaml:"whitelist"`
+	Blacklist []string       `yaml:"blacklist"`
+	Database  string         `yaml:"database"`
+	Signers   []SignerConfig `yaml:"signers"`
+
+	// SignersFile is a YAML list of more signers, and WhitelistFile a list
+	// of hex infohashes, one per line. Like the config, they are read again
+	// on reload, and whitelisted infohashes are not saved in the database.
+	SignersFile   string `yaml:"signers_file"`
+	WhitelistFile string `yaml:"whitelist_file"`
+
+	// Used by the Redis database, shared by every tracker pointing at the
+	// same server and prefix.
+	RedisAddr     string `yaml:"redis_addr"`
+	RedisPassword string `yaml:"redis_password"`
+	RedisPrefix   string `yaml:"redis_prefix"`
+
+	// Used by the SQL database. SQLDriver is sqlite3 or postgres, and
+	// SQLDSN the data source name passed to it.
+	SQLDriver string `yaml:"sql_driver"`
+	SQLDSN    string `yaml:"sql_dsn"`
+
+	// WhitelistStorage is how the whitelist is held in memory: "map" (the
+	// default), or "sorted" for a compact sorted array, suited to
+	// whitelists of millions of infohashes.
+	WhitelistStorage string `yaml:"whitelist_storage"`
+
+	// SignerExpiryWarning is how long before a signer's not_after date
+	// the tracker starts logging and reporting it as expiring.
+	SignerExpiryWarning time.Duration `yaml:"signer_expiry_warning"`
+
+	// VerifyWorkers is the amount of goroutines checking signatures,
+	// defaulting to the number of CPUs. VerifyQueueSize is how many
+	// signatures may wait for a worker before announces are shed.
+	VerifyWorkers   int `yaml:"verify_workers"`
+	VerifyQueueSize int `yaml:"verify_queue_size"`
+
+	// NegativeCacheSize is how many invalid signatures are remembered so
+	// they are not verified again.
+	NegativeCacheSize int `yaml:"negative_cache_size"`
+
+	// An IP sending more than InvalidSignatureLimit invalid signatures
+	// within InvalidSignatureWindow is banned from signed announces for
+	// BanDuration. A limit of 0 disables banning. With PersistBans, bans
+	// are saved in the database and survive restarts.
+	InvalidSignatureLimit  int           `yaml:"invalid_signature_limit"`
+	InvalidSignatureWindow time.Duration `yaml:"invalid_signature_window"`
+	BanDuration            time.Duration `yaml:"ban_duration"`
+	PersistBans            bool          `yaml:"persist_bans"`
+
+	// Replication pushes approvals and revocations to other trackers, and
+	// syncs their lists on startup. Disabled when it has no addr.
+	Replication ReplicationConfig `yaml:"replication"`
+
+	// Admin serves backups of the database, and restores them.
+	Admin AdminConfig `yaml:"admin"`
+
+	// Webhooks are notified of approvals, revocations and invalid
+	// signatures.
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+
+	// MetadataUpload serves /metadata on the HTTP frontend, where signers
+	// approve an infohash along with its name, size, version and .torrent.
+	MetadataUpload bool `yaml:"metadata_upload"`
+
+	// Downloads serves the .torrent files and magnet links of approved
+	// infohashes on the HTTP frontend.
+	Downloads DownloadsConfig `yaml:"downloads"`
+
+	// Status serves a public page of the approved infohashes and their
+	// swarms on the HTTP frontend.
+	Status StatusConfig `yaml:"status"`
+
+	// Pending records unknown infohashes for review instead of only
+	// refusing them.
+	Pending PendingConfig `yaml:"pending"`
+
+	// ApprovalTTL is how long an approval lasts before the infohash is
+	// removed from the whitelist and must be signed again. Zero keeps
+	// approvals forever. Requires a database.
+	ApprovalTTL time.Duration `yaml:"approval_ttl"`
+}
+
+// approval is an infohash waiting to be added to the whitelist.
+type approval struct {
+	infohash bittorrent.InfoHash
+	signer   string // Hex key of the signer, empty if not signed here
+	metadata string // JSON Metadata, from a metadata upload
+
+	// replicated is true for approvals received from another tracker,
+	// which are not pushed on again.
+	replicated bool
 }
 
 type hook struct {
-	approved   map[bittorrent.InfoHash]struct{}
-	unapproved map[bittorrent.InfoHash]struct{}
+	// Read on every announce without locking, see infohashSet
+	approved   *infohashSet
+	unapproved *infohashSet
 
-	pendingWrites      chan bittorrent.InfoHash // Pending saves to database
-	MiddleWareDatabase interfaces.IDatabase
+	pendingWrites      chan approval // Pending saves to database
+	MiddleWareDatabase Database
 	closing            chan struct{}
-
-	Signers []string
-	// We need 1 write opertation per infohash. The rest is reads,
-	// for that one moment, we will need to lock the map
-	sync.RWMutex
+	writerDone         chan struct{}
+	verifyQueue        chan verifyJob
+	negativeCache      *negativeCache
+	throttle           *throttle
+	replicator         *replicator
+	persistBans        bool
+
+	webhooks       *webhooks // nil without webhooks
+	metadataUpload bool
+	downloads      bool
+	announceURLs   []string    // Of magnet links
+	status         *statusPage // nil without a status page
+
+	// How long approvals last, 0 if forever
+	approvalTTL time.Duration
+
+	// Unknown infohashes waiting for review, nil when disabled
+	pending              *pendingQueue
+	pendingFlushInterval time.Duration
+
+	// Held while writing either list to the database, so backups are
+	// consistent
+	dbLock sync.Mutex
+
+	adminAddr     string
+	adminUser     string
+	adminPassword string
+
+	signers             []signer
+	signerExpiryWarning time.Duration
 }
 
 // NewHook returns an instance of the infohash approval middleware.
-func NewHook(cfg Config) (middleware.Hook, error) {
+func NewHook(cfg Config) (_ middleware.Hook, err error) {
 	InitPrometheus()
 	h := &hook{
-		approved:      make(map[bittorrent.InfoHash]struct{}),
-		unapproved:    make(map[bittorrent.InfoHash]struct{}),
-		pendingWrites: make(chan bittorrent.InfoHash, 25000),
-		closing:       make(chan struct{}),
+		pendingWrites:  make(chan approval, 25000),
+		closing:        make(chan struct{}),
+		writerDone:     make(chan struct{}),
+		verifyQueue:    make(chan verifyJob, verifyQueueSize(cfg)),
+		throttle:       newThrottle(cfg),
+		persistBans:    cfg.PersistBans,
+		metadataUpload: cfg.MetadataUpload,
+		downloads:      cfg.Downloads.Enabled,
+		announceURLs:   cfg.Downloads.AnnounceURLs,
+		approvalTTL:    cfg.ApprovalTTL,
+	}
+
+	if err := cfg.Downloads.validate(); err != nil {
+		return nil, errors.New("downloads: " + err.Error())
+	}
+	if err := cfg.Status.validate(); err != nil {
+		return nil, errors.New("status: " + err.Error())
+	}
+
+	h.approved, err = newInfohashSet(cfg.WhitelistStorage)
+	if err != nil {
+		return nil, err
+	}
+	h.unapproved, _ = newInfohashSet("map")
+
+	negativeCacheSize := cfg.NegativeCacheSize
+	if negativeCacheSize == 0 {
+		negativeCacheSize = defaultNegativeCacheSize
+	}
+	h.negativeCache = newNegativeCache(negativeCacheSize)
+
+	if cfg.Status.Enabled {
+		h.status = newStatusPage(cfg.Status)
+	}
+
+	if len(cfg.Webhooks) > 0 {
+		h.webhooks, err = newWebhooks(cfg.Webhooks)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Pending.Enabled {
+		h.pending = newPendingQueue(cfg.Pending)
+		h.pendingFlushInterval = cfg.Pending.FlushInterval
+		if h.pendingFlushInterval == 0 {
+			h.pendingFlushInterval = defaultPendingFlushInterval
+		}
+	}
+
+	whitelistHexes := cfg.Whitelist
+	if cfg.WhitelistFile != "" {
+		fromFile, err := readWhitelistFile(cfg.WhitelistFile)
+		if err != nil {
+			return nil, err
+		}
+		whitelistHexes = append(whitelistHexes, fromFile...)
 	}
 
 	// Load from Config. If loaded from config, it will not go into the database.
-	for _, ihString := range cfg.Whitelist {
+	var whitelist, blacklist []bittorrent.InfoHash
+	for _, ihString := range whitelistHexes {
 		ihBytes, err := hex.DecodeString(ihString)
 		if err != nil {
 			return nil, err
@@ -81,7 +247,7 @@ func NewHook(cfg Config) (middleware.Hook, error) {
 		}
 		var ih bittorrent.InfoHash
 		copy(ih[:], ihBytes)
-		h.approved[ih] = struct{}{}
+		whitelist = append(whitelist, ih)
 	}
 
 	for _, ihString := range cfg.Blacklist {
@@ -95,55 +261,117 @@ func NewHook(cfg Config) (middleware.Hook, error) {
 		}
 		var ih bittorrent.InfoHash
 		copy(ih[:], ihBytes)
-		h.unapproved[ih] = struct{}{}
+		blacklist = append(blacklist, ih)
 	}
 
-	switch cfg.Database {
-	case "Map":
-		log.Println("Infohash middleware is running without a database, and will not save")
-		h.MiddleWareDatabase = nil
-	case "Bolt":
-		db, err := NewOrOpenBoltDB(GetHomeDir() + boltPath)
-		if err != nil {
-			panic("Failed to create a bolt database, " + err.Error())
-		}
-		h.MiddleWareDatabase = db
-
-	case "LDB":
-		db, err := NewOrOpenLevelDB(GetHomeDir() + boltPath)
-		if err != nil {
-			panic("Failed to create a bolt database, " + err.Error())
-		}
-		h.MiddleWareDatabase = db
+	h.MiddleWareDatabase, err = acquireDatabase(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	go h.writeToDatabase()
+	if h.webhooks != nil {
+		go h.deliverWebhooks()
+	}
+
+	// Undo what was started if the hook can't be created
+	defer func() {
+		if err != nil {
+			h.stop()
+		}
+	}()
 
 	// Load from database and update our map
 	if h.MiddleWareDatabase != nil {
-		whitelist, err := h.MiddleWareDatabase.ListAllKeys([]byte("whitelist"))
+		keys, err := h.MiddleWareDatabase.ListAllKeys([]byte("whitelist"))
 		if err != nil {
-			panic("Could not read database: " + err.Error())
+			return nil, errors.New("Could not read database, see chihaya db check: " + err.Error())
 		}
-		for _, key := range whitelist {
+		for _, key := range keys {
 			var ih bittorrent.InfoHash
 			copy(ih[:], key[:])
-			h.approved[ih] = struct{}{}
-			chihayaWhitelistCount.Inc()
+			whitelist = append(whitelist, ih)
 		}
 
-		blacklist, err := h.MiddleWareDatabase.ListAllKeys([]byte("blacklist"))
+		keys, err = h.MiddleWareDatabase.ListAllKeys([]byte("blacklist"))
 		if err != nil {
-			panic("Could not read database: " + err.Error())
+			return nil, errors.New("Could not read database, see chihaya db check: " + err.Error())
 		}
-		for _, key := range blacklist {
+		for _, key := range keys {
 			var ih bittorrent.InfoHash
 			copy(ih[:], key[:])
-			h.unapproved[ih] = struct{}{}
+			blacklist = append(blacklist, ih)
+		}
+
+		if h.persistBans {
+			if err := h.loadBans(); err != nil {
+				return nil, errors.New("Could not read bans from database, see chihaya db check: " + err.Error())
+			}
+		}
+
+		if h.pending != nil {
+			if err := h.loadPending(); err != nil {
+				return nil, errors.New("Could not read pending infohashes from database, see chihaya db check: " + err.Error())
+			}
+		}
+	}
+	go h.expireBans()
+	if h.approvalTTL > 0 && h.MiddleWareDatabase != nil {
+		go h.expireApprovals()
+	}
+
+	// Added in bulk so each shard is only copied once
+	h.approved.Add(whitelist...)
+	h.unapproved.Add(blacklist...)
+	chihayaWhitelistCount.Set(float64(h.approved.Len()))
+
+	// Follow the changes made by other trackers sharing the database
+	if sub, ok := h.MiddleWareDatabase.(subscriber); ok {
+		h.follow(sub)
+	}
+
+	signerCfgs := cfg.Signers
+	if cfg.SignersFile != "" {
+		fromFile, err := readSignersFile(cfg.SignersFile)
+		if err != nil {
+			return nil, err
+		}
+		signerCfgs = append(signerCfgs, fromFile...)
+	}
+
+	for _, signerCfg := range signerCfgs {
+		s, err := newSigner(signerCfg)
+		if err != nil {
+			return nil, err
 		}
+		h.signers = append(h.signers, s)
 	}
 
-	h.Signers = cfg.Signers
+	h.signerExpiryWarning = cfg.SignerExpiryWarning
+	if h.signerExpiryWarning == 0 {
+		h.signerExpiryWarning = defaultSignerExpiryWarning
+	}
+	go h.watchSignerExpiry()
+
+	if cfg.Replication.Addr != "" {
+		h.replicator, err = newReplicator(cfg.Replication)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.startReplication(cfg.Replication.Addr); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Admin.Addr != "" {
+		if err := h.startAdmin(cfg.Admin); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 0; i < verifyWorkers(cfg); i++ {
+		go h.verifyWorker()
+	}
 
 	return h, nil
 }
@@ -157,39 +385,148 @@ func (h *hook) Stop() <-chan error {
 	}
 	c := make(chan error)
 	go func() {
-		h.closing <- struct{}{}
-		//close(h.closing)
+		h.stop()
 		close(c)
 	}()
 	return c
 }
 
+// stop stops everything the hook started, and releases its database once
+// no more writes are pending.
+func (h *hook) stop() {
+	close(h.closing)
+	h.stopReplication()
+	h.stopAdmin()
+	<-h.writerDone
+	if h.webhooks != nil {
+		<-h.webhooks.done
+	}
+	releaseDatabase(h.MiddleWareDatabase)
+}
+
 func (h *hook) writeToDatabase() {
+	defer close(h.writerDone)
+
+	// The pending queue is saved along with the approvals
+	var flush <-chan time.Time
+	if h.pending != nil {
+		ticker := time.NewTicker(h.pendingFlushInterval)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+
 	for {
 		select {
-		case ih := <-h.pendingWrites:
-			h.Lock()
-			h.approved[ih] = struct{}{}
-			h.Unlock()
-			chihayaWhitelistCount.Inc()
-
-			if h.MiddleWareDatabase != nil {
-				var b [20]byte
-				copy(b[:], ih[:])
-
-				t := new(EmptyStruct)
-				err := h.MiddleWareDatabase.Put([]byte("whitelist"), b[:], t)
-				if err != nil {
-					log.Printf("Failed to write %x infohash to whitelist database: %s\n", b, err.Error())
-				}
-			}
+		case a := <-h.pendingWrites:
+			h.approve(a)
+		case <-flush:
+			h.savePending()
 		case <-h.closing:
+			h.drainWrites()
+			h.savePending()
 			log.Println("InfohashApproval Stopped")
 			return
 		}
 	}
 }
 
+// drainWrites saves the approvals still queued when the hook stops.
+func (h *hook) drainWrites() {
+	for {
+		select {
+		case a := <-h.pendingWrites:
+			h.approve(a)
+		default:
+			return
+		}
+	}
+}
+
+// approve adds an infohash to the whitelist and saves it, unless it is
+// blacklisted.
+func (h *hook) approve(a approval) {
+	ih := a.infohash
+	// A revoked infohash stays revoked, whoever signs it again.
+	if h.unapproved.Contains(ih) {
+		h.removePending(ih)
+		return
+	}
+
+	// Saved before it is whitelisted in memory, so an expiry sweep that
+	// read the previous record can't remove it afterwards.
+	if h.MiddleWareDatabase != nil {
+		r := Record{
+			InfoHash:   ih,
+			Signer:     a.signer,
+			ApprovedAt: time.Now(),
+			Metadata:   a.metadata,
+		}
+		if h.approvalTTL > 0 {
+			r.ExpiresAt = r.ApprovedAt.Add(h.approvalTTL)
+		}
+
+		h.dbLock.Lock()
+		err := putRecord(h.MiddleWareDatabase, []byte("whitelist"), r)
+		h.dbLock.Unlock()
+		if err != nil {
+			log.Printf("Failed to write %x infohash to whitelist database: %s\n", ih, err.Error())
+		}
+	}
+	if h.approved.Add(ih) > 0 {
+		chihayaWhitelistCount.Inc()
+	}
+	h.removePending(ih)
+
+	if !a.replicated {
+		h.replicate("approve", ih)
+		h.notify(WebhookApprove, ih, a.signer, "")
+	}
+}
+
+// follow keeps the lists in memory in step with the whitelist and blacklist
+// of a database shared with other trackers, until the hook is stopped.
+func (h *hook) follow(sub subscriber) {
+	changed := func(key []byte) {
+		var ih bittorrent.InfoHash
+		copy(ih[:], key)
+		h.reload(ih)
+	}
+	go sub.Subscribe([]byte("whitelist"), h.closing, changed)
+	go sub.Subscribe([]byte("blacklist"), h.closing, changed)
+}
+
+// reload reads an infohash changed by another tracker back from the
+// database. Whether it was approved, revoked, blacklisted or expired, the
+// records say what it is now, whatever order the changes arrive in.
+func (h *hook) reload(ih bittorrent.InfoHash) {
+	h.dbLock.Lock()
+	white, err := getRecord(h.MiddleWareDatabase, []byte("whitelist"), ih)
+	var black *Record
+	if err == nil {
+		black, err = getRecord(h.MiddleWareDatabase, []byte("blacklist"), ih)
+	}
+	h.dbLock.Unlock()
+	if err != nil {
+		log.Printf("Failed to read %x infohash changed by another tracker: %s\n", ih, err.Error())
+		return
+	}
+
+	if black != nil {
+		h.unapproved.Add(ih)
+	} else {
+		h.unapproved.Remove(ih)
+	}
+
+	if black == nil && white != nil && !white.expired(time.Now()) {
+		if h.approved.Add(ih) > 0 {
+			chihayaWhitelistCount.Inc()
+		}
+		h.removePending(ih)
+	} else if h.approved.Remove(ih) > 0 {
+		chihayaWhitelistCount.Dec()
+	}
+}
+
 func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
 	start := time.Now().UnixNano()
 	defer chihayaAnnounceResponseTime.Observe(float64(time.Now().UnixNano()-start) / 1e9)
@@ -198,68 +535,83 @@ func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceReque
 	var b [20]byte
 	copy(b[:], infohash[:])
 
-	str, sigExists := req.Params.String("sig")
-	h.RLock()
-	_, whitlisted := h.approved[infohash]
-	h.RUnlock()
+	str, sigExists := requestParam(req, "sig")
+	whitlisted := h.approved.Contains(infohash)
 	chihayaAnnounceCount.Add(1)
 	// log.Infof("Announce recieved for infohash %x. Whitelisted: %t", b, whitlisted)
 	// If already whitelisted, we do not care
 	if sigExists && !whitlisted {
+		ip := req.Peer.IP.String()
+		if h.throttle.Banned(ip) {
+			chihayaAnnounceBannedCount.Inc()
+			return ctx, ErrBanned
+		}
+
 		// We have a signed infohash
 		signature, err := hex.DecodeString(str)
 		if err != nil || len(signature) != ed.SignatureSize {
 			chihayaWhitelistFail.Add(1)
+			h.signatureFailed(infohash, ip)
 			return ctx, ErrInvalidSignature
 		}
 
-		var sigFixed [ed.SignatureSize]byte
-		copy(sigFixed[:], signature[:])
-
-		for _, k := range h.Signers {
-			key, err := hex.DecodeString(k)
-			if err != nil || len(key) != ed.PublicKeySize {
-				continue
+		key := negativeKey{infohash: b}
+		copy(key.sig[:], signature[:])
+
+		if h.negativeCache.Contains(key) {
+			// Already known to be invalid, skip verifying it again
+			chihayaNegativeCacheHitCount.Inc()
+			h.signatureFailed(infohash, ip)
+		} else {
+			result, err := h.verifySignature(ctx, b, key.sig)
+			if err != nil {
+				return ctx, err
 			}
 
-			var pubKey [ed.PublicKeySize]byte
-			copy(pubKey[:], key[:])
-
-			valid := ed.VerifyCanonical(&pubKey, b[:], &sigFixed)
-			if valid {
-				/*h.Lock()
-				h.approved[infohash] = struct{}{}
-				h.Unlock()*/
-
-				h.pendingWrites <- infohash
-
-				break
+			if result.signer != "" {
+				h.pendingWrites <- approval{infohash: infohash, signer: result.signer}
+			} else {
+				if result.permanent {
+					h.negativeCache.Add(key)
+				}
+				h.signatureFailed(infohash, ip)
 			}
 		}
 	}
 
-	h.RLock()
-	defer h.RUnlock()
 	// In blacklist
-	if len(h.unapproved) > 0 {
-		if _, found := h.unapproved[infohash]; found {
+	if h.unapproved.Len() > 0 {
+		if h.unapproved.Contains(infohash) {
 			chihayaAnnounceBlacklistCount.Add(1)
 			return ctx, ErrInfohashUnapproved
 		}
 	}
 
 	// In whitelist
-	if len(h.approved) > 0 {
-		if _, found := h.approved[infohash]; found {
+	if h.approved.Len() > 0 {
+		if h.approved.Contains(infohash) {
 			chihayaAnnounceWhitelistCount.Add(1)
 			return ctx, nil
 		}
 	}
 
 	chihayaAnnounceNolistCount.Add(1)
+	if h.pending != nil && !sigExists {
+		h.recordPending(infohash, req.Peer.IP.String())
+	}
 	return ctx, ErrInfohashUnapproved
 }
 
+// requestParam returns a query parameter of an announce. Over UDP the
+// parameters come from the BEP 41 URL data, and Params can be nil when an
+// announce carries none.
+func requestParam(req *bittorrent.AnnounceRequest, key string) (string, bool) {
+	if req.Params == nil {
+		return "", false
+	}
+	return req.Params.String(key)
+}
+
 func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
 	// Scrapes don't require any protection.
 	chihayaScrapCount.Add(1)
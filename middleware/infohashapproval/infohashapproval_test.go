@@ -0,0 +1,35 @@
+package infohashapproval
+
+import (
+	"testing"
+)
+
+func TestStopSavesQueuedWrites(t *testing.T) {
+	db, _ := NewMapDB()
+	h := &hook{
+		MiddleWareDatabase: db,
+		pendingWrites:      make(chan approval, 16),
+		closing:            make(chan struct{}),
+		writerDone:         make(chan struct{}),
+	}
+	h.approved, _ = newInfohashSet("map")
+	h.unapproved, _ = newInfohashSet("map")
+
+	// Queued before the writer runs, so only the drain on stop saves them
+	queued := []approval{{infohash: testInfohash(1)}, {infohash: testInfohash(2), signer: "ab"}}
+	for _, a := range queued {
+		h.pendingWrites <- a
+	}
+	close(h.closing)
+	h.writeToDatabase()
+
+	for _, a := range queued {
+		r, err := getRecord(db, []byte("whitelist"), a.infohash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r == nil || r.Signer != a.signer {
+			t.Errorf("approval of %x queued on stop was saved as %v", a.infohash, r)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package infohashapproval
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	ed "github.com/FactomProject/ed25519"
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+const (
+	// metadataSignatureHeader carries the hex ed25519 signature of the body
+	// of a metadata upload, by one of the signers.
+	metadataSignatureHeader = "X-Chihaya-Signature"
+
+	// maxMetadataSize bounds the body of an upload, including a .torrent
+	// encoded in base64.
+	maxMetadataSize = 16 << 20
+)
+
+// Metadata describes the torrent of an approved infohash. It is saved as
+// JSON in the Metadata of its Record.
+type Metadata struct {
+	Name    string `json:"name,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Version string `json:"version,omitempty"` // Release tag, e.g. v6.1.0
+}
+
+// ParseMetadata returns the Metadata of a Record, or nil if it has none or
+// it was not written by a metadata upload.
+func (r Record) ParseMetadata() *Metadata {
+	if r.Metadata == "" {
+		return nil
+	}
+	m := new(Metadata)
+	if err := json.Unmarshal([]byte(r.Metadata), m); err != nil {
+		return nil
+	}
+	return m
+}
+
+// MetadataUpload is the JSON body of a metadata upload. Torrent is an
+// optional .torrent file, base64 encoded in JSON; the name and size are
+// taken from it when not given.
+type MetadataUpload struct {
+	InfoHash string `json:"infohash"`
+	Metadata
+	Torrent []byte `json:"torrent,omitempty"`
+}
+
+// Routes returns the endpoints the hook serves on the HTTP frontend:
+//
+//	POST /metadata                    approves an infohash with its metadata
+//	GET  /torrents/<infohash>.torrent  the .torrent of an approved infohash
+//	GET  /magnet/<infohash>            the magnet link of an approved infohash
+//	GET  /status, /status.json         the approved infohashes and their swarms
+//	GET  /status.atom                  a feed of the latest approvals
+func (h *hook) Routes() map[string]http.Handler {
+	routes := make(map[string]http.Handler)
+	if h.metadataUpload {
+		routes["/metadata"] = http.HandlerFunc(h.serveMetadataUpload)
+	}
+	if h.downloads {
+		routes["/torrents/"] = http.HandlerFunc(h.serveTorrent)
+		routes["/magnet/"] = http.HandlerFunc(h.serveMagnet)
+	}
+	if h.status != nil {
+		routes["/status"] = http.HandlerFunc(h.serveStatus)
+		routes["/status.json"] = http.HandlerFunc(h.serveStatus)
+		routes["/status.atom"] = http.HandlerFunc(h.serveStatusFeed)
+	}
+	return routes
+}
+
+// serveMetadataUpload approves the infohash of a MetadataUpload signed by
+// one of the signers, saving the metadata in its record and the .torrent,
+// if any, in the torrents bucket. As the signer vouches for the infohash
+// named in the body, this works like a signed announce, except that a
+// blacklisted infohash stays refused.
+func (h *hook) serveMetadataUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxMetadataSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sig, err := hex.DecodeString(r.Header.Get(metadataSignatureHeader))
+	if err != nil || len(sig) != ed.SignatureSize {
+		http.Error(w, ErrInvalidSignature.Error(), http.StatusForbidden)
+		return
+	}
+	var sigFixed [ed.SignatureSize]byte
+	copy(sigFixed[:], sig)
+	signer := h.verify(body, &sigFixed)
+	if signer == "" {
+		http.Error(w, ErrInvalidSignature.Error(), http.StatusForbidden)
+		return
+	}
+
+	var upload MetadataUpload
+	if err := json.Unmarshal(body, &upload); err != nil {
+		http.Error(w, "invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ih, m, err := upload.validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if h.unapproved.Contains(ih) {
+		http.Error(w, ErrInfohashUnapproved.Error(), http.StatusForbidden)
+		return
+	}
+
+	metadata, err := json.Marshal(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(upload.Torrent) > 0 && h.MiddleWareDatabase != nil {
+		torrent := rawValue(upload.Torrent)
+		h.dbLock.Lock()
+		err := h.MiddleWareDatabase.Put([]byte("torrents"), ih[:], &torrent)
+		h.dbLock.Unlock()
+		if err != nil {
+			log.Printf("Failed to write torrent of %x to database: %s\n", ih, err.Error())
+			http.Error(w, "failed to write database", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h.approve(approval{infohash: ih, signer: signer, metadata: string(metadata)})
+	log.Printf("Approved %x with metadata from signer %s\n", ih, signer)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validate checks the infohash of an upload, and that its .torrent hashes
+// to it, returning the metadata to save.
+func (u MetadataUpload) validate() (bittorrent.InfoHash, Metadata, error) {
+	var ih bittorrent.InfoHash
+	if err := validInfohash(u.InfoHash); err != nil {
+		return ih, u.Metadata, err
+	}
+	ihBytes, _ := hex.DecodeString(u.InfoHash)
+	copy(ih[:], ihBytes)
+
+	m := u.Metadata
+	if len(u.Torrent) > 0 {
+		mi, err := parseMetainfo(u.Torrent)
+		if err != nil {
+			return ih, m, errors.New("invalid torrent: " + err.Error())
+		}
+		if mi.InfoHash != ih {
+			return ih, m, errors.New("torrent hashes to " + hex.EncodeToString(mi.InfoHash[:]) + ", not " + u.InfoHash)
+		}
+		if m.Name == "" {
+			m.Name = mi.Name
+		}
+		if m.Size == 0 {
+			m.Size = mi.Size
+		} else if m.Size != mi.Size {
+			return ih, m, errors.New("size doesn't match the torrent")
+		}
+	}
+	if m.Size < 0 {
+		return ih, m, errors.New("size must not be negative")
+	}
+	return ih, m, nil
+}
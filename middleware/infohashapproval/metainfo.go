@@ -0,0 +1,62 @@
+package infohashapproval
+
+import (
+	"crypto/sha1"
+	"errors"
+
+	"github.com/FactomProject/chihaya/bencode"
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// metainfo is what the tracker reads from an uploaded .torrent file.
+type metainfo struct {
+	InfoHash bittorrent.InfoHash // SHA-1 of the bencoded info dictionary
+	Name     string
+	Size     int64 // Total length of the files
+}
+
+// parseMetainfo reads a .torrent file, hashing its info dictionary exactly
+// as it was encoded.
+func parseMetainfo(torrent []byte) (*metainfo, error) {
+	if len(torrent) == 0 || torrent[0] != 'd' {
+		return nil, errors.New("torrent is not a bencoded dictionary")
+	}
+
+	var rawInfo []byte
+	var info map[string]interface{}
+	rest := torrent[1:]
+	for len(rest) > 0 && rest[0] != 'e' {
+		key, afterKey, err := bencode.DecodeString(rest)
+		if err != nil {
+			return nil, err
+		}
+		value, afterValue, err := bencode.DecodeValue(afterKey)
+		if err != nil {
+			return nil, err
+		}
+		if key == "info" {
+			rawInfo = afterKey[:len(afterKey)-len(afterValue)]
+			info, _ = value.(map[string]interface{})
+		}
+		rest = afterValue
+	}
+	if len(rest) != 1 {
+		return nil, errors.New("torrent is not a single bencoded dictionary")
+	}
+	if info == nil {
+		return nil, errors.New("torrent has no info dictionary")
+	}
+
+	m := &metainfo{InfoHash: bittorrent.InfoHash(sha1.Sum(rawInfo))}
+	m.Name, _ = info["name"].(string)
+	if length, ok := info["length"].(int64); ok {
+		m.Size = length
+	}
+	files, _ := info["files"].([]interface{})
+	for _, f := range files {
+		file, _ := f.(map[string]interface{})
+		length, _ := file["length"].(int64)
+		m.Size += length
+	}
+	return m, nil
+}
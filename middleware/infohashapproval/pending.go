@@ -0,0 +1,359 @@
+package infohashapproval
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+const (
+	defaultPendingMaxInfohashes = 10000
+	defaultPendingMaxIPs        = 10
+	defaultPendingFlushInterval = 10 * time.Second
+	defaultPendingMaxAge        = 30 * 24 * time.Hour
+
+	pendingVersion = 1
+)
+
+// PendingConfig configures the pending queue: unsigned announces of
+// infohashes in neither list are still refused, but recorded for operators
+// to approve or reject. It requires a database.
+type PendingConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// MaxInfohashes bounds the queue, further unknown infohashes are not
+	// recorded until some are approved or rejected. MaxIPs is how many
+	// source IPs are kept per infohash.
+	MaxInfohashes int `yaml:"max_infohashes"`
+	MaxIPs        int `yaml:"max_ips"`
+
+	// FlushInterval is how often the queue is saved to the database.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+
+	// MaxAge drops infohashes that haven't been announced for that long,
+	// so the queue doesn't stay full of abandoned ones.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// PendingInfohash is an unknown infohash waiting for review.
+type PendingInfohash struct {
+	InfoHash  bittorrent.InfoHash
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Count     uint64   // Announces refused
+	IPs       []string // The first IPs it was announced from
+}
+
+// pendingQueue holds the pending infohashes in memory, and which of them
+// changed since they were last saved.
+type pendingQueue struct {
+	maxInfohashes int
+	maxIPs        int
+	maxAge        time.Duration
+	entries       map[bittorrent.InfoHash]*PendingInfohash
+	dirty         map[bittorrent.InfoHash]struct{}
+	sync.Mutex
+}
+
+func newPendingQueue(cfg PendingConfig) *pendingQueue {
+	q := &pendingQueue{
+		maxInfohashes: cfg.MaxInfohashes,
+		maxIPs:        cfg.MaxIPs,
+		maxAge:        cfg.MaxAge,
+		entries:       make(map[bittorrent.InfoHash]*PendingInfohash),
+		dirty:         make(map[bittorrent.InfoHash]struct{}),
+	}
+	if q.maxInfohashes == 0 {
+		q.maxInfohashes = defaultPendingMaxInfohashes
+	}
+	if q.maxIPs == 0 {
+		q.maxIPs = defaultPendingMaxIPs
+	}
+	if q.maxAge == 0 {
+		q.maxAge = defaultPendingMaxAge
+	}
+	return q
+}
+
+// Seen records a refused announce of ih from ip. It returns false when the
+// queue is full, until entries are reviewed or expire.
+func (q *pendingQueue) Seen(ih bittorrent.InfoHash, ip string, now time.Time) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	p, ok := q.entries[ih]
+	if !ok {
+		if len(q.entries) >= q.maxInfohashes {
+			return false
+		}
+		p = &PendingInfohash{InfoHash: ih, FirstSeen: now}
+		q.entries[ih] = p
+		chihayaPendingCount.Set(float64(len(q.entries)))
+	}
+
+	p.LastSeen = now
+	p.Count++
+	if len(p.IPs) < q.maxIPs && !containsString(p.IPs, ip) {
+		p.IPs = append(p.IPs, ip)
+	}
+	q.dirty[ih] = struct{}{}
+	return true
+}
+
+// Load adds entries read from the database.
+func (q *pendingQueue) Load(entries []PendingInfohash) {
+	q.Lock()
+	defer q.Unlock()
+	for i := range entries {
+		q.entries[entries[i].InfoHash] = &entries[i]
+	}
+	chihayaPendingCount.Set(float64(len(q.entries)))
+}
+
+// Remove takes ih out of the queue, returning false if it wasn't pending.
+func (q *pendingQueue) Remove(ih bittorrent.InfoHash) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if _, ok := q.entries[ih]; !ok {
+		return false
+	}
+	delete(q.entries, ih)
+	delete(q.dirty, ih)
+	chihayaPendingCount.Set(float64(len(q.entries)))
+	return true
+}
+
+// Expire removes the entries last seen more than maxAge before now,
+// returning their infohashes.
+func (q *pendingQueue) Expire(now time.Time) []bittorrent.InfoHash {
+	q.Lock()
+	defer q.Unlock()
+
+	var expired []bittorrent.InfoHash
+	for ih, p := range q.entries {
+		if now.Sub(p.LastSeen) > q.maxAge {
+			delete(q.entries, ih)
+			delete(q.dirty, ih)
+			expired = append(expired, ih)
+		}
+	}
+	chihayaPendingCount.Set(float64(len(q.entries)))
+	return expired
+}
+
+// List returns copies of the pending infohashes, oldest first.
+func (q *pendingQueue) List() []PendingInfohash {
+	q.Lock()
+	list := make([]PendingInfohash, 0, len(q.entries))
+	for _, p := range q.entries {
+		list = append(list, p.copy())
+	}
+	q.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].FirstSeen.Equal(list[j].FirstSeen) {
+			return bytes.Compare(list[i].InfoHash[:], list[j].InfoHash[:]) < 0
+		}
+		return list[i].FirstSeen.Before(list[j].FirstSeen)
+	})
+	return list
+}
+
+// TakeDirty returns copies of the entries changed since the last call.
+func (q *pendingQueue) TakeDirty() []PendingInfohash {
+	q.Lock()
+	defer q.Unlock()
+
+	dirty := make([]PendingInfohash, 0, len(q.dirty))
+	for ih := range q.dirty {
+		dirty = append(dirty, q.entries[ih].copy())
+	}
+	q.dirty = make(map[bittorrent.InfoHash]struct{})
+	return dirty
+}
+
+func (p *PendingInfohash) copy() PendingInfohash {
+	c := *p
+	c.IPs = append([]string(nil), p.IPs...)
+	return c
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// recordPending queues an unknown infohash announced without a signature.
+func (h *hook) recordPending(ih bittorrent.InfoHash, ip string) {
+	if !h.pending.Seen(ih, ip, time.Now()) {
+		chihayaPendingDroppedCount.Inc()
+	}
+}
+
+// loadPending reads the queue saved in the database.
+func (h *hook) loadPending() error {
+	keys, err := h.MiddleWareDatabase.ListAllKeys([]byte("pending"))
+	if err != nil {
+		return err
+	}
+
+	entries := make([]PendingInfohash, 0, len(keys))
+	for _, key := range keys {
+		p := new(PendingInfohash)
+		if _, err := h.MiddleWareDatabase.Get([]byte("pending"), key, p); err != nil {
+			return err
+		}
+		copy(p.InfoHash[:], key)
+		entries = append(entries, *p)
+	}
+	h.pending.Load(entries)
+	return nil
+}
+
+// savePending deletes the expired entries of the queue and writes the ones
+// that changed. It holds the database lock so an entry being approved or
+// rejected isn't written back.
+func (h *hook) savePending() {
+	if h.pending == nil || h.MiddleWareDatabase == nil {
+		return
+	}
+
+	h.dbLock.Lock()
+	defer h.dbLock.Unlock()
+	for _, ih := range h.pending.Expire(time.Now()) {
+		if err := h.MiddleWareDatabase.Delete([]byte("pending"), ih[:]); err != nil {
+			log.Printf("Failed to delete expired pending infohash %x from database: %s\n", ih, err.Error())
+		}
+	}
+	for _, p := range h.pending.TakeDirty() {
+		if err := h.MiddleWareDatabase.Put([]byte("pending"), p.InfoHash[:], &p); err != nil {
+			log.Printf("Failed to write pending infohash %x to database: %s\n", p.InfoHash, err.Error())
+		}
+	}
+}
+
+// removePending takes an approved or rejected infohash out of the queue.
+func (h *hook) removePending(ih bittorrent.InfoHash) bool {
+	if h.pending == nil {
+		return false
+	}
+
+	h.dbLock.Lock()
+	defer h.dbLock.Unlock()
+	if !h.pending.Remove(ih) {
+		return false
+	}
+	if h.MiddleWareDatabase != nil {
+		if err := h.MiddleWareDatabase.Delete([]byte("pending"), ih[:]); err != nil {
+			log.Printf("Failed to delete pending infohash %x from database: %s\n", ih, err.Error())
+		}
+	}
+	return true
+}
+
+// MarshalBinary encodes the entry, without the infohash which is the key, as
+// the version byte, the first and last seen times in unix seconds, the
+// count, and the IPs each prefixed by their length.
+func (p *PendingInfohash) MarshalBinary() ([]byte, error) {
+	if len(p.IPs) > 255 {
+		return nil, errors.New("too many IPs in pending infohash")
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(pendingVersion)
+	binary.Write(buf, binary.BigEndian, p.FirstSeen.Unix())
+	binary.Write(buf, binary.BigEndian, p.LastSeen.Unix())
+	binary.Write(buf, binary.BigEndian, p.Count)
+	buf.WriteByte(byte(len(p.IPs)))
+	for _, ip := range p.IPs {
+		if len(ip) > 255 {
+			return nil, errors.New("invalid IP " + ip)
+		}
+		buf.WriteByte(byte(len(ip)))
+		buf.WriteString(ip)
+	}
+	return buf.Bytes(), nil
+}
+
+func (p *PendingInfohash) UnmarshalBinary(data []byte) error {
+	_, err := p.UnmarshalBinaryData(data)
+	return err
+}
+
+func (p *PendingInfohash) UnmarshalBinaryData(data []byte) ([]byte, error) {
+	ih := p.InfoHash
+	*p = PendingInfohash{InfoHash: ih}
+
+	if len(data) < 26 {
+		return nil, errors.New("pending infohash too short")
+	}
+	if data[0] != pendingVersion {
+		return nil, errors.New("unknown pending infohash version")
+	}
+	p.FirstSeen = time.Unix(int64(binary.BigEndian.Uint64(data[1:9])), 0)
+	p.LastSeen = time.Unix(int64(binary.BigEndian.Uint64(data[9:17])), 0)
+	p.Count = binary.BigEndian.Uint64(data[17:25])
+	n := int(data[25])
+	data = data[26:]
+
+	for i := 0; i < n; i++ {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return nil, errors.New("pending infohash too short")
+		}
+		p.IPs = append(p.IPs, string(data[1:1+int(data[0])]))
+		data = data[1+int(data[0]):]
+	}
+	return data, nil
+}
+
+// pendingJSON is how a PendingInfohash is written by the admin server.
+type pendingJSON struct {
+	InfoHash  string    `json:"infohash"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     uint64    `json:"count"`
+	IPs       []string  `json:"ips"`
+}
+
+func (p PendingInfohash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pendingJSON{
+		InfoHash:  hex.EncodeToString(p.InfoHash[:]),
+		FirstSeen: p.FirstSeen.UTC(),
+		LastSeen:  p.LastSeen.UTC(),
+		Count:     p.Count,
+		IPs:       p.IPs,
+	})
+}
+
+func (p *PendingInfohash) UnmarshalJSON(data []byte) error {
+	var pj pendingJSON
+	if err := json.Unmarshal(data, &pj); err != nil {
+		return err
+	}
+	if err := validInfohash(pj.InfoHash); err != nil {
+		return err
+	}
+	ihBytes, _ := hex.DecodeString(pj.InfoHash)
+
+	*p = PendingInfohash{
+		FirstSeen: pj.FirstSeen,
+		LastSeen:  pj.LastSeen,
+		Count:     pj.Count,
+		IPs:       pj.IPs,
+	}
+	copy(p.InfoHash[:], ihBytes)
+	return nil
+}
@@ -0,0 +1,34 @@
+package infohashapproval
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingQueueExpire(t *testing.T) {
+	q := newPendingQueue(PendingConfig{MaxInfohashes: 2, MaxAge: time.Hour})
+	old, recent, next := testInfohash(1), testInfohash(2), testInfohash(3)
+	now := time.Now()
+
+	q.Seen(old, "10.0.0.1", now.Add(-2*time.Hour))
+	q.Seen(recent, "10.0.0.2", now.Add(-time.Minute))
+	if q.Seen(next, "10.0.0.3", now) {
+		t.Fatal("recorded an infohash in a full queue")
+	}
+
+	expired := q.Expire(now)
+	if len(expired) != 1 || expired[0] != old {
+		t.Fatalf("expired %x, want only %x", expired, old)
+	}
+	if len(q.TakeDirty()) != 1 {
+		t.Error("an expired entry is still to be saved")
+	}
+
+	if !q.Seen(next, "10.0.0.3", now) {
+		t.Fatal("expiry didn't make room in the queue")
+	}
+	list := q.List()
+	if len(list) != 2 || list[0].InfoHash != recent || list[1].InfoHash != next {
+		t.Errorf("queue holds %+v", list)
+	}
+}
@@ -1,6 +1,8 @@
 package infohashapproval
 
 import (
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -39,7 +41,7 @@ var (
 	})
 
 	// Storage
-	chihayaWhitelistCount = prometheus.NewCounter(prometheus.CounterOpts{
+	chihayaWhitelistCount = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "chihaya_middleware_whitelist_total_count",
 		Help: "Amount of whitlisted infohashes in the middleware",
 	})
@@ -48,9 +50,110 @@ var (
 		Name: "chihaya_middleware_whitelist_fail_total_count",
 		Help: "Amount of whitlisted infohashes failed to write to the middleware",
 	})
+
+	// Signature verification
+	chihayaVerifyQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_middleware_verify_queue_depth",
+		Help: "Amount of signatures waiting for a verification worker",
+	})
+
+	chihayaVerifyShedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_middleware_verify_shed_total_count",
+		Help: "Amount of signed announces rejected because the verification queue was full",
+	})
+
+	// Throttling
+	chihayaNegativeCacheHitCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_middleware_negative_cache_hit_total_count",
+		Help: "Amount of signatures rejected from the invalid signature cache",
+	})
+
+	chihayaAnnounceBannedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_middleware_banned_announce_total_count",
+		Help: "Amount of signed announces rejected because the IP is banned",
+	})
+
+	chihayaBanCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_middleware_ban_total_count",
+		Help: "Amount of IPs banned for sending too many invalid signatures",
+	})
+
+	chihayaBannedIPCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_middleware_banned_ip_count",
+		Help: "Amount of IPs currently banned from signed announces",
+	})
+
+	// Replication
+	chihayaReplicationPushCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_middleware_replication_push_total_count",
+		Help: "Amount of approvals and revocations pushed to replication peers",
+	})
+
+	chihayaReplicationFailCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_middleware_replication_fail_total_count",
+		Help: "Amount of pushes and syncs with replication peers that failed",
+	})
+
+	// Signers
+	chihayaSignerExpirySeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chihaya_middleware_signer_expiry_seconds",
+		Help: "Seconds until a signer key passes its not_after date",
+	}, []string{"key"})
+
+	chihayaSignersExpiringCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_middleware_signers_expiring_count",
+		Help: "Amount of signer keys within the expiry warning period",
+	})
+
+	// Pending queue
+	chihayaPendingCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_middleware_pending_count",
+		Help: "Amount of unknown infohashes waiting for review",
+	})
+
+	chihayaPendingDroppedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_middleware_pending_dropped_total_count",
+		Help: "Amount of unknown infohash announces not recorded because the pending queue was full",
+	})
+
+	// Webhooks
+	chihayaWebhookDeliveredCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_middleware_webhook_delivered_total_count",
+		Help: "Amount of webhook deliveries that succeeded",
+	})
+
+	chihayaWebhookFailCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_middleware_webhook_fail_total_count",
+		Help: "Amount of webhook delivery attempts that failed",
+	})
+
+	chihayaWebhookDroppedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_middleware_webhook_dropped_total_count",
+		Help: "Amount of webhook events dropped because the queue or outbox was full",
+	})
+
+	chihayaWebhookOutboxCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_middleware_webhook_outbox_count",
+		Help: "Amount of webhook deliveries waiting in the outbox",
+	})
+
+	// Downloads
+	chihayaDownloadCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_middleware_download_total_count",
+		Help: "Amount of .torrent files and magnet links served",
+	}, []string{"kind"})
 )
 
+var prometheusOnce sync.Once
+
+// InitPrometheus registers the metrics of the middleware. It is called by
+// every NewHook, and only registers them the first time, as a reload
+// creates a new hook.
 func InitPrometheus() {
+	prometheusOnce.Do(registerPrometheus)
+}
+
+func registerPrometheus() {
 	// Request
 	prometheus.MustRegister(chihayaAnnounceCount)
 	prometheus.MustRegister(chihayaAnnounceWhitelistCount)
@@ -62,4 +165,35 @@ func InitPrometheus() {
 	// Storage
 	prometheus.MustRegister(chihayaWhitelistCount)
 	prometheus.MustRegister(chihayaWhitelistFail)
+
+	// Signature verification
+	prometheus.MustRegister(chihayaVerifyQueueDepth)
+	prometheus.MustRegister(chihayaVerifyShedCount)
+
+	// Throttling
+	prometheus.MustRegister(chihayaNegativeCacheHitCount)
+	prometheus.MustRegister(chihayaAnnounceBannedCount)
+	prometheus.MustRegister(chihayaBanCount)
+	prometheus.MustRegister(chihayaBannedIPCount)
+
+	// Replication
+	prometheus.MustRegister(chihayaReplicationPushCount)
+	prometheus.MustRegister(chihayaReplicationFailCount)
+
+	// Signers
+	prometheus.MustRegister(chihayaSignerExpirySeconds)
+	prometheus.MustRegister(chihayaSignersExpiringCount)
+
+	// Pending queue
+	prometheus.MustRegister(chihayaPendingCount)
+	prometheus.MustRegister(chihayaPendingDroppedCount)
+
+	// Webhooks
+	prometheus.MustRegister(chihayaWebhookDeliveredCount)
+	prometheus.MustRegister(chihayaWebhookFailCount)
+	prometheus.MustRegister(chihayaWebhookDroppedCount)
+	prometheus.MustRegister(chihayaWebhookOutboxCount)
+
+	// Downloads
+	prometheus.MustRegister(chihayaDownloadCount)
 }
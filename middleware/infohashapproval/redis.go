@@ -0,0 +1,198 @@
+package infohashapproval
+
+import (
+	"log"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/FactomProject/factomd/common/interfaces"
+
+	redisstorage "github.com/FactomProject/chihaya/storage/redis"
+)
+
+// redisDB is a Database shared by several trackers. Every bucket is a Redis
+// hash, and every Put and Delete is published on a channel named after the
+// bucket so the other trackers learn about it.
+type redisDB struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+// NewRedisDB returns a Database stored in the Redis server at addr, with
+// every key starting with prefix.
+func NewRedisDB(addr, password, prefix string) (Database, error) {
+	db := &redisDB{
+		pool:   redisstorage.NewPool(addr, password),
+		prefix: prefix,
+	}
+
+	conn := db.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		return nil, err
+	}
+
+	log.Println("Database started from redis at " + addr)
+	return db, nil
+}
+
+func (db *redisDB) key(bucket []byte) string {
+	return db.prefix + string(bucket)
+}
+
+func (db *redisDB) Put(bucket, key []byte, data interfaces.BinaryMarshallable) error {
+	value, err := data.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HSET", db.key(bucket), key, value)
+	conn.Send("PUBLISH", db.key(bucket), key)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (db *redisDB) Get(bucket, key []byte, destination interfaces.BinaryMarshallable) (interfaces.BinaryMarshallable, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	value, err := redis.Bytes(conn.Do("HGET", db.key(bucket), key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := destination.UnmarshalBinaryData(value); err != nil {
+		return nil, err
+	}
+	return destination, nil
+}
+
+func (db *redisDB) Delete(bucket, key []byte) error {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HDEL", db.key(bucket), key)
+	conn.Send("PUBLISH", db.key(bucket), key)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// WriteBatch makes the puts and deletes in one transaction, publishing
+// each of them.
+func (db *redisDB) WriteBatch(puts, deletes []interfaces.Record) error {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	for _, p := range puts {
+		value, err := p.Data.MarshalBinary()
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+		conn.Send("HSET", db.key(p.Bucket), p.Key, value)
+		conn.Send("PUBLISH", db.key(p.Bucket), p.Key)
+	}
+	for _, d := range deletes {
+		conn.Send("HDEL", db.key(d.Bucket), d.Key)
+		conn.Send("PUBLISH", db.key(d.Bucket), d.Key)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// leaseKey is a string key next to the bucket hash, which Redis deletes
+// when the lease ends.
+func (db *redisDB) leaseKey(bucket, key []byte) string {
+	return db.key(bucket) + ":lease:" + string(key)
+}
+
+func (db *redisDB) Lease(bucket, key []byte, until time.Time) (bool, error) {
+	ms := int64(until.Sub(time.Now()) / time.Millisecond)
+	if ms <= 0 {
+		return false, nil
+	}
+
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("SET", db.leaseKey(bucket, key), 1, "NX", "PX", ms)
+	return reply != nil, err
+}
+
+func (db *redisDB) Release(bucket, key []byte) error {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", db.leaseKey(bucket, key))
+	return err
+}
+
+func (db *redisDB) ListAllKeys(bucket []byte) ([][]byte, error) {
+	conn := db.pool.Get()
+	defer conn.Close()
+
+	return redis.ByteSlices(conn.Do("HKEYS", db.key(bucket)))
+}
+
+func (db *redisDB) Close() error {
+	return db.pool.Close()
+}
+
+// Subscribe calls fn with every key put in or deleted from bucket by any
+// tracker, until closing is closed. Lost connections are retried.
+func (db *redisDB) Subscribe(bucket []byte, closing <-chan struct{}, fn func(key []byte)) {
+	for {
+		// Dialled rather than taken from the pool, as a pooled connection
+		// can't be closed while Receive is blocked on it
+		conn, err := db.pool.Dial()
+		if err == nil {
+			psc := redis.PubSubConn{Conn: conn}
+			err = psc.Subscribe(db.key(bucket))
+			if err == nil {
+				// Receive blocks, so unblock it by closing the connection
+				done := make(chan struct{})
+				go func() {
+					select {
+					case <-closing:
+						conn.Close()
+					case <-done:
+					}
+				}()
+
+				db.receive(psc, fn)
+				close(done)
+			}
+			conn.Close()
+		}
+		if err != nil {
+			log.Printf("Failed to subscribe to redis %s: %s\n", db.key(bucket), err.Error())
+		}
+
+		select {
+		case <-closing:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (db *redisDB) receive(psc redis.PubSubConn, fn func(key []byte)) {
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			fn(v.Data)
+		case error:
+			return
+		}
+	}
+}
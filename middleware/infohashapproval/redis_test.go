@@ -0,0 +1,266 @@
+package infohashapproval
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// fakeRedis implements the hash, transaction and pub/sub commands used by
+// redisDB, in memory.
+type fakeRedis struct {
+	hashes      map[string]map[string][]byte
+	subscribers map[string]map[*fakeConn]bool
+	sync.Mutex
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		hashes:      make(map[string]map[string][]byte),
+		subscribers: make(map[string]map[*fakeConn]bool),
+	}
+}
+
+func (r *fakeRedis) dial() (redis.Conn, error) {
+	return &fakeConn{
+		r:       r,
+		replies: make(chan interface{}, 1024),
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+// subscribed returns the number of connections subscribed to channel.
+func (r *fakeRedis) subscribed(channel string) int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.subscribers[channel])
+}
+
+// fakeConn is a connection to a fakeRedis. Commands run when they are sent,
+// and their replies are read with Receive along with published messages.
+type fakeConn struct {
+	r         *fakeRedis
+	replies   chan interface{}
+	multi     [][]interface{}
+	inMulti   bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *fakeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.r.Lock()
+		for _, subs := range c.r.subscribers {
+			delete(subs, c)
+		}
+		c.r.Unlock()
+	})
+	return nil
+}
+
+func (c *fakeConn) Err() error {
+	select {
+	case <-c.closed:
+		return errors.New("connection closed")
+	default:
+		return nil
+	}
+}
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	c.replies <- c.run(strings.ToUpper(cmd), args)
+	return nil
+}
+
+func (c *fakeConn) Flush() error { return c.Err() }
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	select {
+	case reply := <-c.replies:
+		if err, ok := reply.(error); ok {
+			return nil, err
+		}
+		return reply, nil
+	case <-c.closed:
+		return nil, errors.New("connection closed")
+	}
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	for len(c.replies) > 0 {
+		<-c.replies
+	}
+	if cmd == "" {
+		return nil, nil
+	}
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	reply := c.run(strings.ToUpper(cmd), args)
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *fakeConn) run(cmd string, args []interface{}) interface{} {
+	switch cmd {
+	case "MULTI":
+		c.inMulti = true
+		return "OK"
+	case "EXEC":
+		queued := c.multi
+		c.inMulti, c.multi = false, nil
+		c.r.Lock()
+		defer c.r.Unlock()
+		replies := make([]interface{}, len(queued))
+		for i, q := range queued {
+			replies[i] = c.r.command(c, q[0].(string), q[1:])
+		}
+		return replies
+	}
+	if c.inMulti {
+		c.multi = append(c.multi, append([]interface{}{cmd}, args...))
+		return "QUEUED"
+	}
+
+	c.r.Lock()
+	defer c.r.Unlock()
+	return c.r.command(c, cmd, args)
+}
+
+func bytesOf(v interface{}) []byte {
+	switch v := v.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return []byte(fmt.Sprint(v))
+}
+
+func (r *fakeRedis) command(c *fakeConn, cmd string, args []interface{}) interface{} {
+	var key string
+	if len(args) > 0 {
+		key = string(bytesOf(args[0]))
+	}
+
+	switch cmd {
+	case "PING":
+		return "PONG"
+	case "ECHO":
+		return bytesOf(args[0])
+	case "HSET":
+		h := r.hashes[key]
+		if h == nil {
+			h = make(map[string][]byte)
+			r.hashes[key] = h
+		}
+		h[string(bytesOf(args[1]))] = bytesOf(args[2])
+		return int64(1)
+	case "HGET":
+		if v, ok := r.hashes[key][string(bytesOf(args[1]))]; ok {
+			return v
+		}
+		return nil
+	case "HDEL":
+		field := string(bytesOf(args[1]))
+		if _, ok := r.hashes[key][field]; !ok {
+			return int64(0)
+		}
+		delete(r.hashes[key], field)
+		return int64(1)
+	case "HKEYS":
+		var reply []interface{}
+		for field := range r.hashes[key] {
+			reply = append(reply, []byte(field))
+		}
+		return reply
+	case "PUBLISH":
+		for sub := range r.subscribers[key] {
+			sub.replies <- []interface{}{[]byte("message"), []byte(key), bytesOf(args[1])}
+		}
+		return int64(len(r.subscribers[key]))
+	case "SUBSCRIBE":
+		if r.subscribers[key] == nil {
+			r.subscribers[key] = make(map[*fakeConn]bool)
+		}
+		r.subscribers[key][c] = true
+		return []interface{}{[]byte("subscribe"), []byte(key), int64(1)}
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		for _, subs := range r.subscribers {
+			delete(subs, c)
+		}
+		return []interface{}{[]byte(strings.ToLower(cmd)), nil, int64(0)}
+	}
+	return redis.Error("ERR unknown command " + cmd)
+}
+
+// newRedisHook returns a hook following the whitelist and blacklist of r,
+// as a tracker sharing it would.
+func newRedisHook(t *testing.T, r *fakeRedis) *hook {
+	db := &redisDB{pool: &redis.Pool{Dial: r.dial}, prefix: "test:"}
+	h := &hook{MiddleWareDatabase: db, closing: make(chan struct{})}
+	h.approved, _ = newInfohashSet("map")
+	h.unapproved, _ = newInfohashSet("map")
+
+	before := r.subscribed("test:blacklist")
+	h.follow(db)
+	waitFor(t, "subscriptions", func() bool {
+		return r.subscribed("test:whitelist") == before+1 && r.subscribed("test:blacklist") == before+1
+	})
+	return h
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRedisFollow(t *testing.T) {
+	r := newFakeRedis()
+	a := newRedisHook(t, r)
+	defer close(a.closing)
+	b := newRedisHook(t, r)
+	defer close(b.closing)
+
+	revoked, expiring := testInfohash(1), testInfohash(2)
+
+	a.approve(approval{infohash: revoked})
+	waitFor(t, "approval", func() bool { return b.approved.Contains(revoked) })
+
+	b.revoke(revoked, false)
+	waitFor(t, "revocation", func() bool {
+		return !a.approved.Contains(revoked) && a.unapproved.Contains(revoked)
+	})
+
+	a.approvalTTL = time.Hour
+	a.approve(approval{infohash: expiring})
+	waitFor(t, "approval", func() bool { return b.approved.Contains(expiring) })
+
+	a.removeExpiredApprovals(time.Now().Add(2 * time.Hour))
+	waitFor(t, "expiry", func() bool { return !b.approved.Contains(expiring) })
+
+	// Taking an infohash off the blacklist is followed too
+	if err := a.MiddleWareDatabase.Delete([]byte("blacklist"), revoked[:]); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "unblacklisting", func() bool { return !b.unapproved.Contains(revoked) })
+	if b.approved.Contains(revoked) {
+		t.Error("revoked infohash was whitelisted again")
+	}
+}
@@ -0,0 +1,494 @@
+package infohashapproval
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+const (
+	// replicationSignatureHeader carries the hex ed25519 signature of the
+	// body of every replication request and response.
+	replicationSignatureHeader = "X-Chihaya-Signature"
+
+	// replicationTimeHeader carries the unix time of a sync request, which
+	// is signed in place of a body.
+	replicationTimeHeader = "X-Chihaya-Time"
+
+	// Pushes older than replicationMaxAge are rejected, so a captured push
+	// can't be replayed later.
+	replicationMaxAge = 5 * time.Minute
+
+	maxPushSize    = 1 << 20
+	maxSyncSize    = 256 << 20
+	pushAttempts   = 4
+	pushQueueSize  = 1024
+	replicationTTL = 30 * time.Second
+
+	// replicationQueueTimeout is how long a push or sync waits for room in
+	// the write queue before giving up.
+	replicationQueueTimeout = 10 * time.Second
+)
+
+// errReplicationBusy is returned when replicated approvals can't be queued
+// in time. Pushes failing with it are retried by the peer.
+var errReplicationBusy = errors.New("approval queue full, try again later")
+
+// ReplicationConfig configures pushing approvals and revocations to other
+// trackers, and receiving theirs.
+type ReplicationConfig struct {
+	// Addr is where this tracker listens for pushes and sync requests
+	Addr string `yaml:"addr"`
+
+	// PrivateKey is the hex ed25519 private key this tracker signs its
+	// pushes and sync responses with.
+	PrivateKey string `yaml:"private_key"`
+
+	Peers []ReplicationPeer `yaml:"peers"`
+}
+
+// ReplicationPeer is another tracker of the fleet.
+type ReplicationPeer struct {
+	// URL is the peer's replication address, e.g. http://10.0.0.2:6883
+	URL string `yaml:"url"`
+
+	// Key is the hex ed25519 public key the peer signs with
+	Key string `yaml:"key"`
+}
+
+// replicationMessage is the body of a push, or of a sync response. A
+// revocation puts the infohash in the blacklist.
+type replicationMessage struct {
+	Op        string   `json:"op"` // approve, revoke or sync
+	Time      int64    `json:"time"`
+	Whitelist []string `json:"whitelist,omitempty"`
+	Blacklist []string `json:"blacklist,omitempty"`
+}
+
+type replicationPeer struct {
+	url string
+	key [ed.PublicKeySize]byte
+}
+
+type replicator struct {
+	privateKey [ed.PrivateKeySize]byte
+	peers      []replicationPeer
+	addr       string
+	client     *http.Client
+	pushes     chan replicationMessage
+}
+
+func newReplicator(cfg ReplicationConfig) (*replicator, error) {
+	r := &replicator{
+		client: &http.Client{Timeout: replicationTTL},
+		pushes: make(chan replicationMessage, pushQueueSize),
+	}
+
+	key, err := hex.DecodeString(cfg.PrivateKey)
+	if err != nil || len(key) != ed.PrivateKeySize {
+		return nil, errors.New("replication private_key must be a 64 byte hex ed25519 private key")
+	}
+	copy(r.privateKey[:], key)
+
+	for _, p := range cfg.Peers {
+		key, err := hex.DecodeString(p.Key)
+		if err != nil || len(key) != ed.PublicKeySize {
+			return nil, errors.New("replication peer " + p.URL + " must have a 32 byte hex public key")
+		}
+
+		peer := replicationPeer{url: p.URL}
+		copy(peer.key[:], key)
+		r.peers = append(r.peers, peer)
+	}
+
+	return r, nil
+}
+
+// startReplication serves pushes and sync requests from other trackers,
+// pulls their full lists once, and pushes local changes until the hook
+// stops.
+func (h *hook) startReplication(addr string) error {
+	if err := h.serveShared("replication", addr, h.replicationHandler()); err != nil {
+		return err
+	}
+	h.replicator.addr = addr
+
+	go h.syncFromPeers()
+	go h.pushToPeers()
+	return nil
+}
+
+func (h *hook) replicationHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replication/push", h.servePush)
+	mux.HandleFunc("/replication/sync", h.serveSync)
+	return mux
+}
+
+func (h *hook) stopReplication() {
+	if h.replicator != nil && h.replicator.addr != "" {
+		h.releaseServer(h.replicator.addr)
+	}
+}
+
+// replicate queues a local change to be pushed to every peer.
+func (h *hook) replicate(op string, ih bittorrent.InfoHash) {
+	if h.replicator == nil {
+		return
+	}
+
+	msg := replicationMessage{Op: op}
+	switch op {
+	case "approve":
+		msg.Whitelist = []string{hex.EncodeToString(ih[:])}
+	case "revoke":
+		msg.Blacklist = []string{hex.EncodeToString(ih[:])}
+	}
+
+	select {
+	case h.replicator.pushes <- msg:
+	default:
+		chihayaReplicationFailCount.Inc()
+		log.Printf("Replication queue full, dropped %s of %x\n", op, ih)
+	}
+}
+
+func (h *hook) pushToPeers() {
+	for {
+		select {
+		case msg := <-h.replicator.pushes:
+			msg.Time = time.Now().Unix()
+			body, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+
+			for _, p := range h.replicator.peers {
+				h.push(p, body)
+			}
+		case <-h.closing:
+			return
+		}
+	}
+}
+
+// push sends a push to a peer, retrying with backoff.
+func (h *hook) push(p replicationPeer, body []byte) {
+	sig := ed.Sign(&h.replicator.privateKey, body)
+	backoff := time.Second
+
+	var err error
+	for attempt := 0; attempt < pushAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-h.closing:
+				return
+			}
+		}
+
+		var req *http.Request
+		req, err = http.NewRequest("POST", p.url+"/replication/push", bytes.NewReader(body))
+		if err != nil {
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(replicationSignatureHeader, hex.EncodeToString(sig[:]))
+
+		var resp *http.Response
+		resp, err = h.replicator.client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNoContent {
+			chihayaReplicationPushCount.Inc()
+			return
+		}
+		err = errors.New(resp.Status)
+	}
+
+	chihayaReplicationFailCount.Inc()
+	log.Printf("Failed to push to replication peer %s: %s\n", p.url, err.Error())
+}
+
+func (h *hook) servePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPushSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !h.replicator.fromPeer(body, r.Header.Get(replicationSignatureHeader)) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	var msg replicationMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	age := time.Since(time.Unix(msg.Time, 0))
+	if age > replicationMaxAge || age < -replicationMaxAge {
+		http.Error(w, "push expired", http.StatusForbidden)
+		return
+	}
+
+	if err := h.applyReplication(msg); err == errReplicationBusy {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fromPeer returns true if body is signed by one of the peers.
+func (r *replicator) fromPeer(body []byte, sigHex string) bool {
+	for i := range r.peers {
+		if verifyBody(&r.peers[i].key, body, sigHex) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncRequestBody is what a sync request made at the given unix time signs.
+func syncRequestBody(t string) []byte {
+	return []byte("sync " + t)
+}
+
+// serveSync answers a peer with the full whitelist and blacklist of this
+// tracker. The request must be signed by a peer, recently.
+func (h *hook) serveSync(w http.ResponseWriter, r *http.Request) {
+	t := r.Header.Get(replicationTimeHeader)
+	if !h.replicator.fromPeer(syncRequestBody(t), r.Header.Get(replicationSignatureHeader)) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	age := time.Since(time.Unix(unix, 0))
+	if err != nil || age > replicationMaxAge || age < -replicationMaxAge {
+		http.Error(w, "sync request expired", http.StatusForbidden)
+		return
+	}
+
+	msg := replicationMessage{Op: "sync", Time: time.Now().Unix()}
+
+	whitelist, blacklist, err := h.savedLists()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, ih := range whitelist {
+		msg.Whitelist = append(msg.Whitelist, hex.EncodeToString(ih[:]))
+	}
+	for _, ih := range blacklist {
+		msg.Blacklist = append(msg.Blacklist, hex.EncodeToString(ih[:]))
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sig := ed.Sign(&h.replicator.privateKey, body)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(replicationSignatureHeader, hex.EncodeToString(sig[:]))
+	w.Write(body)
+}
+
+// savedLists returns the whitelist and blacklist that replicate: the ones in
+// the database, or the whole in-memory lists when running without one.
+func (h *hook) savedLists() (whitelist, blacklist []bittorrent.InfoHash, err error) {
+	if h.MiddleWareDatabase == nil {
+		h.approved.Each(func(ih bittorrent.InfoHash) { whitelist = append(whitelist, ih) })
+		h.unapproved.Each(func(ih bittorrent.InfoHash) { blacklist = append(blacklist, ih) })
+		return whitelist, blacklist, nil
+	}
+
+	keys, err := h.MiddleWareDatabase.ListAllKeys([]byte("whitelist"))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, key := range keys {
+		var ih bittorrent.InfoHash
+		copy(ih[:], key)
+		whitelist = append(whitelist, ih)
+	}
+
+	keys, err = h.MiddleWareDatabase.ListAllKeys([]byte("blacklist"))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, key := range keys {
+		var ih bittorrent.InfoHash
+		copy(ih[:], key)
+		blacklist = append(blacklist, ih)
+	}
+	return whitelist, blacklist, nil
+}
+
+// syncFromPeers merges the full lists of every peer into ours, so a tracker
+// that was down catches up on what it missed.
+func (h *hook) syncFromPeers() {
+	for _, p := range h.replicator.peers {
+		if err := h.syncFrom(p); err != nil {
+			chihayaReplicationFailCount.Inc()
+			log.Printf("Failed to sync from replication peer %s: %s\n", p.url, err.Error())
+		}
+	}
+}
+
+func (h *hook) syncFrom(p replicationPeer) error {
+	req, err := http.NewRequest("GET", p.url+"/replication/sync", nil)
+	if err != nil {
+		return err
+	}
+	t := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := ed.Sign(&h.replicator.privateKey, syncRequestBody(t))
+	req.Header.Set(replicationTimeHeader, t)
+	req.Header.Set(replicationSignatureHeader, hex.EncodeToString(sig[:]))
+
+	resp, err := h.replicator.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSyncSize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxSyncSize {
+		return errors.New("sync response too large")
+	}
+
+	if !verifyBody(&p.key, body, resp.Header.Get(replicationSignatureHeader)) {
+		return errors.New("invalid signature")
+	}
+
+	var msg replicationMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return err
+	}
+	if msg.Op != "sync" {
+		return errors.New("unexpected " + msg.Op + " response")
+	}
+
+	log.Printf("Synced %d approved and %d blacklisted infohashes from %s\n", len(msg.Whitelist), len(msg.Blacklist), p.url)
+	return h.applyReplication(msg)
+}
+
+// applyReplication applies the changes of another tracker without pushing
+// them on. Blacklisted infohashes are never approved.
+func (h *hook) applyReplication(msg replicationMessage) error {
+	blacklist, err := decodeInfohashes(msg.Blacklist)
+	if err != nil {
+		return err
+	}
+	whitelist, err := decodeInfohashes(msg.Whitelist)
+	if err != nil {
+		return err
+	}
+
+	for _, ih := range blacklist {
+		if !h.unapproved.Contains(ih) {
+			h.revoke(ih, true)
+		}
+	}
+
+	// approve checks the blacklist again when the write is applied, as a
+	// revocation may come in while it is queued.
+	timeout := time.NewTimer(replicationQueueTimeout)
+	defer timeout.Stop()
+	for _, ih := range whitelist {
+		if h.approved.Contains(ih) || h.unapproved.Contains(ih) {
+			continue
+		}
+		select {
+		case h.pendingWrites <- approval{infohash: ih, replicated: true}:
+		case <-timeout.C:
+			return errReplicationBusy
+		case <-h.closing:
+			return errReplicationBusy
+		}
+	}
+	return nil
+}
+
+// revoke moves an infohash from the whitelist to the blacklist, pushing the
+// revocation to the peers unless it came from one.
+func (h *hook) revoke(ih bittorrent.InfoHash, replicated bool) {
+	h.removePending(ih)
+	if h.approved.Remove(ih) > 0 {
+		chihayaWhitelistCount.Dec()
+	}
+	h.unapproved.Add(ih)
+
+	if h.MiddleWareDatabase != nil {
+		h.dbLock.Lock()
+		defer h.dbLock.Unlock()
+		if err := h.MiddleWareDatabase.Delete([]byte("whitelist"), ih[:]); err != nil {
+			log.Printf("Failed to delete %x infohash from whitelist database: %s\n", ih, err.Error())
+		}
+		err := putRecord(h.MiddleWareDatabase, []byte("blacklist"), Record{InfoHash: ih, ApprovedAt: time.Now()})
+		if err != nil {
+			log.Printf("Failed to write %x infohash to blacklist database: %s\n", ih, err.Error())
+		}
+	}
+
+	if !replicated {
+		h.replicate("revoke", ih)
+		h.notify(WebhookRevoke, ih, "", "")
+	}
+}
+
+func verifyBody(key *[ed.PublicKeySize]byte, body []byte, sigHex string) bool {
+	sig, err := hex.DecodeString(sigHex)
+	if err != nil || len(sig) != ed.SignatureSize {
+		return false
+	}
+
+	var sigFixed [ed.SignatureSize]byte
+	copy(sigFixed[:], sig)
+	return ed.VerifyCanonical(key, body, &sigFixed)
+}
+
+func decodeInfohashes(hexes []string) ([]bittorrent.InfoHash, error) {
+	ihs := make([]bittorrent.InfoHash, 0, len(hexes))
+	for _, ihString := range hexes {
+		ihBytes, err := hex.DecodeString(ihString)
+		if err != nil || len(ihBytes) != 20 {
+			return nil, errors.New("Infohash " + ihString + " must be 20 bytes")
+		}
+		var ih bittorrent.InfoHash
+		copy(ih[:], ihBytes)
+		ihs = append(ihs, ih)
+	}
+	return ihs, nil
+}
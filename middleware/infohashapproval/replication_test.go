@@ -0,0 +1,129 @@
+package infohashapproval
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+type replicatingHook struct {
+	*hook
+	server *httptest.Server
+	public *[ed.PublicKeySize]byte
+}
+
+// newReplicatingHook returns a running hook with a database, serving
+// replication requests. Its peers are added by the caller.
+func newReplicatingHook(t *testing.T) *replicatingHook {
+	pub, priv, err := ed.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, _ := NewMapDB()
+	h := &hook{
+		MiddleWareDatabase: db,
+		pendingWrites:      make(chan approval, 16),
+		closing:            make(chan struct{}),
+		writerDone:         make(chan struct{}),
+		replicator: &replicator{
+			privateKey: *priv,
+			client:     &http.Client{Timeout: 5 * time.Second},
+			pushes:     make(chan replicationMessage, 16),
+		},
+	}
+	h.approved, _ = newInfohashSet("map")
+	h.unapproved, _ = newInfohashSet("map")
+
+	go h.writeToDatabase()
+	go h.pushToPeers()
+	return &replicatingHook{hook: h, server: httptest.NewServer(h.replicationHandler()), public: pub}
+}
+
+func (h *replicatingHook) stop() {
+	close(h.closing)
+	<-h.writerDone
+	h.server.Close()
+}
+
+func (h *replicatingHook) peer() replicationPeer {
+	return replicationPeer{url: h.server.URL, key: *h.public}
+}
+
+func TestReplication(t *testing.T) {
+	a, b := newReplicatingHook(t), newReplicatingHook(t)
+	defer a.stop()
+	defer b.stop()
+	a.replicator.peers = []replicationPeer{b.peer()}
+	b.replicator.peers = []replicationPeer{a.peer()}
+
+	synced, pushed := testInfohash(1), testInfohash(2)
+
+	// Approved on a before b synced, without a push
+	if err := putRecord(a.MiddleWareDatabase, []byte("whitelist"), Record{InfoHash: synced}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.syncFrom(a.peer()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "sync", func() bool { return b.approved.Contains(synced) })
+
+	a.approve(approval{infohash: pushed})
+	waitFor(t, "approval", func() bool { return b.approved.Contains(pushed) })
+
+	a.revoke(pushed, false)
+	waitFor(t, "revocation", func() bool {
+		return !b.approved.Contains(pushed) && b.unapproved.Contains(pushed)
+	})
+	r, err := getRecord(b.MiddleWareDatabase, []byte("blacklist"), pushed)
+	if err != nil || r == nil {
+		t.Errorf("revocation wasn't saved: %v", err)
+	}
+
+	// A revoked infohash isn't approved again by a sync
+	if err := b.applyReplication(replicationMessage{Op: "sync", Whitelist: []string{hex.EncodeToString(pushed[:])}}); err != nil {
+		t.Fatal(err)
+	}
+	if b.approved.Contains(pushed) {
+		t.Error("sync approved a revoked infohash")
+	}
+}
+
+func TestServeSyncUnsigned(t *testing.T) {
+	a, b := newReplicatingHook(t), newReplicatingHook(t)
+	defer a.stop()
+	defer b.stop()
+	a.replicator.peers = []replicationPeer{b.peer()}
+
+	resp, err := http.Get(a.server.URL + "/replication/sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unsigned sync got %s", resp.Status)
+	}
+
+	// Signed, but by a tracker that isn't a peer
+	if err := a.syncFrom(replicationPeer{url: b.server.URL, key: *b.public}); err == nil {
+		t.Error("synced from a tracker that doesn't know us")
+	}
+}
+
+func TestApplyReplicationBusy(t *testing.T) {
+	h := &hook{pendingWrites: make(chan approval), closing: make(chan struct{})}
+	h.approved, _ = newInfohashSet("map")
+	h.unapproved, _ = newInfohashSet("map")
+	close(h.closing)
+
+	ih := testInfohash(1)
+	err := h.applyReplication(replicationMessage{Op: "approve", Whitelist: []string{hex.EncodeToString(ih[:])}})
+	if err != errReplicationBusy {
+		t.Errorf("got %v, want %v", err, errReplicationBusy)
+	}
+}
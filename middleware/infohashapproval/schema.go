@@ -0,0 +1,220 @@
+package infohashapproval
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// schemaVersion is the version of the values written to key/value
+// databases (Bolt, LDB and Redis):
+//
+//	0: whitelist and blacklist values are empty
+//	1: whitelist and blacklist values are encoded Records
+//
+// The version of a database is kept under the schema_version key of the
+// meta bucket, and is 0 when missing.
+const schemaVersion = 1
+
+// recordVersion is the first byte of an encoded Record.
+const recordVersion = 1
+
+// migrations[v] moves a database from version v to v+1.
+var migrations = []func(Database) error{
+	migrateEmptyToRecords,
+}
+
+// migrate brings a key/value database written by an older version of the
+// hook up to schemaVersion. Databases that store Records themselves have
+// their own schema and are left alone.
+func migrate(db Database) error {
+	if _, ok := db.(recordStore); ok {
+		return nil
+	}
+
+	version, err := readSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", version, schemaVersion)
+	}
+
+	for ; version < schemaVersion; version++ {
+		log.Printf("Migrating infohash database from schema version %d to %d\n", version, version+1)
+		if err := migrations[version](db); err != nil {
+			return fmt.Errorf("failed to migrate database to schema version %d: %s", version+1, err.Error())
+		}
+		if err := writeSchemaVersion(db, version+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readSchemaVersion(db Database) (uint32, error) {
+	v := new(rawValue)
+	found, err := db.Get([]byte("meta"), []byte("schema_version"), v)
+	if err != nil {
+		return 0, err
+	}
+	if found == nil {
+		return 0, nil
+	}
+	if len(*v) != 4 {
+		return 0, errors.New("malformed schema version")
+	}
+	return binary.BigEndian.Uint32(*v), nil
+}
+
+func writeSchemaVersion(db Database, version uint32) error {
+	v := make(rawValue, 4)
+	binary.BigEndian.PutUint32(v, version)
+	return db.Put([]byte("meta"), []byte("schema_version"), &v)
+}
+
+// migrateEmptyToRecords replaces the empty values of version 0 with Records
+// holding no details, as the signer and time of those approvals are
+// unknown.
+func migrateEmptyToRecords(db Database) error {
+	for _, bucket := range []string{"whitelist", "blacklist"} {
+		keys, err := db.ListAllKeys([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if len(key) != 20 {
+				return fmt.Errorf("%s key %x is not a 20 byte infohash", bucket, key)
+			}
+
+			var ih bittorrent.InfoHash
+			copy(ih[:], key)
+			if err := db.Put([]byte(bucket), key, &Record{InfoHash: ih}); err != nil {
+				return err
+			}
+		}
+		log.Printf("Migrated %d %s entries\n", len(keys), bucket)
+	}
+	return nil
+}
+
+// putRecord saves a Record in the whitelist or blacklist of any Database.
+func putRecord(db Database, bucket []byte, r Record) error {
+	if rs, ok := db.(recordStore); ok {
+		return rs.PutRecord(bucket, r)
+	}
+	return db.Put(bucket, r.InfoHash[:], &r)
+}
+
+// getRecord reads the Record of ih from the whitelist or blacklist of any
+// Database, returning nil if it isn't there.
+func getRecord(db Database, bucket []byte, ih bittorrent.InfoHash) (*Record, error) {
+	if rs, ok := db.(recordStore); ok {
+		return rs.Record(bucket, ih)
+	}
+
+	r := &Record{InfoHash: ih}
+	found, err := db.Get(bucket, ih[:], r)
+	if err != nil || found == nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// MarshalBinary encodes the Record, without the infohash which is the key,
+// as the version byte, the signer key, the approval and expiry times in
+// unix seconds (0 when unset) and the metadata.
+func (r *Record) MarshalBinary() ([]byte, error) {
+	signer, err := hex.DecodeString(r.Signer)
+	if err != nil || len(signer) > 255 {
+		return nil, errors.New("invalid signer " + r.Signer)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(recordVersion)
+	buf.WriteByte(byte(len(signer)))
+	buf.Write(signer)
+	binary.Write(buf, binary.BigEndian, unixOrZero(r.ApprovedAt))
+	binary.Write(buf, binary.BigEndian, unixOrZero(r.ExpiresAt))
+	binary.Write(buf, binary.BigEndian, uint32(len(r.Metadata)))
+	buf.WriteString(r.Metadata)
+	return buf.Bytes(), nil
+}
+
+func (r *Record) UnmarshalBinary(data []byte) error {
+	_, err := r.UnmarshalBinaryData(data)
+	return err
+}
+
+// UnmarshalBinaryData decodes a Record. An empty value, as written before
+// schema version 1, is a Record without details.
+func (r *Record) UnmarshalBinaryData(data []byte) ([]byte, error) {
+	ih := r.InfoHash
+	*r = Record{InfoHash: ih}
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	if data[0] != recordVersion {
+		return nil, fmt.Errorf("unknown record version %d", data[0])
+	}
+	data = data[1:]
+
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, errors.New("record too short")
+	}
+	r.Signer = hex.EncodeToString(data[1 : 1+int(data[0])])
+	data = data[1+int(data[0]):]
+
+	if len(data) < 20 {
+		return nil, errors.New("record too short")
+	}
+	r.ApprovedAt = fromUnix(int64(binary.BigEndian.Uint64(data[0:8])))
+	r.ExpiresAt = fromUnix(int64(binary.BigEndian.Uint64(data[8:16])))
+	n := int(binary.BigEndian.Uint32(data[16:20]))
+	data = data[20:]
+
+	if len(data) < n {
+		return nil, errors.New("record too short")
+	}
+	r.Metadata = string(data[:n])
+	return data[n:], nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// rawValue is a database value kept as it is.
+type rawValue []byte
+
+func (v *rawValue) MarshalBinary() ([]byte, error) {
+	return *v, nil
+}
+
+func (v *rawValue) UnmarshalBinary(data []byte) error {
+	*v = append((*v)[:0], data...)
+	return nil
+}
+
+func (v *rawValue) UnmarshalBinaryData(data []byte) ([]byte, error) {
+	*v = append((*v)[:0], data...)
+	return nil, nil
+}
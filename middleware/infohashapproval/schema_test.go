@@ -0,0 +1,180 @@
+package infohashapproval
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+var (
+	testWhitelisted = bittorrent.InfoHash{1, 2, 3}
+	testBlacklisted = bittorrent.InfoHash{4, 5, 6}
+)
+
+// writeV0 fills db as version 0 of the hook did: infohash keys with empty
+// values and no schema version.
+func writeV0(t *testing.T, db Database) {
+	if err := db.Put([]byte("whitelist"), testWhitelisted[:], new(EmptyStruct)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("blacklist"), testBlacklisted[:], new(EmptyStruct)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkMigrated(t *testing.T, db Database) {
+	v := new(rawValue)
+	found, err := db.Get([]byte("meta"), []byte("schema_version"), v)
+	if err != nil || found == nil {
+		t.Fatalf("schema version not written: %v", err)
+	}
+	if !bytes.Equal(*v, []byte{0, 0, 0, schemaVersion}) {
+		t.Fatalf("schema version is %x, want %d", *v, schemaVersion)
+	}
+
+	for bucket, ih := range map[string]bittorrent.InfoHash{"whitelist": testWhitelisted, "blacklist": testBlacklisted} {
+		raw := new(rawValue)
+		if _, err := db.Get([]byte(bucket), ih[:], raw); err != nil {
+			t.Fatal(err)
+		}
+		if len(*raw) == 0 || (*raw)[0] != recordVersion {
+			t.Errorf("%s value %x is not an encoded Record", bucket, *raw)
+		}
+
+		r, err := getRecord(db, []byte(bucket), ih)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r == nil || *r != (Record{InfoHash: ih}) {
+			t.Errorf("%s record is %+v, want one without details", bucket, r)
+		}
+	}
+
+	// Migrating again changes nothing
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateMap(t *testing.T) {
+	db, _ := NewMapDB()
+	writeV0(t, db)
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t, db)
+}
+
+func TestMigrateBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "infohashapproval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "approvals.db")
+
+	db, err := NewOrOpenBoltDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeV0(t, db)
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// The migration is on disk
+	db, err = NewOrOpenBoltDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkMigrated(t, db)
+}
+
+func TestMigrateNewerVersion(t *testing.T) {
+	db, _ := NewMapDB()
+	if err := writeSchemaVersion(db, schemaVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err == nil {
+		t.Fatal("migrated a database newer than the hook")
+	}
+}
+
+func TestRecordBinaryRoundTrip(t *testing.T) {
+	approvedAt := time.Unix(1496318400, 0)
+	tests := []Record{
+		{InfoHash: testWhitelisted},
+		{InfoHash: testWhitelisted, Signer: "cc1985cdfae4e32b5a454dfda8ce5e1361558482684f3367649c3ad852c8e31a"},
+		{InfoHash: testWhitelisted, ApprovedAt: approvedAt, ExpiresAt: approvedAt.Add(time.Hour)},
+		{InfoHash: testWhitelisted, Metadata: `{"name":"factomd"}`},
+		{
+			InfoHash:   testWhitelisted,
+			Signer:     "cc1985cdfae4e32b5a454dfda8ce5e1361558482684f3367649c3ad852c8e31a",
+			ApprovedAt: approvedAt,
+			Metadata:   `{"name":"factomd","size":1024}`,
+		},
+	}
+
+	for _, want := range tests {
+		data, err := want.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := Record{InfoHash: want.InfoHash}
+		rest, err := got.UnmarshalBinaryData(data)
+		if err != nil {
+			t.Fatalf("%+v: %v", want, err)
+		}
+		if len(rest) != 0 {
+			t.Errorf("%+v: %d bytes left over", want, len(rest))
+		}
+		if got.Signer != want.Signer || !got.ApprovedAt.Equal(want.ApprovedAt) || !got.ExpiresAt.Equal(want.ExpiresAt) || got.Metadata != want.Metadata {
+			t.Errorf("decoded %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestRecordBinaryInvalid(t *testing.T) {
+	r := Record{
+		InfoHash:   testWhitelisted,
+		Signer:     "cc1985cdfae4e32b5a454dfda8ce5e1361558482684f3367649c3ad852c8e31a",
+		ApprovedAt: time.Unix(1496318400, 0),
+		Metadata:   `{"name":"factomd"}`,
+	}
+	data, err := r.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every truncation but the empty value of version 0 is rejected
+	for n := 1; n < len(data); n++ {
+		if err := new(Record).UnmarshalBinary(data[:n]); err == nil {
+			t.Errorf("decoded a record truncated to %d of %d bytes", n, len(data))
+		}
+	}
+
+	unknown := append([]byte{recordVersion + 1}, data[1:]...)
+	if err := new(Record).UnmarshalBinary(unknown); err == nil {
+		t.Error("decoded a record of an unknown version")
+	}
+
+	// A metadata length past the end of the value
+	long := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(long[len(long)-len(r.Metadata)-4:], uint32(len(r.Metadata)+1))
+	if err := new(Record).UnmarshalBinary(long); err == nil {
+		t.Error("decoded a record with a metadata length past its end")
+	}
+
+	if _, err := (&Record{Signer: "not hex"}).MarshalBinary(); err == nil {
+		t.Error("encoded a record with an invalid signer")
+	}
+}
@@ -0,0 +1,115 @@
+package infohashapproval
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// shardCount is the number of shards an infohashSet is split into, keyed on
+// the first byte of the infohash.
+const shardCount = 256
+
+// infohashSet is a set of infohashes that is read without locking.
+//
+// Every shard is immutable and held in an atomic.Value. Writers build a
+// changed copy of the shards they touch and swap them in, so readers always
+// see a consistent snapshot of a shard and an approval only copies 1/256th
+// of the set.
+type infohashSet struct {
+	shards [shardCount]atomic.Value // shard
+	count  int64
+
+	// Serializes writers, readers never take it
+	writeLock sync.Mutex
+}
+
+// newInfohashSet returns an empty set using the given storage, "map" (the
+// default) or "sorted".
+func newInfohashSet(storage string) (*infohashSet, error) {
+	var empty shard
+	switch storage {
+	case "", "map":
+		empty = mapShard{}
+	case "sorted":
+		empty = sortedShard{}
+	default:
+		return nil, errors.New("unknown whitelist storage " + storage)
+	}
+
+	s := new(infohashSet)
+	for i := range s.shards {
+		s.shards[i].Store(empty)
+	}
+	return s, nil
+}
+
+func (s *infohashSet) shard(i byte) shard {
+	return s.shards[i].Load().(shard)
+}
+
+// Contains returns true if the infohash is in the set.
+func (s *infohashSet) Contains(ih bittorrent.InfoHash) bool {
+	return s.shard(ih[0]).contains(ih)
+}
+
+// Len returns the number of infohashes in the set.
+func (s *infohashSet) Len() int {
+	return int(atomic.LoadInt64(&s.count))
+}
+
+// Add adds infohashes to the set, returning how many were not already in
+// it. Each changed shard is copied once, so adding in bulk is cheap.
+func (s *infohashSet) Add(ihs ...bittorrent.InfoHash) int {
+	changed := s.update(ihs, func(sh shard, ihs []bittorrent.InfoHash) (shard, int) {
+		return sh.with(ihs, nil)
+	})
+	atomic.AddInt64(&s.count, int64(changed))
+	return changed
+}
+
+// Remove removes infohashes from the set, returning how many were in it.
+func (s *infohashSet) Remove(ihs ...bittorrent.InfoHash) int {
+	changed := s.update(ihs, func(sh shard, ihs []bittorrent.InfoHash) (shard, int) {
+		return sh.with(nil, ihs)
+	})
+	atomic.AddInt64(&s.count, -int64(changed))
+	return changed
+}
+
+// Each calls fn for every infohash in the set.
+func (s *infohashSet) Each(fn func(bittorrent.InfoHash)) {
+	for i := range s.shards {
+		s.shard(byte(i)).each(fn)
+	}
+}
+
+// update groups ihs by shard, replaces every touched shard with the result
+// of change and returns the total amount of infohashes changed.
+func (s *infohashSet) update(ihs []bittorrent.InfoHash, change func(shard, []bittorrent.InfoHash) (shard, int)) int {
+	// Sized up front, as shards may keep their group
+	var sizes [256]int
+	for _, ih := range ihs {
+		sizes[ih[0]]++
+	}
+	groups := make(map[byte][]bittorrent.InfoHash)
+	for _, ih := range ihs {
+		if groups[ih[0]] == nil {
+			groups[ih[0]] = make([]bittorrent.InfoHash, 0, sizes[ih[0]])
+		}
+		groups[ih[0]] = append(groups[ih[0]], ih)
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	changed := 0
+	for i, group := range groups {
+		sh, n := change(s.shard(i), group)
+		s.shards[i].Store(sh)
+		changed += n
+	}
+	return changed
+}
@@ -0,0 +1,279 @@
+package infohashapproval
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// benchmarkEntries is the size of the whitelist the benchmarks run with.
+const benchmarkEntries = 1000000
+
+var storages = []string{"map", "sorted"}
+
+func testInfohash(b ...byte) bittorrent.InfoHash {
+	var ih bittorrent.InfoHash
+	copy(ih[:], b)
+	return ih
+}
+
+func randomInfohashes(n int) []bittorrent.InfoHash {
+	ihs := make([]bittorrent.InfoHash, n)
+	for i := range ihs {
+		rand.Read(ihs[i][:])
+	}
+	return ihs
+}
+
+// sorted returns the infohashes of a shard in order.
+func sorted(sh shard) []bittorrent.InfoHash {
+	var ihs []bittorrent.InfoHash
+	sh.each(func(ih bittorrent.InfoHash) {
+		ihs = append(ihs, ih)
+	})
+	sort.Slice(ihs, func(i, j int) bool { return bytes.Compare(ihs[i][:], ihs[j][:]) < 0 })
+	return ihs
+}
+
+func TestShardWith(t *testing.T) {
+	a, b, c := testInfohash(0, 1), testInfohash(0, 2), testInfohash(0, 3)
+	tests := []struct {
+		name        string
+		initial     []bittorrent.InfoHash
+		add, remove []bittorrent.InfoHash
+		want        []bittorrent.InfoHash
+		changed     int
+	}{
+		{"add to empty", nil, []bittorrent.InfoHash{b, a}, nil, []bittorrent.InfoHash{a, b}, 2},
+		{"add duplicates", nil, []bittorrent.InfoHash{a, a}, nil, []bittorrent.InfoHash{a}, 1},
+		{"add existing", []bittorrent.InfoHash{a}, []bittorrent.InfoHash{a, b}, nil, []bittorrent.InfoHash{a, b}, 1},
+		{"remove", []bittorrent.InfoHash{a, b, c}, nil, []bittorrent.InfoHash{b}, []bittorrent.InfoHash{a, c}, 1},
+		{"remove duplicates", []bittorrent.InfoHash{a, b}, nil, []bittorrent.InfoHash{a, a}, []bittorrent.InfoHash{b}, 1},
+		{"remove missing", []bittorrent.InfoHash{a}, nil, []bittorrent.InfoHash{b}, []bittorrent.InfoHash{a}, 0},
+		{"remove all", []bittorrent.InfoHash{a, b}, nil, []bittorrent.InfoHash{b, a}, nil, 2},
+		{"add and remove", []bittorrent.InfoHash{a, b}, []bittorrent.InfoHash{c}, []bittorrent.InfoHash{a}, []bittorrent.InfoHash{b, c}, 2},
+	}
+
+	for _, empty := range []shard{mapShard{}, sortedShard{}} {
+		for _, tt := range tests {
+			initial, _ := empty.with(tt.initial, nil)
+			before := sorted(initial)
+
+			got, changed := initial.with(tt.add, tt.remove)
+			if changed != tt.changed {
+				t.Errorf("%T %s: changed %d, want %d", empty, tt.name, changed, tt.changed)
+			}
+			if ihs := sorted(got); !equalInfohashes(ihs, tt.want) {
+				t.Errorf("%T %s: got %x, want %x", empty, tt.name, ihs, tt.want)
+			}
+			for _, ih := range tt.want {
+				if !got.contains(ih) {
+					t.Errorf("%T %s: doesn't contain %x", empty, tt.name, ih)
+				}
+			}
+			for _, ih := range tt.remove {
+				if got.contains(ih) {
+					t.Errorf("%T %s: still contains %x", empty, tt.name, ih)
+				}
+			}
+			if !equalInfohashes(sorted(initial), before) {
+				t.Errorf("%T %s: changed the original shard", empty, tt.name)
+			}
+		}
+	}
+}
+
+func TestInfohashSet(t *testing.T) {
+	// Spread over several shards, with two in the same one
+	a, b, c, d := testInfohash(0, 1), testInfohash(0, 2), testInfohash(7, 1), testInfohash(255, 1)
+
+	for _, storage := range storages {
+		s, err := newInfohashSet(storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n := s.Add(a, b, c, a); n != 3 {
+			t.Errorf("%s: added %d, want 3", storage, n)
+		}
+		if n := s.Add(c, d); n != 1 {
+			t.Errorf("%s: added %d, want 1", storage, n)
+		}
+		if n := s.Remove(b, testInfohash(9)); n != 1 {
+			t.Errorf("%s: removed %d, want 1", storage, n)
+		}
+
+		for _, tt := range []struct {
+			ih   bittorrent.InfoHash
+			want bool
+		}{{a, true}, {b, false}, {c, true}, {d, true}, {testInfohash(9), false}} {
+			if got := s.Contains(tt.ih); got != tt.want {
+				t.Errorf("%s: Contains(%x) = %t, want %t", storage, tt.ih, got, tt.want)
+			}
+		}
+
+		if s.Len() != 3 {
+			t.Errorf("%s: Len() = %d, want 3", storage, s.Len())
+		}
+		var each []bittorrent.InfoHash
+		s.Each(func(ih bittorrent.InfoHash) { each = append(each, ih) })
+		if !equalInfohashes(each, []bittorrent.InfoHash{a, c, d}) {
+			t.Errorf("%s: Each gave %x", storage, each)
+		}
+	}
+
+	if _, err := newInfohashSet("tree"); err == nil {
+		t.Error("created a set with an unknown storage")
+	}
+}
+
+func equalInfohashes(a, b []bittorrent.InfoHash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func newBenchmarkSet(b *testing.B, storage string) (*infohashSet, []bittorrent.InfoHash) {
+	s, err := newInfohashSet(storage)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ihs := randomInfohashes(benchmarkEntries)
+	s.Add(ihs...)
+	return s, ihs
+}
+
+// BenchmarkContains checks whitelisted infohashes from all CPUs, like
+// announces do.
+func BenchmarkContains(b *testing.B) {
+	for _, storage := range storages {
+		b.Run(storage, func(b *testing.B) {
+			s, ihs := newBenchmarkSet(b, storage)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if !s.Contains(ihs[i%len(ihs)]) {
+						b.Fatal("whitelisted infohash not found")
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkAdd approves one infohash at a time, copying its shard each time.
+func BenchmarkAdd(b *testing.B) {
+	for _, storage := range storages {
+		b.Run(storage, func(b *testing.B) {
+			s, _ := newBenchmarkSet(b, storage)
+			ihs := randomInfohashes(b.N)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for _, ih := range ihs {
+				s.Add(ih)
+			}
+		})
+	}
+}
+
+// BenchmarkContainsWhileAdding checks whitelisted infohashes from all CPUs
+// while another goroutine keeps approving new ones, as announces do while
+// approvals come in.
+func BenchmarkContainsWhileAdding(b *testing.B) {
+	for _, storage := range storages {
+		b.Run(storage, func(b *testing.B) {
+			s, ihs := newBenchmarkSet(b, storage)
+			added := randomInfohashes(100000)
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+						s.Add(added[i%len(added)])
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if !s.Contains(ihs[i%len(ihs)]) {
+						b.Fatal("whitelisted infohash not found")
+					}
+					i++
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			<-done
+		})
+	}
+}
+
+// BenchmarkHandleAnnounce runs unsigned announces of whitelisted infohashes
+// through the hook from all CPUs.
+func BenchmarkHandleAnnounce(b *testing.B) {
+	for _, storage := range storages {
+		b.Run(storage, func(b *testing.B) {
+			hk, err := NewHook(Config{Database: "Map", WhitelistStorage: storage})
+			if err != nil {
+				b.Fatal(err)
+			}
+			h := hk.(*hook)
+			defer func() { <-h.Stop() }()
+			ihs := randomInfohashes(benchmarkEntries)
+			h.approved.Add(ihs...)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				req := &bittorrent.AnnounceRequest{}
+				req.Peer.IP = net.ParseIP("10.0.0.1")
+				i := 0
+				for pb.Next() {
+					req.InfoHash = ihs[i%len(ihs)]
+					if _, err := h.HandleAnnounce(context.Background(), req, nil); err != nil {
+						b.Fatal(err)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkLoad builds a whitelist of benchmarkEntries infohashes at once,
+// as on startup. The bytes allocated per op are what loading costs.
+func BenchmarkLoad(b *testing.B) {
+	ihs := randomInfohashes(benchmarkEntries)
+	for _, storage := range storages {
+		b.Run(storage, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s, err := newInfohashSet(storage)
+				if err != nil {
+					b.Fatal(err)
+				}
+				s.Add(ihs...)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package infohashapproval
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// shard is an immutable part of an infohashSet.
+type shard interface {
+	contains(ih bittorrent.InfoHash) bool
+	each(fn func(bittorrent.InfoHash))
+
+	// with returns a copy of the shard with add added and remove removed,
+	// and the amount of infohashes that changed. It may reorder add and
+	// remove, and keep add as the new shard.
+	with(add, remove []bittorrent.InfoHash) (shard, int)
+}
+
+// mapShard is the default shard, fast but using several times the 20 bytes
+// of each infohash.
+type mapShard map[bittorrent.InfoHash]struct{}
+
+func (m mapShard) contains(ih bittorrent.InfoHash) bool {
+	_, ok := m[ih]
+	return ok
+}
+
+func (m mapShard) each(fn func(bittorrent.InfoHash)) {
+	for ih := range m {
+		fn(ih)
+	}
+}
+
+func (m mapShard) with(add, remove []bittorrent.InfoHash) (shard, int) {
+	c := make(mapShard, len(m)+len(add))
+	for ih := range m {
+		c[ih] = struct{}{}
+	}
+
+	changed := 0
+	for _, ih := range add {
+		if _, ok := c[ih]; !ok {
+			c[ih] = struct{}{}
+			changed++
+		}
+	}
+	for _, ih := range remove {
+		if _, ok := c[ih]; ok {
+			delete(c, ih)
+			changed++
+		}
+	}
+	return c, changed
+}
+
+// sortedShard is a sorted array of infohashes searched with binary search.
+// It uses only the 20 bytes of each infohash, for whitelists of millions of
+// infohashes.
+type sortedShard []bittorrent.InfoHash
+
+func (s sortedShard) Len() int           { return len(s) }
+func (s sortedShard) Less(i, j int) bool { return bytes.Compare(s[i][:], s[j][:]) < 0 }
+func (s sortedShard) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (s sortedShard) contains(ih bittorrent.InfoHash) bool {
+	i := sort.Search(len(s), func(i int) bool {
+		return bytes.Compare(s[i][:], ih[:]) >= 0
+	})
+	return i < len(s) && s[i] == ih
+}
+
+func (s sortedShard) each(fn func(bittorrent.InfoHash)) {
+	for _, ih := range s {
+		fn(ih)
+	}
+}
+
+func (s sortedShard) with(add, remove []bittorrent.InfoHash) (shard, int) {
+	added, removed := sortedShard(add), sortedShard(remove)
+	sort.Sort(added)
+	sort.Sort(removed)
+
+	// Merged into a new array, or when there is nothing to merge with, in
+	// place into add, so loading a whitelist doesn't copy it again
+	var merged sortedShard
+	if len(s) == 0 {
+		merged = added[:0]
+	} else {
+		merged = make(sortedShard, 0, len(s)+len(added))
+	}
+
+	// Drop duplicates and removed infohashes, counting the distinct
+	// infohashes of both
+	distinct, dropped := 0, 0
+	var last bittorrent.InfoHash
+	for i, j, k := 0, 0, 0; i < len(s) || j < len(added); {
+		var ih bittorrent.InfoHash
+		if j == len(added) || (i < len(s) && bytes.Compare(s[i][:], added[j][:]) <= 0) {
+			ih = s[i]
+			i++
+		} else {
+			ih = added[j]
+			j++
+		}
+		if distinct > 0 && last == ih {
+			continue
+		}
+		last = ih
+		distinct++
+
+		for k < len(removed) && bytes.Compare(removed[k][:], ih[:]) < 0 {
+			k++
+		}
+		if k < len(removed) && removed[k] == ih {
+			dropped++
+			continue
+		}
+		merged = append(merged, ih)
+	}
+
+	// Copy out so the shard doesn't hold on to spare capacity
+	if len(merged) < cap(merged) {
+		c := make(sortedShard, len(merged))
+		copy(c, merged)
+		merged = c
+	}
+
+	// Like mapShard, an infohash both added and removed counts twice
+	return merged, distinct - len(s) + dropped
+}
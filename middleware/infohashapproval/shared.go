@@ -0,0 +1,159 @@
+package infohashapproval
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// On reload, the new hook is created before the running one is stopped, so
+// both are alive at once. They share their database, which Bolt and LDB
+// lock to one opener, and their listeners, which can't both bind the same
+// address. The newest hook serves the shared listeners; when it is stopped
+// they go back to the hook before it, so a failed reload leaves the running
+// hook as it was.
+var shared = struct {
+	sync.Mutex
+	databases map[string]*sharedDatabase
+	servers   map[string]*sharedServer
+}{
+	databases: make(map[string]*sharedDatabase),
+	servers:   make(map[string]*sharedServer),
+}
+
+type sharedDatabase struct {
+	db   Database
+	refs int
+}
+
+// databaseKey identifies the database a config opens.
+func databaseKey(cfg Config) string {
+	switch cfg.Database {
+	case "Bolt", "LDB":
+		return cfg.Database + " " + DatabasePath(cfg)
+	case "Redis":
+		return cfg.Database + " " + cfg.RedisAddr + " " + cfg.RedisPrefix
+	case "SQL":
+		return cfg.Database + " " + cfg.SQLDriver + " " + cfg.SQLDSN
+	}
+	return cfg.Database
+}
+
+// acquireDatabase returns the database configured for the hook, opening it
+// unless another hook already has. Every acquired database must be released.
+func acquireDatabase(cfg Config) (Database, error) {
+	shared.Lock()
+	defer shared.Unlock()
+
+	key := databaseKey(cfg)
+	if d, ok := shared.databases[key]; ok {
+		d.refs++
+		return d.db, nil
+	}
+
+	db, err := OpenDatabase(cfg)
+	if err != nil || db == nil {
+		return nil, err
+	}
+	shared.databases[key] = &sharedDatabase{db: db, refs: 1}
+	return db, nil
+}
+
+// releaseDatabase closes db once no hook uses it.
+func releaseDatabase(db Database) {
+	if db == nil {
+		return
+	}
+
+	shared.Lock()
+	defer shared.Unlock()
+
+	for key, d := range shared.databases {
+		if d.db != db {
+			continue
+		}
+		d.refs--
+		if d.refs == 0 {
+			delete(shared.databases, key)
+			if err := db.Close(); err != nil {
+				log.Println("Failed to close infohash database: " + err.Error())
+			}
+		}
+		return
+	}
+}
+
+type sharedServer struct {
+	server *http.Server
+
+	// The handlers of every hook using the server, newest last
+	owners   []*hook
+	handlers []http.Handler
+}
+
+// ServeHTTP hands the request to the newest hook.
+func (s *sharedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	shared.Lock()
+	handler := s.handlers[len(s.handlers)-1]
+	shared.Unlock()
+
+	handler.ServeHTTP(w, r)
+}
+
+// serveShared serves handler for h on addr, listening unless another hook
+// already does. It fails if addr can't be listened on, so a reload with a
+// new address is refused rather than losing the server.
+func (h *hook) serveShared(name, addr string, handler http.Handler) error {
+	shared.Lock()
+	defer shared.Unlock()
+
+	if s, ok := shared.servers[addr]; ok {
+		s.owners = append(s.owners, h)
+		s.handlers = append(s.handlers, handler)
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.New("could not serve infohash " + name + ": " + err.Error())
+	}
+
+	s := &sharedServer{owners: []*hook{h}, handlers: []http.Handler{handler}}
+	s.server = &http.Server{Addr: addr, Handler: s}
+	shared.servers[addr] = s
+
+	go func() {
+		log.Println("Serving infohash " + name + " on " + addr)
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Println("Infohash " + name + " server failed: " + err.Error())
+		}
+	}()
+	return nil
+}
+
+// releaseServer stops serving h on addr, closing the listener once no hook
+// uses it.
+func (h *hook) releaseServer(addr string) {
+	shared.Lock()
+	defer shared.Unlock()
+
+	s, ok := shared.servers[addr]
+	if !ok {
+		return
+	}
+
+	for i, owner := range s.owners {
+		if owner == h {
+			s.owners = append(s.owners[:i], s.owners[i+1:]...)
+			s.handlers = append(s.handlers[:i], s.handlers[i+1:]...)
+			break
+		}
+	}
+
+	if len(s.owners) == 0 {
+		delete(shared.servers, addr)
+		s.server.Close()
+	}
+}
@@ -0,0 +1,29 @@
+package infohashapproval
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestServeSharedListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	h := new(hook)
+	if err := h.serveShared("test", addr, http.NotFoundHandler()); err == nil {
+		h.releaseServer(addr)
+		t.Fatal("served on an address already in use")
+	}
+
+	shared.Lock()
+	_, ok := shared.servers[addr]
+	shared.Unlock()
+	if ok {
+		t.Error("kept a server that failed to listen")
+	}
+}
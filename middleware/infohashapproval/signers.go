@@ -0,0 +1,152 @@
+package infohashapproval
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+// defaultSignerExpiryWarning is how long before a signer's not_after date
+// the tracker starts warning about it, when not set in the config.
+const defaultSignerExpiryWarning = 7 * 24 * time.Hour
+
+// SignerConfig is a public key allowed to approve infohashes, with an
+// optional validity period. Dates are either RFC3339 timestamps or plain
+// 2006-01-02 dates (UTC).
+//
+// In YAML a signer can be written as a bare hex key, or as a mapping when a
+// validity period is needed:
+//
+//	signers:
+//	  - "cc1985cd..."
+//	  - key: "5a3f09be..."
+//	    not_before: 2017-06-01
+//	    not_after: 2018-06-01
+type SignerConfig struct {
+	Key       string `yaml:"key"`
+	NotBefore string `yaml:"not_before"`
+	NotAfter  string `yaml:"not_after"`
+}
+
+// UnmarshalYAML allows a SignerConfig to be given as a bare key string.
+func (s *SignerConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var key string
+	if err := unmarshal(&key); err == nil {
+		*s = SignerConfig{Key: key}
+		return nil
+	}
+
+	type plain SignerConfig
+	return unmarshal((*plain)(s))
+}
+
+// signer is a parsed SignerConfig.
+type signer struct {
+	key       [ed.PublicKeySize]byte
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+func newSigner(cfg SignerConfig) (signer, error) {
+	var s signer
+
+	key, err := hex.DecodeString(cfg.Key)
+	if err != nil || len(key) != ed.PublicKeySize {
+		return s, errors.New("Signer " + cfg.Key + " must be a 32 byte hex public key")
+	}
+	copy(s.key[:], key)
+
+	s.notBefore, err = parseSignerTime(cfg.NotBefore)
+	if err != nil {
+		return s, errors.New("Signer " + cfg.Key + " has an invalid not_before: " + err.Error())
+	}
+
+	s.notAfter, err = parseSignerTime(cfg.NotAfter)
+	if err != nil {
+		return s, errors.New("Signer " + cfg.Key + " has an invalid not_after: " + err.Error())
+	}
+
+	if !s.notBefore.IsZero() && !s.notAfter.IsZero() && !s.notAfter.After(s.notBefore) {
+		return s, errors.New("Signer " + cfg.Key + " has a not_after before its not_before")
+	}
+
+	return s, nil
+}
+
+func parseSignerTime(str string) (time.Time, error) {
+	if str == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, str)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", str)
+}
+
+// String returns the hex encoded public key.
+func (s signer) String() string {
+	return hex.EncodeToString(s.key[:])
+}
+
+// validAt returns true if the signer may approve infohashes at time t.
+func (s signer) validAt(t time.Time) bool {
+	if !s.notBefore.IsZero() && t.Before(s.notBefore) {
+		return false
+	}
+	if !s.notAfter.IsZero() && !t.Before(s.notAfter) {
+		return false
+	}
+	return true
+}
+
+// verify returns true if sig is a valid signature of the infohash by this
+// signer.
+func (s signer) verify(infohash []byte, sig *[ed.SignatureSize]byte) bool {
+	return ed.VerifyCanonical(&s.key, infohash, sig)
+}
+
+// watchSignerExpiry periodically logs and exports the signers that are
+// close to, or past, their not_after date.
+func (h *hook) watchSignerExpiry() {
+	h.checkSignerExpiry()
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.checkSignerExpiry()
+		case <-h.closing:
+			return
+		}
+	}
+}
+
+func (h *hook) checkSignerExpiry() {
+	now := time.Now()
+	expiring := 0
+
+	chihayaSignerExpirySeconds.Reset()
+	for _, s := range h.signers {
+		if s.notAfter.IsZero() {
+			continue
+		}
+
+		remaining := s.notAfter.Sub(now)
+		chihayaSignerExpirySeconds.WithLabelValues(s.String()).Set(remaining.Seconds())
+
+		switch {
+		case remaining <= 0:
+			log.Printf("Signer %s expired on %s\n", s, s.notAfter.Format(time.RFC3339))
+		case remaining <= h.signerExpiryWarning:
+			expiring++
+			log.Printf("Signer %s expires on %s\n", s, s.notAfter.Format(time.RFC3339))
+		}
+	}
+	chihayaSignersExpiringCount.Set(float64(expiring))
+}
@@ -0,0 +1,392 @@
+package infohashapproval
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/FactomProject/factomd/common/interfaces"
+	"github.com/chihaya/chihaya/bittorrent"
+
+	// Drivers for the SQL database
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Record is an infohash saved in the approval database, with the details of
+// its approval.
+type Record struct {
+	InfoHash   bittorrent.InfoHash
+	Signer     string // Hex public key of the signer, empty if not signed
+	ApprovedAt time.Time
+	ExpiresAt  time.Time // Zero if the approval doesn't expire
+	Metadata   string
+}
+
+// recordStore is implemented by Databases that keep the details of every
+// approval, not just the infohash.
+type recordStore interface {
+	PutRecord(bucket []byte, r Record) error
+	Record(bucket []byte, ih bittorrent.InfoHash) (*Record, error)
+	Records(bucket []byte) ([]Record, error)
+}
+
+// sqlSchema works on both SQLite and Postgres. Infohashes and signers are
+// stored hex encoded so they are easy to query by hand. The approvals table
+// holds both lists; the kv table holds every other bucket.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS approvals (
+		list        VARCHAR(16) NOT NULL,
+		infohash    CHAR(40)    NOT NULL,
+		signer      CHAR(64),
+		approved_at TIMESTAMP   NOT NULL,
+		expires_at  TIMESTAMP,
+		metadata    TEXT,
+		PRIMARY KEY (list, infohash)
+	)`,
+	`CREATE TABLE IF NOT EXISTS kv (
+		bucket VARCHAR(64) NOT NULL,
+		k      TEXT        NOT NULL,
+		v      TEXT        NOT NULL,
+		PRIMARY KEY (bucket, k)
+	)`,
+}
+
+// sqlDB is a Database stored with database/sql, in SQLite for a single
+// tracker or Postgres shared with other tools.
+type sqlDB struct {
+	db       *sql.DB
+	postgres bool
+}
+
+// NewSQLDB opens the database/sql database dsn with driver ("sqlite3" or
+// "postgres") and creates the tables if needed.
+func NewSQLDB(driver, dsn string) (Database, error) {
+	if driver != "sqlite3" && driver != "postgres" {
+		return nil, errors.New("sql_driver must be sqlite3 or postgres")
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if driver == "sqlite3" {
+		// SQLite only allows one writer at a time
+		db.SetMaxOpenConns(1)
+	}
+
+	for _, stmt := range sqlSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	log.Println("Database started from " + driver)
+	return &sqlDB{db: db, postgres: driver == "postgres"}, nil
+}
+
+// rebind replaces the ? placeholders with $1, $2... for Postgres.
+func (s *sqlDB) rebind(query string) string {
+	if !s.postgres {
+		return query
+	}
+
+	var b bytes.Buffer
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func isList(bucket []byte) bool {
+	return string(bucket) == "whitelist" || string(bucket) == "blacklist"
+}
+
+// execer is a *sql.DB or a *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// PutRecord saves an approval with its details in the whitelist or
+// blacklist.
+func (s *sqlDB) PutRecord(bucket []byte, r Record) error {
+	return s.putRecord(s.db, bucket, r)
+}
+
+func (s *sqlDB) putRecord(ex execer, bucket []byte, r Record) error {
+	var signer, metadata interface{}
+	if r.Signer != "" {
+		signer = r.Signer
+	}
+	if r.Metadata != "" {
+		metadata = r.Metadata
+	}
+	var expires interface{}
+	if !r.ExpiresAt.IsZero() {
+		expires = r.ExpiresAt.UTC()
+	}
+
+	_, err := ex.Exec(s.upsert(`approvals (list, infohash, signer, approved_at, expires_at, metadata) VALUES (?, ?, ?, ?, ?, ?)`,
+		`(list, infohash) DO UPDATE SET signer = excluded.signer, approved_at = excluded.approved_at, expires_at = excluded.expires_at, metadata = excluded.metadata`),
+		string(bucket), hex.EncodeToString(r.InfoHash[:]), signer, r.ApprovedAt.UTC(), expires, metadata)
+	return err
+}
+
+// upsert returns an insert into table and values that replaces the row
+// with the same primary key in one statement. Postgres takes the conflict
+// clause, SQLite replaces the whole row.
+func (s *sqlDB) upsert(into, conflict string) string {
+	if s.postgres {
+		return s.rebind(`INSERT INTO ` + into + ` ON CONFLICT ` + conflict)
+	}
+	return `INSERT OR REPLACE INTO ` + into
+}
+
+// Record returns the approval of ih in the whitelist or blacklist, or nil if
+// it isn't there.
+func (s *sqlDB) Record(bucket []byte, ih bittorrent.InfoHash) (*Record, error) {
+	var signer, metadata sql.NullString
+	var approved time.Time
+	var expires nullTime
+	err := s.db.QueryRow(s.rebind(`SELECT signer, approved_at, expires_at, metadata FROM approvals WHERE list = ? AND infohash = ?`),
+		string(bucket), hex.EncodeToString(ih[:])).Scan(&signer, &approved, &expires, &metadata)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Record{
+		InfoHash:   ih,
+		Signer:     signer.String,
+		ApprovedAt: approved,
+		ExpiresAt:  expires.Time,
+		Metadata:   metadata.String,
+	}, nil
+}
+
+// Records returns every approval of the whitelist or blacklist, including
+// expired ones.
+func (s *sqlDB) Records(bucket []byte) ([]Record, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT infohash, signer, approved_at, expires_at, metadata FROM approvals WHERE list = ?`), string(bucket))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var ih string
+		var signer, metadata sql.NullString
+		var approved time.Time
+		var expires nullTime
+		if err := rows.Scan(&ih, &signer, &approved, &expires, &metadata); err != nil {
+			return nil, err
+		}
+
+		ihBytes, err := hex.DecodeString(ih)
+		if err != nil || len(ihBytes) != 20 {
+			return nil, errors.New("Infohash " + ih + " must be 20 bytes")
+		}
+
+		r := Record{
+			Signer:     signer.String,
+			ApprovedAt: approved,
+			ExpiresAt:  expires.Time,
+			Metadata:   metadata.String,
+		}
+		copy(r.InfoHash[:], ihBytes)
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// nullTime scans a nullable TIMESTAMP, leaving Time zero for NULL.
+type nullTime struct {
+	Time time.Time
+}
+
+func (n *nullTime) Scan(value interface{}) error {
+	n.Time, _ = value.(time.Time)
+	return nil
+}
+
+func (s *sqlDB) Put(bucket, key []byte, data interfaces.BinaryMarshallable) error {
+	return s.put(s.db, bucket, key, data)
+}
+
+func (s *sqlDB) put(ex execer, bucket, key []byte, data interfaces.BinaryMarshallable) error {
+	if isList(bucket) {
+		if r, ok := data.(*Record); ok {
+			return s.putRecord(ex, bucket, *r)
+		}
+		var ih bittorrent.InfoHash
+		copy(ih[:], key)
+		return s.putRecord(ex, bucket, Record{InfoHash: ih, ApprovedAt: time.Now()})
+	}
+
+	value, err := data.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	_, err = ex.Exec(s.upsert(`kv (bucket, k, v) VALUES (?, ?, ?)`, `(bucket, k) DO UPDATE SET v = excluded.v`),
+		string(bucket), hex.EncodeToString(key), hex.EncodeToString(value))
+	return err
+}
+
+func (s *sqlDB) Get(bucket, key []byte, destination interfaces.BinaryMarshallable) (interfaces.BinaryMarshallable, error) {
+	var value []byte
+	if isList(bucket) {
+		var n int
+		err := s.db.QueryRow(s.rebind(`SELECT COUNT(*) FROM approvals WHERE list = ? AND infohash = ?`),
+			string(bucket), hex.EncodeToString(key)).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, nil
+		}
+	} else {
+		var v string
+		err := s.db.QueryRow(s.rebind(`SELECT v FROM kv WHERE bucket = ? AND k = ?`),
+			string(bucket), hex.EncodeToString(key)).Scan(&v)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		value, err = hex.DecodeString(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := destination.UnmarshalBinaryData(value); err != nil {
+		return nil, err
+	}
+	return destination, nil
+}
+
+func (s *sqlDB) Delete(bucket, key []byte) error {
+	return s.delete(s.db, bucket, key)
+}
+
+func (s *sqlDB) delete(ex execer, bucket, key []byte) error {
+	var err error
+	if isList(bucket) {
+		_, err = ex.Exec(s.rebind(`DELETE FROM approvals WHERE list = ? AND infohash = ?`), string(bucket), hex.EncodeToString(key))
+	} else {
+		_, err = ex.Exec(s.rebind(`DELETE FROM kv WHERE bucket = ? AND k = ?`), string(bucket), hex.EncodeToString(key))
+	}
+	return err
+}
+
+// WriteBatch makes the puts and deletes in one transaction.
+func (s *sqlDB) WriteBatch(puts, deletes []interfaces.Record) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range puts {
+		if err = s.put(tx, p.Bucket, p.Key, p.Data); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		for _, d := range deletes {
+			if err = s.delete(tx, d.Bucket, d.Key); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Leases are kept in the kv table, in a bucket named after the leased one,
+// with the end of the lease in unix nanoseconds.
+func (s *sqlDB) Lease(bucket, key []byte, until time.Time) (bool, error) {
+	leases := "lease:" + string(bucket)
+	k := hex.EncodeToString(key)
+
+	// An ended lease is deleted first, unless another took it meanwhile
+	var v string
+	err := s.db.QueryRow(s.rebind(`SELECT v FROM kv WHERE bucket = ? AND k = ?`), leases, k).Scan(&v)
+	if err == nil {
+		end, _ := strconv.ParseInt(v, 10, 64)
+		if time.Now().UnixNano() < end {
+			return false, nil
+		}
+		if _, err := s.db.Exec(s.rebind(`DELETE FROM kv WHERE bucket = ? AND k = ? AND v = ?`), leases, k, v); err != nil {
+			return false, err
+		}
+	} else if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	res, err := s.db.Exec(s.rebind(`INSERT INTO kv (bucket, k, v) SELECT CAST(? AS VARCHAR(64)), CAST(? AS TEXT), CAST(? AS TEXT) WHERE NOT EXISTS (SELECT 1 FROM kv WHERE bucket = ? AND k = ?)`),
+		leases, k, strconv.FormatInt(until.UnixNano(), 10), leases, k)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlDB) Release(bucket, key []byte) error {
+	_, err := s.db.Exec(s.rebind(`DELETE FROM kv WHERE bucket = ? AND k = ?`), "lease:"+string(bucket), hex.EncodeToString(key))
+	return err
+}
+
+func (s *sqlDB) ListAllKeys(bucket []byte) ([][]byte, error) {
+	var rows *sql.Rows
+	var err error
+	if isList(bucket) {
+		rows, err = s.db.Query(s.rebind(`SELECT infohash FROM approvals WHERE list = ?`), string(bucket))
+	} else {
+		rows, err = s.db.Query(s.rebind(`SELECT k FROM kv WHERE bucket = ?`), string(bucket))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys [][]byte
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+
+		key, err := hex.DecodeString(k)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqlDB) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,396 @@
+package infohashapproval
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+const (
+	defaultStatusTitle         = "Factom chihaya tracker"
+	defaultStatusMaxInfohashes = 1000
+	defaultStatusFeedSize      = 50
+	defaultStatusCacheTTL      = 10 * time.Second
+)
+
+// StatusConfig serves a public, read-only status page of the approved
+// infohashes on the HTTP frontend.
+type StatusConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Title   string `yaml:"title"`
+
+	// URL is where the HTTP frontend is publicly reached, such as
+	// https://tracker.example.com, which the Atom feed links to. Required,
+	// as the Host of a request is chosen by the client.
+	URL string `yaml:"url"`
+
+	// MaxInfohashes is how many infohashes are listed, the most recently
+	// approved first. FeedSize is how many are in the Atom feed.
+	MaxInfohashes int `yaml:"max_infohashes"`
+	FeedSize      int `yaml:"feed_size"`
+
+	// CacheTTL is how long the status is served before it is read again
+	// from the database and the peer store.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+// Swarms counts the peers of swarms. The tracker's storage.PeerStore
+// implements it.
+type Swarms interface {
+	ScrapeSwarm(ih bittorrent.InfoHash, v6 bool) bittorrent.Scrape
+}
+
+// SwarmsUser is implemented by hooks that report the peers of swarms. The
+// tracker hands them its peer store before serving their routes.
+type SwarmsUser interface {
+	UseSwarms(s Swarms)
+}
+
+// Status is the JSON served at /status.json.
+type Status struct {
+	Title     string        `json:"title"`
+	Generated time.Time     `json:"generated"`
+	Approved  int           `json:"approved"` // All approved infohashes, even those not listed
+	Swarms    []SwarmStatus `json:"swarms"`
+}
+
+// SwarmStatus is an approved infohash with its metadata, if any, and the
+// peers announcing it over IPv4 and IPv6.
+type SwarmStatus struct {
+	InfoHash   string     `json:"infohash"`
+	Name       string     `json:"name,omitempty"`
+	Size       int64      `json:"size,omitempty"`
+	Version    string     `json:"version,omitempty"`
+	ApprovedAt *time.Time `json:"approved_at,omitempty"`
+	Seeders    uint32     `json:"seeders"`
+	Leechers   uint32     `json:"leechers"`
+
+	// Served by the downloads endpoints, when enabled
+	Torrent string `json:"torrent,omitempty"`
+	Magnet  string `json:"magnet,omitempty"`
+}
+
+type statusPage struct {
+	cfg    StatusConfig
+	swarms Swarms // nil until UseSwarms, then the counts are left at 0
+
+	mu      sync.Mutex
+	status  *Status
+	expires time.Time
+}
+
+func (cfg StatusConfig) validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be the http or https URL of the tracker, not " + strconv.Quote(cfg.URL))
+	}
+	return nil
+}
+
+func newStatusPage(cfg StatusConfig) *statusPage {
+	if cfg.Title == "" {
+		cfg.Title = defaultStatusTitle
+	}
+	if cfg.MaxInfohashes == 0 {
+		cfg.MaxInfohashes = defaultStatusMaxInfohashes
+	}
+	if cfg.FeedSize == 0 {
+		cfg.FeedSize = defaultStatusFeedSize
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = defaultStatusCacheTTL
+	}
+	cfg.URL = strings.TrimSuffix(cfg.URL, "/")
+	return &statusPage{cfg: cfg}
+}
+
+// UseSwarms sets where the status page gets the peers of swarms from. It
+// must be called before the routes are served.
+func (h *hook) UseSwarms(s Swarms) {
+	if h.status != nil {
+		h.status.swarms = s
+	}
+}
+
+// currentStatus returns the cached status, reading it again once it
+// expired. Concurrent requests wait for the same read.
+func (h *hook) currentStatus() (*Status, error) {
+	p := h.status
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.status != nil && time.Now().Before(p.expires) {
+		return p.status, nil
+	}
+	status, err := h.readStatus()
+	if err != nil {
+		return nil, err
+	}
+	p.status, p.expires = status, time.Now().Add(p.cfg.CacheTTL)
+	return status, nil
+}
+
+// readStatus lists the approved infohashes, the most recently approved
+// first, and counts the peers of the ones listed.
+func (h *hook) readStatus() (*Status, error) {
+	records, err := h.approvedRecords()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].ApprovedAt.Equal(records[j].ApprovedAt) {
+			return records[i].ApprovedAt.After(records[j].ApprovedAt)
+		}
+		return bytes.Compare(records[i].InfoHash[:], records[j].InfoHash[:]) < 0
+	})
+
+	cfg := h.status.cfg
+	status := &Status{Title: cfg.Title, Generated: time.Now().UTC(), Approved: len(records), Swarms: []SwarmStatus{}}
+	if len(records) > cfg.MaxInfohashes {
+		records = records[:cfg.MaxInfohashes]
+	}
+
+	torrents := make(map[string]bool)
+	if h.downloads && h.MiddleWareDatabase != nil {
+		keys, err := h.MiddleWareDatabase.ListAllKeys([]byte("torrents"))
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			torrents[string(key)] = true
+		}
+	}
+
+	for _, r := range records {
+		ihString := hex.EncodeToString(r.InfoHash[:])
+		s := SwarmStatus{InfoHash: ihString}
+		if m := r.ParseMetadata(); m != nil {
+			s.Name, s.Size, s.Version = m.Name, m.Size, m.Version
+		}
+		if !r.ApprovedAt.IsZero() {
+			approvedAt := r.ApprovedAt.UTC()
+			s.ApprovedAt = &approvedAt
+		}
+		if swarms := h.status.swarms; swarms != nil {
+			for _, v6 := range []bool{false, true} {
+				scrape := swarms.ScrapeSwarm(r.InfoHash, v6)
+				s.Seeders += scrape.Complete
+				s.Leechers += scrape.Incomplete
+			}
+		}
+		if h.downloads {
+			s.Magnet = "/magnet/" + ihString
+			if torrents[string(r.InfoHash[:])] {
+				s.Torrent = "/torrents/" + ihString + ".torrent"
+			}
+		}
+		status.Swarms = append(status.Swarms, s)
+	}
+	return status, nil
+}
+
+// approvedRecords returns the Records of every approved infohash, with no
+// details for infohashes only held in memory, like those of whitelist_file.
+func (h *hook) approvedRecords() ([]Record, error) {
+	var records []Record
+	if h.MiddleWareDatabase != nil {
+		h.dbLock.Lock()
+		stored, err := readRecords(h.MiddleWareDatabase, []byte("whitelist"))
+		h.dbLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		records = stored
+	}
+
+	// Drop records revoked while they were read, as revoke updates the
+	// sets before the database.
+	listed := make(map[bittorrent.InfoHash]bool, len(records))
+	approved := records[:0]
+	for _, r := range records {
+		if h.approved.Contains(r.InfoHash) && !h.unapproved.Contains(r.InfoHash) && !listed[r.InfoHash] {
+			listed[r.InfoHash] = true
+			approved = append(approved, r)
+		}
+	}
+	h.approved.Each(func(ih bittorrent.InfoHash) {
+		if !listed[ih] && !h.unapproved.Contains(ih) {
+			approved = append(approved, Record{InfoHash: ih})
+		}
+	})
+	return approved, nil
+}
+
+// serveStatus serves the status page as HTML at /status, and as JSON at
+// /status.json.
+func (h *hook) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := h.currentStatus()
+	if err != nil {
+		log.Println("Failed to read status: " + err.Error())
+		http.Error(w, "failed to read database", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Path == "/status.json" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Println("Failed to write status: " + err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, status); err != nil {
+		log.Println("Failed to write status: " + err.Error())
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"time": func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04 MST")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<link rel="alternate" type="application/atom+xml" title="Approved releases" href="/status.atom">
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 0.8em; text-align: left; border-bottom: 1px solid #ddd; }
+td.n { text-align: right; }
+code { font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Approved}} approved infohashes{{if lt (len .Swarms) .Approved}}, the {{len .Swarms}} most recent listed{{end}}. Updated {{.Generated.Format "2006-01-02 15:04:05 MST"}}. Also as <a href="/status.json">JSON</a> and an <a href="/status.atom">Atom feed</a>.</p>
+<table>
+<tr><th>Name</th><th>Version</th><th>Size</th><th>Infohash</th><th>Approved</th><th>Seeders</th><th>Leechers</th><th></th></tr>
+{{range .Swarms}}<tr><td>{{.Name}}</td><td>{{.Version}}</td><td class="n">{{if .Size}}{{.Size}}{{end}}</td><td><code>{{.InfoHash}}</code></td><td>{{time .ApprovedAt}}</td><td class="n">{{.Seeders}}</td><td class="n">{{.Leechers}}</td><td>{{if .Torrent}}<a href="{{.Torrent}}">.torrent</a> {{end}}{{if .Magnet}}<a href="{{.Magnet}}">magnet</a>{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Summary string     `xml:"summary"`
+	Links   []atomLink `xml:"link"`
+}
+
+// serveStatusFeed serves an Atom feed of the most recently approved
+// infohashes at /status.atom. Infohashes approved before records kept the
+// approval time are left out, as they have no date.
+func (h *hook) serveStatusFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, err := h.currentStatus()
+	if err != nil {
+		log.Println("Failed to read status: " + err.Error())
+		http.Error(w, "failed to read database", http.StatusInternalServerError)
+		return
+	}
+
+	base := h.status.cfg.URL
+
+	feed := atomFeed{
+		ID:      base + "/status.atom",
+		Title:   status.Title,
+		Updated: status.Generated.Format(time.RFC3339),
+		Author:  atomAuthor{Name: status.Title},
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: base + "/status.atom"},
+			{Rel: "alternate", Type: "text/html", Href: base + "/status"},
+		},
+	}
+	for _, s := range status.Swarms {
+		if len(feed.Entries) == h.status.cfg.FeedSize {
+			break
+		}
+		if s.ApprovedAt == nil {
+			continue
+		}
+		if len(feed.Entries) == 0 {
+			feed.Updated = s.ApprovedAt.Format(time.RFC3339)
+		}
+
+		title := s.InfoHash
+		if s.Name != "" {
+			title = s.Name
+		}
+		if s.Version != "" {
+			title += " " + s.Version
+		}
+		entry := atomEntry{
+			ID:      "urn:btih:" + s.InfoHash,
+			Title:   title,
+			Updated: s.ApprovedAt.Format(time.RFC3339),
+			Summary: "Infohash " + s.InfoHash + " approved",
+			Links:   []atomLink{{Rel: "alternate", Type: "text/html", Href: base + "/status"}},
+		}
+		if s.Torrent != "" {
+			entry.Links = append(entry.Links, atomLink{Rel: "enclosure", Type: "application/x-bittorrent", Href: base + s.Torrent})
+		}
+		if s.Magnet != "" {
+			entry.Links = append(entry.Links, atomLink{Rel: "related", Type: "text/plain", Href: base + s.Magnet})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(feed); err != nil {
+		log.Println("Failed to write status feed: " + err.Error())
+	}
+}
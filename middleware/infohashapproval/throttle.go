@@ -0,0 +1,268 @@
+package infohashapproval
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+const (
+	defaultNegativeCacheSize      = 4096
+	defaultInvalidSignatureWindow = time.Minute
+	defaultBanDuration            = time.Hour
+)
+
+// ErrBanned is returned for signed announces from an IP that sent too many
+// invalid signatures.
+var ErrBanned = bittorrent.ClientError("too many invalid signatures, try again later")
+
+// negativeKey identifies a signature that failed verification.
+type negativeKey struct {
+	infohash [20]byte
+	sig      [ed.SignatureSize]byte
+}
+
+// negativeCache is a bounded LRU of signatures known to be invalid, so
+// repeated announces with the same bad signature are not verified again.
+type negativeCache struct {
+	size    int
+	order   *list.List
+	entries map[negativeKey]*list.Element
+	sync.Mutex
+}
+
+func newNegativeCache(size int) *negativeCache {
+	return &negativeCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[negativeKey]*list.Element),
+	}
+}
+
+// Contains returns true if the key is in the cache, and marks it as recently
+// used.
+func (c *negativeCache) Contains(k negativeKey) bool {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[k]
+	if ok {
+		c.order.MoveToFront(e)
+	}
+	return ok
+}
+
+// Add adds a key to the cache, evicting the least recently used key when
+// full.
+func (c *negativeCache) Add(k negativeKey) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[k]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[k] = c.order.PushFront(k)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(negativeKey))
+	}
+}
+
+// ipFailures counts the invalid signatures from an IP in the current window.
+type ipFailures struct {
+	count int
+	start time.Time
+}
+
+// throttle bans IPs that send more than limit invalid signatures within
+// window.
+type throttle struct {
+	limit       int
+	window      time.Duration
+	banDuration time.Duration
+
+	failures map[string]*ipFailures
+	bans     map[string]time.Time // IP -> end of ban
+	sync.Mutex
+}
+
+func newThrottle(cfg Config) *throttle {
+	t := &throttle{
+		limit:       cfg.InvalidSignatureLimit,
+		window:      cfg.InvalidSignatureWindow,
+		banDuration: cfg.BanDuration,
+		failures:    make(map[string]*ipFailures),
+		bans:        make(map[string]time.Time),
+	}
+	if t.window == 0 {
+		t.window = defaultInvalidSignatureWindow
+	}
+	if t.banDuration == 0 {
+		t.banDuration = defaultBanDuration
+	}
+	return t
+}
+
+// Banned returns true if the IP is currently banned.
+func (t *throttle) Banned(ip string) bool {
+	t.Lock()
+	defer t.Unlock()
+	until, ok := t.bans[ip]
+	return ok && time.Now().Before(until)
+}
+
+// Fail records an invalid signature from the IP. If it pushes the IP over
+// the limit, the IP is banned and the end of the ban is returned.
+func (t *throttle) Fail(ip string) (until time.Time, banned bool) {
+	if t.limit <= 0 {
+		return time.Time{}, false
+	}
+
+	now := time.Now()
+	t.Lock()
+	defer t.Unlock()
+
+	f, ok := t.failures[ip]
+	if !ok || now.Sub(f.start) > t.window {
+		f = &ipFailures{start: now}
+		t.failures[ip] = f
+	}
+	f.count++
+
+	if f.count <= t.limit {
+		return time.Time{}, false
+	}
+
+	delete(t.failures, ip)
+	until = now.Add(t.banDuration)
+	t.bans[ip] = until
+	chihayaBannedIPCount.Set(float64(len(t.bans)))
+	return until, true
+}
+
+// Ban bans an IP until the given time. It is used to restore persisted bans.
+func (t *throttle) Ban(ip string, until time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	t.bans[ip] = until
+	chihayaBannedIPCount.Set(float64(len(t.bans)))
+}
+
+// Expire drops failure windows and bans that are over, returning the IPs
+// that are no longer banned.
+func (t *throttle) Expire() (unbanned []string) {
+	now := time.Now()
+	t.Lock()
+	defer t.Unlock()
+
+	for ip, f := range t.failures {
+		if now.Sub(f.start) > t.window {
+			delete(t.failures, ip)
+		}
+	}
+
+	for ip, until := range t.bans {
+		if !now.Before(until) {
+			delete(t.bans, ip)
+			unbanned = append(unbanned, ip)
+		}
+	}
+	chihayaBannedIPCount.Set(float64(len(t.bans)))
+	return unbanned
+}
+
+// signatureFailed records an invalid signature of ih from an IP, banning
+// it if it crossed the limit.
+func (h *hook) signatureFailed(ih bittorrent.InfoHash, ip string) {
+	if h.webhooks != nil && h.webhooks.reportInvalid(ip, time.Now()) {
+		h.notify(WebhookInvalidSignature, ih, "", ip)
+	}
+
+	until, banned := h.throttle.Fail(ip)
+	if !banned {
+		return
+	}
+
+	chihayaBanCount.Inc()
+	log.Printf("Banned %s from signed announces until %s\n", ip, until.Format(time.RFC3339))
+	if h.persistBans && h.MiddleWareDatabase != nil {
+		err := h.MiddleWareDatabase.Put([]byte("bans"), []byte(ip), &banRecord{Until: until})
+		if err != nil {
+			log.Printf("Failed to write ban for %s to database: %s\n", ip, err.Error())
+		}
+	}
+}
+
+// expireBans periodically lifts bans that are over.
+func (h *hook) expireBans() {
+	ticker := time.NewTicker(h.throttle.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, ip := range h.throttle.Expire() {
+				if h.persistBans && h.MiddleWareDatabase != nil {
+					if err := h.MiddleWareDatabase.Delete([]byte("bans"), []byte(ip)); err != nil {
+						log.Printf("Failed to delete ban for %s from database: %s\n", ip, err.Error())
+					}
+				}
+			}
+		case <-h.closing:
+			return
+		}
+	}
+}
+
+// loadBans restores the bans saved in the database that have not ended,
+// and deletes those that ended while the tracker was down.
+func (h *hook) loadBans() error {
+	ips, err := h.MiddleWareDatabase.ListAllKeys([]byte("bans"))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, ip := range ips {
+		ban := new(banRecord)
+		if _, err := h.MiddleWareDatabase.Get([]byte("bans"), ip, ban); err != nil {
+			return err
+		}
+		if ban.Until.After(now) {
+			h.throttle.Ban(string(ip), ban.Until)
+		} else if err := h.MiddleWareDatabase.Delete([]byte("bans"), ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// banRecord is the database value of a persisted ban.
+type banRecord struct {
+	Until time.Time
+}
+
+func (b *banRecord) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(b.Until.Unix()))
+	return data, nil
+}
+
+func (b *banRecord) UnmarshalBinary(data []byte) error {
+	_, err := b.UnmarshalBinaryData(data)
+	return err
+}
+
+func (b *banRecord) UnmarshalBinaryData(data []byte) ([]byte, error) {
+	if len(data) < 8 {
+		return nil, errors.New("ban record must be 8 bytes")
+	}
+	b.Until = time.Unix(int64(binary.BigEndian.Uint64(data[:8])), 0)
+	return data[8:], nil
+}
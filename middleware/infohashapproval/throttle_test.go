@@ -0,0 +1,134 @@
+package infohashapproval
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+func TestNegativeCache(t *testing.T) {
+	c := newNegativeCache(2)
+	a, b, d := negativeKey{infohash: [20]byte{1}}, negativeKey{infohash: [20]byte{2}}, negativeKey{infohash: [20]byte{3}}
+
+	c.Add(a)
+	c.Add(b)
+	c.Contains(a) // b is now the least recently used
+	c.Add(d)
+
+	if !c.Contains(a) || !c.Contains(d) {
+		t.Error("evicted a recently used key")
+	}
+	if c.Contains(b) {
+		t.Error("kept the least recently used key of a full cache")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle(Config{InvalidSignatureLimit: 2, InvalidSignatureWindow: time.Hour, BanDuration: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		if _, banned := th.Fail("10.0.0.1"); banned {
+			t.Fatalf("banned after %d failures, limit is 2", i+1)
+		}
+	}
+	until, banned := th.Fail("10.0.0.1")
+	if !banned || time.Until(until) < 59*time.Minute {
+		t.Fatalf("not banned for an hour past the limit: %t until %s", banned, until)
+	}
+	if !th.Banned("10.0.0.1") || th.Banned("10.0.0.2") {
+		t.Error("ban applied to the wrong IPs")
+	}
+
+	th.Ban("10.0.0.3", time.Now().Add(-time.Second))
+	if th.Banned("10.0.0.3") {
+		t.Error("an ended ban still applies")
+	}
+	if unbanned := th.Expire(); len(unbanned) != 1 || unbanned[0] != "10.0.0.3" {
+		t.Errorf("Expire lifted %v, want only 10.0.0.3", unbanned)
+	}
+
+	if _, banned := newThrottle(Config{}).Fail("10.0.0.1"); banned {
+		t.Error("banned with banning disabled")
+	}
+}
+
+func TestPersistedBans(t *testing.T) {
+	db, _ := NewMapDB()
+	put := func(ip string, until time.Time) {
+		if err := db.Put([]byte("bans"), []byte(ip), &banRecord{Until: until}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := func(ip string) bool {
+		found, err := db.Get([]byte("bans"), []byte(ip), new(banRecord))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found != nil
+	}
+
+	put("10.0.0.1", time.Now().Add(time.Hour))
+	put("10.0.0.2", time.Now().Add(-time.Hour))
+	// Bans are saved to the second, so this one is still on when loaded
+	put("10.0.0.3", time.Now().Add(1500*time.Millisecond))
+
+	h := &hook{
+		MiddleWareDatabase: db,
+		persistBans:        true,
+		closing:            make(chan struct{}),
+		throttle:           newThrottle(Config{InvalidSignatureWindow: 10 * time.Millisecond}),
+	}
+	if err := h.loadBans(); err != nil {
+		t.Fatal(err)
+	}
+	if !h.throttle.Banned("10.0.0.1") || !h.throttle.Banned("10.0.0.3") || h.throttle.Banned("10.0.0.2") {
+		t.Error("restored the wrong bans")
+	}
+	if saved("10.0.0.2") {
+		t.Error("kept a ban that ended while the tracker was down")
+	}
+
+	go h.expireBans()
+	defer close(h.closing)
+	deadline := time.Now().Add(5 * time.Second)
+	for saved("10.0.0.3") {
+		if time.Now().After(deadline) {
+			t.Fatal("ended ban not deleted from the database")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !saved("10.0.0.1") || h.throttle.Banned("10.0.0.3") {
+		t.Error("expired the wrong bans")
+	}
+}
+
+func TestCheckPermanent(t *testing.T) {
+	newKey := func(notBefore time.Time) (signer, *[ed.PrivateKeySize]byte) {
+		pub, priv, err := ed.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer{key: *pub, notBefore: notBefore}, priv
+	}
+	current, currentKey := newKey(time.Time{})
+	future, futureKey := newKey(time.Now().Add(time.Hour))
+	_, unknownKey := newKey(time.Time{})
+	h := &hook{signers: []signer{current, future}}
+
+	ih := testInfohash(1)
+	for _, tt := range []struct {
+		name string
+		key  *[ed.PrivateKeySize]byte
+		want verifyResult
+	}{
+		{"current signer", currentKey, verifyResult{signer: current.String()}},
+		{"signer not valid yet", futureKey, verifyResult{}},
+		{"unknown key", unknownKey, verifyResult{permanent: true}},
+	} {
+		if got := h.check(ih[:], ed.Sign(tt.key, ih[:])); got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
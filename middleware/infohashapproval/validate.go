@@ -0,0 +1,147 @@
+package infohashapproval
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Validate checks the whole config without opening anything, returning
+// every problem found rather than only the first.
+func (cfg Config) Validate() []error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch cfg.Database {
+	case "", "Map", "Bolt", "LDB":
+	case "Redis":
+		if cfg.RedisAddr == "" {
+			add("database Redis requires redis_addr")
+		}
+	case "SQL":
+		if cfg.SQLDriver != "sqlite3" && cfg.SQLDriver != "postgres" {
+			add("database SQL requires sql_driver sqlite3 or postgres, not %q", cfg.SQLDriver)
+		}
+		if cfg.SQLDSN == "" {
+			add("database SQL requires sql_dsn")
+		}
+	default:
+		add("unknown database %q, must be Map, Bolt, LDB, Redis or SQL", cfg.Database)
+	}
+
+	if _, err := newInfohashSet(cfg.WhitelistStorage); err != nil {
+		add("whitelist_storage must be map or sorted, not %q", cfg.WhitelistStorage)
+	}
+
+	whitelist := cfg.Whitelist
+	if cfg.WhitelistFile != "" {
+		fromFile, err := readWhitelistFile(cfg.WhitelistFile)
+		if err != nil {
+			add("whitelist_file: %s", err.Error())
+		}
+		whitelist = append(append([]string(nil), whitelist...), fromFile...)
+	}
+	for _, ihString := range whitelist {
+		if err := validInfohash(ihString); err != nil {
+			add("whitelist: %s", err.Error())
+		}
+	}
+	for _, ihString := range cfg.Blacklist {
+		if err := validInfohash(ihString); err != nil {
+			add("blacklist: %s", err.Error())
+		}
+	}
+
+	signers := cfg.Signers
+	if cfg.SignersFile != "" {
+		fromFile, err := readSignersFile(cfg.SignersFile)
+		if err != nil {
+			add("signers_file: %s", err.Error())
+		}
+		signers = append(append([]SignerConfig(nil), signers...), fromFile...)
+	}
+	for _, signerCfg := range signers {
+		if _, err := newSigner(signerCfg); err != nil {
+			add("signers: %s", err.Error())
+		}
+	}
+
+	if cfg.VerifyWorkers < 0 || cfg.VerifyQueueSize < 0 || cfg.NegativeCacheSize < 0 || cfg.InvalidSignatureLimit < 0 {
+		add("verify_workers, verify_queue_size, negative_cache_size and invalid_signature_limit must not be negative")
+	}
+	if cfg.SignerExpiryWarning < 0 || cfg.InvalidSignatureWindow < 0 || cfg.BanDuration < 0 {
+		add("signer_expiry_warning, invalid_signature_window and ban_duration must not be negative")
+	}
+	if cfg.PersistBans && (cfg.Database == "" || cfg.Database == "Map") {
+		add("persist_bans requires a database")
+	}
+	if cfg.ApprovalTTL < 0 {
+		add("approval_ttl must not be negative")
+	}
+	if cfg.ApprovalTTL > 0 && (cfg.Database == "" || cfg.Database == "Map") {
+		add("approval_ttl requires a database")
+	}
+
+	if cfg.Pending.Enabled && (cfg.Database == "" || cfg.Database == "Map") {
+		add("pending requires a database")
+	}
+	if cfg.Pending.MaxInfohashes < 0 || cfg.Pending.MaxIPs < 0 || cfg.Pending.FlushInterval < 0 || cfg.Pending.MaxAge < 0 {
+		add("pending max_infohashes, max_ips, flush_interval and max_age must not be negative")
+	}
+	if cfg.Pending.MaxIPs > 255 {
+		add("pending max_ips must be at most 255")
+	}
+
+	if cfg.Replication.Addr != "" {
+		if _, err := newReplicator(cfg.Replication); err != nil {
+			add("replication: %s", err.Error())
+		}
+	} else if len(cfg.Replication.Peers) > 0 {
+		add("replication has peers but no addr")
+	}
+
+	if len(cfg.Webhooks) > 0 {
+		if _, err := newWebhooks(cfg.Webhooks); err != nil {
+			add("webhooks: %s", err.Error())
+		}
+	}
+
+	if err := cfg.Downloads.validate(); err != nil {
+		add("downloads: %s", err.Error())
+	}
+
+	if err := cfg.Status.validate(); err != nil {
+		add("status: %s", err.Error())
+	}
+	if cfg.Status.MaxInfohashes < 0 || cfg.Status.FeedSize < 0 || cfg.Status.CacheTTL < 0 {
+		add("status max_infohashes, feed_size and cache_ttl must not be negative")
+	}
+
+	if cfg.Admin.Addr != "" && (cfg.Admin.Username == "" || cfg.Admin.Password == "") {
+		add("admin requires a username and password")
+	}
+
+	return errs
+}
+
+// Addrs returns the TCP addresses the hook listens on, by config key.
+func (cfg Config) Addrs() map[string]string {
+	addrs := make(map[string]string)
+	if cfg.Replication.Addr != "" {
+		addrs["replication.addr"] = cfg.Replication.Addr
+	}
+	if cfg.Admin.Addr != "" {
+		addrs["admin.addr"] = cfg.Admin.Addr
+	}
+	return addrs
+}
+
+func validInfohash(ihString string) error {
+	ihBytes, err := hex.DecodeString(ihString)
+	if err != nil || len(ihBytes) != 20 {
+		return errors.New("Infohash " + ihString + " must be 20 bytes")
+	}
+	return nil
+}
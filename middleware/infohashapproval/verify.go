@@ -0,0 +1,146 @@
+package infohashapproval
+
+import (
+	"context"
+	"runtime"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+const defaultVerifyQueueSize = 256
+
+// ErrVerifierOverloaded is returned when too many signatures are waiting to
+// be verified, and the announce is shed rather than queued.
+var ErrVerifierOverloaded = bittorrent.ClientError("signature verification overloaded, try again later")
+
+// ErrVerifierStopped is returned for signatures still waiting when the hook
+// stops, such as during a reload.
+var ErrVerifierStopped = bittorrent.ClientError("signature verification stopped, try again later")
+
+// verifyJob is a signature waiting on a verification worker, which sends
+// the outcome on result.
+type verifyJob struct {
+	infohash [20]byte
+	sig      [ed.SignatureSize]byte
+	result   chan verifyResult
+}
+
+// verifyResult is the key of the signer that validated a signature, empty
+// if none did. An invalid signature is permanent unless it was made by a
+// signer whose not_before hasn't come yet, and only then can it be cached.
+type verifyResult struct {
+	signer    string
+	permanent bool
+}
+
+// verifyWorker checks signatures from the verify queue against every signer
+// that is valid at the time of the check. Once the hook stops, the jobs left
+// in the queue are dropped; their announces fail with ErrVerifierStopped.
+func (h *hook) verifyWorker() {
+	for {
+		select {
+		case job := <-h.verifyQueue:
+			chihayaVerifyQueueDepth.Set(float64(len(h.verifyQueue)))
+			job.result <- h.check(job.infohash[:], &job.sig)
+		case <-h.closing:
+			for {
+				select {
+				case <-h.verifyQueue:
+				default:
+					chihayaVerifyQueueDepth.Set(0)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (h *hook) verify(infohash []byte, sig *[ed.SignatureSize]byte) string {
+	now := time.Now()
+	for _, s := range h.signers {
+		// Only keys inside their validity period may approve
+		if !s.validAt(now) {
+			continue
+		}
+
+		if s.verify(infohash, sig) {
+			return s.String()
+		}
+	}
+	return ""
+}
+
+// check verifies a signature like verify. Only a rejected signature is
+// checked against the signers that are not valid yet, so signers added
+// ahead of time don't stop rejections from being cached.
+func (h *hook) check(infohash []byte, sig *[ed.SignatureSize]byte) verifyResult {
+	if signer := h.verify(infohash, sig); signer != "" {
+		return verifyResult{signer: signer}
+	}
+
+	now := time.Now()
+	for _, s := range h.signers {
+		if !s.notBefore.IsZero() && now.Before(s.notBefore) && s.verify(infohash, sig) {
+			return verifyResult{}
+		}
+	}
+	return verifyResult{permanent: true}
+}
+
+// verifySignature queues a signature for verification and waits for the
+// result. If the
+// queue is full the request is shed immediately, and if the hook stops
+// before the signature is verified, ErrVerifierStopped is returned.
+func (h *hook) verifySignature(ctx context.Context, infohash [20]byte, sig [ed.SignatureSize]byte) (verifyResult, error) {
+	job := verifyJob{
+		infohash: infohash,
+		sig:      sig,
+		result:   make(chan verifyResult, 1),
+	}
+
+	// Checked first, as a select with room in the queue may not see it
+	select {
+	case <-h.closing:
+		return verifyResult{}, ErrVerifierStopped
+	default:
+	}
+
+	select {
+	case h.verifyQueue <- job:
+		chihayaVerifyQueueDepth.Set(float64(len(h.verifyQueue)))
+	default:
+		chihayaVerifyShedCount.Inc()
+		return verifyResult{}, ErrVerifierOverloaded
+	}
+
+	select {
+	case result := <-job.result:
+		return result, nil
+	case <-h.closing:
+		// The worker may have answered just before stopping
+		select {
+		case result := <-job.result:
+			return result, nil
+		default:
+			return verifyResult{}, ErrVerifierStopped
+		}
+	case <-ctx.Done():
+		return verifyResult{}, ctx.Err()
+	}
+}
+
+func verifyWorkers(cfg Config) int {
+	if cfg.VerifyWorkers > 0 {
+		return cfg.VerifyWorkers
+	}
+	return runtime.NumCPU()
+}
+
+func verifyQueueSize(cfg Config) int {
+	if cfg.VerifyQueueSize > 0 {
+		return cfg.VerifyQueueSize
+	}
+	return defaultVerifyQueueSize
+}
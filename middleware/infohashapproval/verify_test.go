@@ -0,0 +1,47 @@
+package infohashapproval
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ed "github.com/FactomProject/ed25519"
+)
+
+func TestVerifySignatureStopped(t *testing.T) {
+	h := &hook{
+		closing:     make(chan struct{}),
+		verifyQueue: make(chan verifyJob, 4),
+	}
+
+	// No worker picks the job up, as when every worker is busy
+	errs := make(chan error)
+	go func() {
+		_, err := h.verifySignature(context.Background(), [20]byte{1}, [ed.SignatureSize]byte{})
+		errs <- err
+	}()
+	for len(h.verifyQueue) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(h.closing)
+	select {
+	case err := <-errs:
+		if err != ErrVerifierStopped {
+			t.Errorf("got %v, want ErrVerifierStopped", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("verifySignature still waiting after the hook stopped")
+	}
+
+	// A stopping worker drops what is left in the queue
+	h.verifyQueue <- verifyJob{result: make(chan verifyResult, 1)}
+	h.verifyWorker()
+	if len(h.verifyQueue) != 0 {
+		t.Errorf("%d jobs left in the queue", len(h.verifyQueue))
+	}
+
+	if _, err := h.verifySignature(context.Background(), [20]byte{1}, [ed.SignatureSize]byte{}); err != ErrVerifierStopped {
+		t.Errorf("verifying after stop got %v, want ErrVerifierStopped", err)
+	}
+}
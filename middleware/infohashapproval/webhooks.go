@@ -0,0 +1,559 @@
+package infohashapproval
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+const (
+	// webhookSignatureHeader carries "sha256=" and the hex HMAC-SHA256 of
+	// the body, keyed with the webhook's secret.
+	webhookSignatureHeader = "X-Chihaya-Webhook-Signature"
+	webhookEventHeader     = "X-Chihaya-Webhook-Event"
+
+	webhookTimeout     = 10 * time.Second
+	webhookQueueSize   = 1024
+	webhookMaxOutbox   = 10000
+	webhookMaxInvalid  = 1000
+	webhookMaxAttempts = 15
+	webhookMaxBackoff  = time.Hour
+	webhookPoll        = time.Second
+
+	// An IP is reported for invalid signatures at most once per
+	// webhookInvalidInterval, and at most webhookMaxSources IPs are
+	// remembered.
+	webhookInvalidInterval = time.Minute
+	webhookMaxSources      = 10000
+)
+
+// webhookLease is how long a hook has to attempt a delivery it claimed
+// before another may.
+var webhookLease = time.Minute
+
+// Webhook events.
+const (
+	WebhookApprove          = "approve"
+	WebhookRevoke           = "revoke"
+	WebhookInvalidSignature = "invalid_signature"
+)
+
+// WebhookConfig is an HTTP endpoint notified of approval events.
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+
+	// Secret is the key of the HMAC-SHA256 signature of every body, sent
+	// in the X-Chihaya-Webhook-Signature header.
+	Secret string `yaml:"secret"`
+
+	// Events are the events sent to the webhook: approve, revoke and
+	// invalid_signature. All of them when empty.
+	Events []string `yaml:"events"`
+}
+
+// WebhookEvent is the JSON body POSTed to webhooks. Deliveries are retried
+// until they succeed, so a receiver may see an event more than once and
+// should deduplicate them by ID.
+type WebhookEvent struct {
+	ID       string    `json:"id"`
+	Event    string    `json:"event"`
+	InfoHash string    `json:"infohash"`
+	Signer   string    `json:"signer,omitempty"` // Hex key, for signed approvals
+	IP       string    `json:"ip,omitempty"`     // Source of an invalid signature
+	Time     time.Time `json:"time"`
+}
+
+// webhookDelivery is an event waiting to be delivered to a webhook. It is
+// kept in the outbox bucket until it is delivered or given up on, so
+// deliveries survive restarts. invalid_signature deliveries are only kept
+// in memory, see persisted.
+type webhookDelivery struct {
+	URL         string          `json:"url"`
+	Body        json.RawMessage `json:"body"`
+	Event       string          `json:"event"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+}
+
+type webhooks struct {
+	hooks  []WebhookConfig
+	client *http.Client
+	events chan WebhookEvent
+	done   chan struct{}
+
+	// The outbox, by database key, in memory as well, and the number of
+	// invalid_signature deliveries in it.
+	outbox  map[string]*webhookDelivery
+	invalid int
+
+	// When each IP was last reported for an invalid signature
+	reported map[string]time.Time
+	sync.Mutex
+}
+
+func newWebhooks(cfgs []WebhookConfig) (*webhooks, error) {
+	for _, cfg := range cfgs {
+		u, err := url.Parse(cfg.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("webhook url " + cfg.URL + " must be an http or https URL")
+		}
+		if cfg.Secret == "" {
+			return nil, errors.New("webhook " + cfg.URL + " requires a secret")
+		}
+		for _, event := range cfg.Events {
+			if event != WebhookApprove && event != WebhookRevoke && event != WebhookInvalidSignature {
+				return nil, errors.New("webhook " + cfg.URL + " has unknown event " + event + ", must be approve, revoke or invalid_signature")
+			}
+		}
+	}
+
+	return &webhooks{
+		hooks:    cfgs,
+		client:   &http.Client{Timeout: webhookTimeout},
+		events:   make(chan WebhookEvent, webhookQueueSize),
+		done:     make(chan struct{}),
+		outbox:   make(map[string]*webhookDelivery),
+		reported: make(map[string]time.Time),
+	}, nil
+}
+
+// wants returns true if the webhook receives event.
+func (cfg WebhookConfig) wants(event string) bool {
+	return len(cfg.Events) == 0 || containsString(cfg.Events, event)
+}
+
+// notify queues an event for the webhooks without blocking the announce or
+// approval that caused it.
+func (h *hook) notify(event string, ih bittorrent.InfoHash, signer, ip string) {
+	if h.webhooks == nil {
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	e := WebhookEvent{
+		ID:       hex.EncodeToString(id),
+		Event:    event,
+		InfoHash: hex.EncodeToString(ih[:]),
+		Signer:   signer,
+		IP:       ip,
+		Time:     time.Now().UTC(),
+	}
+
+	select {
+	case h.webhooks.events <- e:
+	default:
+		chihayaWebhookDroppedCount.Inc()
+		log.Printf("Webhook queue full, dropped %s of %x\n", event, ih)
+	}
+}
+
+// reportInvalid returns true if an invalid signature from ip should be
+// sent to the webhooks: at most once per webhookInvalidInterval for each
+// IP, so a client sending bad signatures can't flood them.
+func (w *webhooks) reportInvalid(ip string, now time.Time) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	if last, ok := w.reported[ip]; ok && now.Sub(last) < webhookInvalidInterval {
+		return false
+	}
+	if len(w.reported) >= webhookMaxSources {
+		for source, last := range w.reported {
+			if now.Sub(last) >= webhookInvalidInterval {
+				delete(w.reported, source)
+			}
+		}
+		if len(w.reported) >= webhookMaxSources {
+			chihayaWebhookDroppedCount.Inc()
+			return false
+		}
+	}
+	w.reported[ip] = now
+	return true
+}
+
+// loadOutbox reads the deliveries left in the database by a previous run,
+// or by another tracker sharing it.
+func (h *hook) loadOutbox() error {
+	keys, err := h.MiddleWareDatabase.ListAllKeys([]byte("outbox"))
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		d := new(webhookDelivery)
+		if _, err := h.MiddleWareDatabase.Get([]byte("outbox"), key, d); err != nil {
+			return err
+		}
+		h.webhooks.outbox[string(key)] = d
+	}
+	chihayaWebhookOutboxCount.Set(float64(len(h.webhooks.outbox)))
+	return nil
+}
+
+// deliverWebhooks adds queued events to the outbox until the hook stops,
+// while deliverOutbox delivers them, so a slow webhook doesn't fill the
+// queue. Events still queued then are saved to be delivered on the next
+// start.
+func (h *hook) deliverWebhooks() {
+	defer close(h.webhooks.done)
+	if h.MiddleWareDatabase != nil {
+		if err := h.loadOutbox(); err != nil {
+			log.Println("Could not read webhook outbox from database, see chihaya db check: " + err.Error())
+		}
+	}
+
+	delivererDone := make(chan struct{})
+	go h.deliverOutbox(delivererDone)
+	defer func() { <-delivererDone }()
+
+	for {
+		select {
+		case e := <-h.webhooks.events:
+			h.addToOutbox(e)
+		case <-h.closing:
+			for {
+				select {
+				case e := <-h.webhooks.events:
+					h.addToOutbox(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// addToOutbox creates a delivery of e for every webhook that wants it.
+// invalid_signature deliveries have their own bound, so invalid signatures
+// can't crowd out approvals and revocations.
+func (h *hook) addToOutbox(e WebhookEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	w := h.webhooks
+	for _, cfg := range w.hooks {
+		if !cfg.wants(e.Event) {
+			continue
+		}
+
+		d := &webhookDelivery{URL: cfg.URL, Body: body, Event: e.Event, NextAttempt: time.Now()}
+		w.Lock()
+		full := len(w.outbox)-w.invalid >= webhookMaxOutbox
+		if !d.persisted() {
+			full = w.invalid >= webhookMaxInvalid
+		}
+		w.Unlock()
+		if full {
+			chihayaWebhookDroppedCount.Inc()
+			log.Printf("Webhook outbox full, dropped %s of %s for %s\n", e.Event, e.InfoHash, cfg.URL)
+			continue
+		}
+
+		key := outboxKey()
+		if h.MiddleWareDatabase != nil && d.persisted() {
+			if err := h.MiddleWareDatabase.Put([]byte("outbox"), key, d); err != nil {
+				log.Printf("Failed to write webhook delivery to database: %s\n", err.Error())
+			}
+		}
+
+		w.Lock()
+		w.outbox[string(key)] = d
+		if !d.persisted() {
+			w.invalid++
+		}
+		chihayaWebhookOutboxCount.Set(float64(len(w.outbox)))
+		w.Unlock()
+	}
+}
+
+// persisted returns false for invalid_signature deliveries. Anyone can
+// send invalid signatures, so they are kept out of the database, and lost
+// on restart.
+func (d *webhookDelivery) persisted() bool {
+	return d.Event != WebhookInvalidSignature
+}
+
+// outboxKey orders deliveries by creation: the time in nanoseconds, then
+// random bytes so keys don't collide.
+func outboxKey() []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(time.Now().UnixNano()))
+	rand.Read(key[8:])
+	return key
+}
+
+// deliverOutbox delivers the deliveries that are due until the hook stops,
+// then closes done.
+func (h *hook) deliverOutbox(done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(webhookPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.deliverDue()
+		case <-h.closing:
+			return
+		}
+	}
+}
+
+// deliverDue attempts the deliveries whose next attempt is due, oldest
+// first. A failed delivery is retried with exponential backoff, and
+// dropped after webhookMaxAttempts. Once a delivery to a webhook fails, its
+// other deliveries wait for the next round, so a webhook that is down
+// doesn't hold up the others. Deliveries to webhooks no longer in the
+// config are dropped.
+//
+// Only deliverOutbox changes deliveries once they are in the outbox, so
+// they are read without the lock.
+func (h *hook) deliverDue() {
+	w := h.webhooks
+	now := time.Now()
+
+	var due []string
+	w.Lock()
+	for key, d := range w.outbox {
+		if !d.NextAttempt.After(now) {
+			due = append(due, key)
+		}
+	}
+	w.Unlock()
+	sort.Strings(due)
+
+	failed := make(map[string]bool)
+	for _, key := range due {
+		select {
+		case <-h.closing:
+			return
+		default:
+		}
+
+		w.Lock()
+		d := w.outbox[key]
+		w.Unlock()
+		if failed[d.URL] {
+			continue
+		}
+
+		cfg, ok := w.webhook(d.URL)
+		if !ok {
+			h.finishDelivery(key, d, false)
+			continue
+		}
+
+		claimed, gone := h.claimDelivery(key, d)
+		if gone {
+			h.removeDelivery(key, d)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		err := w.post(cfg, d)
+		if err == nil {
+			chihayaWebhookDeliveredCount.Inc()
+			h.finishDelivery(key, d, true)
+			continue
+		}
+
+		chihayaWebhookFailCount.Inc()
+		failed[d.URL] = true
+		d.Attempts++
+		if d.Attempts >= webhookMaxAttempts {
+			log.Printf("Giving up on %s webhook to %s after %d attempts: %s\n", d.Event, d.URL, d.Attempts, err.Error())
+			h.finishDelivery(key, d, true)
+			continue
+		}
+
+		backoff := time.Second << uint(d.Attempts-1)
+		if backoff > webhookMaxBackoff || backoff <= 0 {
+			backoff = webhookMaxBackoff
+		}
+		d.NextAttempt = time.Now().Add(backoff)
+		if h.MiddleWareDatabase != nil && d.persisted() {
+			if err := h.MiddleWareDatabase.Put([]byte("outbox"), []byte(key), d); err != nil {
+				log.Printf("Failed to write webhook delivery to database: %s\n", err.Error())
+			}
+			h.releaseDelivery(key)
+		}
+	}
+}
+
+// localLeases are the leases taken on databases that aren't leasers, which
+// only one process opens, by bucket and key.
+var localLeases = struct {
+	sync.Mutex
+	until map[string]time.Time
+}{until: make(map[string]time.Time)}
+
+func lease(db Database, bucket, key []byte, until time.Time) (bool, error) {
+	if l, ok := db.(leaser); ok {
+		return l.Lease(bucket, key, until)
+	}
+
+	localLeases.Lock()
+	defer localLeases.Unlock()
+	k := string(bucket) + ":" + string(key)
+	if localLeases.until[k].After(time.Now()) {
+		return false, nil
+	}
+	localLeases.until[k] = until
+	return true, nil
+}
+
+func release(db Database, bucket, key []byte) error {
+	if l, ok := db.(leaser); ok {
+		return l.Release(bucket, key)
+	}
+
+	localLeases.Lock()
+	defer localLeases.Unlock()
+	delete(localLeases.until, string(bucket)+":"+string(key))
+	return nil
+}
+
+// claimDelivery leases a delivery before it is attempted, so that only one
+// of the hooks sharing the database makes it: the old and new hook of a
+// reload, or trackers sharing Redis or SQL. The delivery stays in the
+// database until it is delivered or given up on, and the lease ends on its
+// own, so a delivery claimed by a tracker that died is attempted again. It
+// returns false if another hook holds the lease or attempted the delivery
+// since it was due, and gone if another hook already finished with it.
+// Attempts made by other hooks are read back into d.
+func (h *hook) claimDelivery(key string, d *webhookDelivery) (claimed, gone bool) {
+	if h.MiddleWareDatabase == nil || !d.persisted() {
+		return true, false
+	}
+
+	claimed, err := lease(h.MiddleWareDatabase, []byte("outbox"), []byte(key), time.Now().Add(webhookLease))
+	if err != nil {
+		log.Printf("Failed to claim webhook delivery in database: %s\n", err.Error())
+		return false, false
+	}
+	if !claimed {
+		return false, false
+	}
+
+	saved := new(webhookDelivery)
+	found, err := h.MiddleWareDatabase.Get([]byte("outbox"), []byte(key), saved)
+	if err != nil || found == nil {
+		h.releaseDelivery(key)
+		if err != nil {
+			log.Printf("Failed to claim webhook delivery in database: %s\n", err.Error())
+			return false, false
+		}
+		return false, true
+	}
+	*d = *saved
+	if d.NextAttempt.After(time.Now()) {
+		// Another hook attempted it since it was due
+		h.releaseDelivery(key)
+		return false, false
+	}
+	return true, false
+}
+
+// releaseDelivery ends the lease on a delivery.
+func (h *hook) releaseDelivery(key string) {
+	if err := release(h.MiddleWareDatabase, []byte("outbox"), []byte(key)); err != nil {
+		log.Printf("Failed to release webhook delivery in database: %s\n", err.Error())
+	}
+}
+
+// finishDelivery drops a delivery that was made, given up on, or is to a
+// webhook no longer in the config, from the database and then the outbox.
+func (h *hook) finishDelivery(key string, d *webhookDelivery, claimed bool) {
+	if h.MiddleWareDatabase != nil && d.persisted() {
+		if err := h.MiddleWareDatabase.Delete([]byte("outbox"), []byte(key)); err != nil {
+			log.Printf("Failed to delete webhook delivery from database: %s\n", err.Error())
+		}
+		if claimed {
+			h.releaseDelivery(key)
+		}
+	}
+	h.removeDelivery(key, d)
+}
+
+// removeDelivery drops a delivery from the outbox in memory.
+func (h *hook) removeDelivery(key string, d *webhookDelivery) {
+	w := h.webhooks
+	w.Lock()
+	defer w.Unlock()
+	delete(w.outbox, key)
+	if !d.persisted() {
+		w.invalid--
+	}
+	chihayaWebhookOutboxCount.Set(float64(len(w.outbox)))
+}
+
+func (w *webhooks) webhook(url string) (WebhookConfig, bool) {
+	for _, cfg := range w.hooks {
+		if cfg.URL == url {
+			return cfg, true
+		}
+	}
+	return WebhookConfig{}, false
+}
+
+// post sends a delivery, succeeding on any 2xx response.
+func (w *webhooks) post(cfg WebhookConfig, d *webhookDelivery) error {
+	req, err := http.NewRequest("POST", cfg.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(cfg.Secret, d.Body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// webhookSignature returns the hex HMAC-SHA256 of body, which receivers
+// should compare with the X-Chihaya-Webhook-Signature header in constant
+// time.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *webhookDelivery) MarshalBinary() ([]byte, error) {
+	return json.Marshal(d)
+}
+
+func (d *webhookDelivery) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, d)
+}
+
+func (d *webhookDelivery) UnmarshalBinaryData(data []byte) ([]byte, error) {
+	return nil, json.Unmarshal(data, d)
+}
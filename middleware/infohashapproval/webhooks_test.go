@@ -0,0 +1,132 @@
+package infohashapproval
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the deliveries POSTed to it.
+type webhookReceiver struct {
+	*httptest.Server
+	bodies     [][]byte
+	signatures []string
+	sync.Mutex
+}
+
+func newWebhookReceiver() *webhookReceiver {
+	r := &webhookReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.Lock()
+		r.bodies = append(r.bodies, body)
+		r.signatures = append(r.signatures, req.Header.Get(webhookSignatureHeader))
+		r.Unlock()
+	}))
+	return r
+}
+
+func (r *webhookReceiver) received() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.bodies)
+}
+
+// newWebhookHook returns a hook sending every event to url, with db as its
+// database, without starting its delivery goroutines.
+func newWebhookHook(t *testing.T, db Database, url string) *hook {
+	w, err := newWebhooks([]WebhookConfig{{URL: url, Secret: "key"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &hook{MiddleWareDatabase: db, webhooks: w, closing: make(chan struct{})}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// HMAC-SHA256 test vector
+	got := webhookSignature("key", []byte("The quick brown fox jumps over the lazy dog"))
+	if want := "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"; got != want {
+		t.Errorf("signature is %s, want %s", got, want)
+	}
+
+	r := newWebhookReceiver()
+	defer r.Close()
+	db, _ := NewMapDB()
+	h := newWebhookHook(t, db, r.URL)
+
+	h.addToOutbox(WebhookEvent{ID: "1", Event: WebhookApprove, InfoHash: "01"})
+	h.deliverDue()
+	if r.received() != 1 {
+		t.Fatalf("webhook received %d deliveries, want 1", r.received())
+	}
+	if want := "sha256=" + webhookSignature("key", r.bodies[0]); r.signatures[0] != want {
+		t.Errorf("signature header is %q, want %q", r.signatures[0], want)
+	}
+}
+
+func TestWebhookLease(t *testing.T) {
+	defer func(lease time.Duration) { webhookLease = lease }(webhookLease)
+	webhookLease = 50 * time.Millisecond
+
+	r := newWebhookReceiver()
+	defer r.Close()
+	db, _ := NewMapDB()
+	a, b := newWebhookHook(t, db, r.URL), newWebhookHook(t, db, r.URL)
+
+	a.addToOutbox(WebhookEvent{ID: "1", Event: WebhookApprove, InfoHash: "01"})
+	if err := b.loadOutbox(); err != nil {
+		t.Fatal(err)
+	}
+	var key string
+	var d *webhookDelivery
+	for key, d = range a.webhooks.outbox {
+	}
+
+	// a claims the delivery and dies before attempting it
+	if claimed, _ := a.claimDelivery(key, d); !claimed {
+		t.Fatal("delivery wasn't claimed")
+	}
+	b.deliverDue()
+	if r.received() != 0 {
+		t.Error("leased delivery was made by another hook")
+	}
+	if keys, _ := db.ListAllKeys([]byte("outbox")); len(keys) != 1 {
+		t.Fatalf("claimed delivery was taken out of the database")
+	}
+
+	time.Sleep(webhookLease)
+	b.deliverDue()
+	if r.received() != 1 {
+		t.Fatalf("delivery wasn't made after its lease ended")
+	}
+	if keys, _ := db.ListAllKeys([]byte("outbox")); len(keys) != 0 {
+		t.Errorf("made delivery was left in the database")
+	}
+
+	// a finds it gone rather than making it again
+	a.deliverDue()
+	if r.received() != 1 || len(a.webhooks.outbox) != 0 {
+		t.Errorf("delivery was made %d times, %d left in the outbox", r.received(), len(a.webhooks.outbox))
+	}
+}
+
+func TestReportInvalid(t *testing.T) {
+	w, _ := newWebhooks(nil)
+	now := time.Now()
+
+	if !w.reportInvalid("10.0.0.1", now) {
+		t.Error("first invalid signature wasn't reported")
+	}
+	if w.reportInvalid("10.0.0.1", now.Add(webhookInvalidInterval/2)) {
+		t.Error("invalid signature was reported twice in an interval")
+	}
+	if !w.reportInvalid("10.0.0.2", now) {
+		t.Error("invalid signature from another IP wasn't reported")
+	}
+	if !w.reportInvalid("10.0.0.1", now.Add(webhookInvalidInterval)) {
+		t.Error("invalid signature wasn't reported after the interval")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/FactomProject/chihaya/middleware/infohashapproval"
+)
+
+// newPendingCmd returns the commands reviewing the pending queue of a
+// running tracker, through its admin server.
+func newPendingCmd() *cobra.Command {
+	pendingCmd := &cobra.Command{
+		Use:   "pending",
+		Short: "Review the unknown infohashes announced to the tracker",
+	}
+	pendingCmd.PersistentFlags().String("admin", "", "URL of the admin server, from admin.addr in the config by default")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the pending infohashes, oldest first",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := pendingListRun(cmd); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	approveCmd := &cobra.Command{
+		Use:   "approve <infohash>...",
+		Short: "Whitelist pending infohashes",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := pendingReviewRun(cmd, "approve", args); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	rejectCmd := &cobra.Command{
+		Use:   "reject <infohash>...",
+		Short: "Blacklist pending infohashes",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := pendingReviewRun(cmd, "reject", args); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	pendingCmd.AddCommand(listCmd, approveCmd, rejectCmd)
+	return pendingCmd
+}
+
+func pendingListRun(cmd *cobra.Command) error {
+	body, err := adminRequest(cmd, "GET", "/admin/pending", nil)
+	if err != nil {
+		return err
+	}
+
+	var pending []infohashapproval.PendingInfohash
+	if err := json.Unmarshal(body, &pending); err != nil {
+		return errors.New("invalid response from admin server: " + err.Error())
+	}
+
+	for _, p := range pending {
+		fmt.Printf("%x  first seen %s  last seen %s  %d announces  from %s\n",
+			p.InfoHash, p.FirstSeen.Format(time.RFC3339), p.LastSeen.Format(time.RFC3339), p.Count, strings.Join(p.IPs, ", "))
+	}
+	log.Infof("%d pending infohashes", len(pending))
+	return nil
+}
+
+func pendingReviewRun(cmd *cobra.Command, action string, infohashes []string) error {
+	if len(infohashes) == 0 {
+		return errors.New("no infohash given")
+	}
+
+	failed := 0
+	for _, ih := range infohashes {
+		_, err := adminRequest(cmd, "POST", "/admin/pending/"+action, url.Values{"infohash": {ih}})
+		if err != nil {
+			log.Errorf("failed to %s %s: %s", action, ih, err.Error())
+			failed++
+			continue
+		}
+		log.Infof("%sd %s", action, ih)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to %s %d of %d infohashes", action, failed, len(infohashes))
+	}
+	return nil
+}
+
+// adminRequest sends a request to the admin server of the infohash approval
+// hook in the config file, with its credentials, and returns the body of a
+// successful response.
+func adminRequest(cmd *cobra.Command, method, path string, query url.Values) ([]byte, error) {
+	iaCfg, err := approvalConfig(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	base, _ := cmd.Flags().GetString("admin")
+	if base == "" {
+		if iaCfg.Admin.Addr == "" {
+			return nil, errors.New("the infohash approval hook has no admin server, set admin.addr")
+		}
+		host, port, err := net.SplitHostPort(iaCfg.Admin.Addr)
+		if err != nil {
+			return nil, errors.New("invalid admin.addr: " + err.Error())
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "127.0.0.1"
+		}
+		base = "http://" + net.JoinHostPort(host, port)
+	}
+
+	u := strings.TrimSuffix(base, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(iaCfg.Admin.Username, iaCfg.Admin.Password)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, errors.New(resp.Status + ": " + strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
@@ -0,0 +1,428 @@
+// Package redis implements a storage.PeerStore backed by Redis, so several
+// tracker instances behind a load balancer share the same swarms.
+//
+// Every swarm is a pair of Redis sorted sets per address family, one for
+// seeders and one for leechers, holding encoded peers scored by the unix time
+// of their last announce. A set holds the names of all swarm sets for garbage
+// collection.
+package redis
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/stopper"
+	"github.com/chihaya/chihaya/storage"
+)
+
+const (
+	defaultPrefix     = "chihaya:"
+	defaultGCInterval = 3 * time.Minute
+)
+
+// Config holds the configuration of a Redis PeerStore.
+type Config struct {
+	Addr                      string
+	Password                  string
+	Prefix                    string
+	PeerLifetime              time.Duration
+	GarbageCollectionInterval time.Duration
+}
+
+type peerStore struct {
+	cfg     Config
+	pool    *redis.Pool
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// New returns a PeerStore storing peers in the Redis server at cfg.Addr.
+func New(cfg Config) (storage.PeerStore, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("redis storage requires a redis_addr")
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultPrefix
+	}
+	if cfg.GarbageCollectionInterval == 0 {
+		cfg.GarbageCollectionInterval = defaultGCInterval
+	}
+
+	s := &peerStore{
+		cfg:     cfg,
+		pool:    NewPool(cfg.Addr, cfg.Password),
+		closing: make(chan struct{}),
+	}
+
+	// Fail early if the server can't be reached
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		return nil, errors.New("failed to reach redis at " + cfg.Addr + ": " + err.Error())
+	}
+
+	s.wg.Add(1)
+	go s.runGC()
+
+	return s, nil
+}
+
+// NewPool returns a pool of connections to the Redis server at addr.
+func NewPool(addr, password string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 4 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			var opts []redis.DialOption
+			if password != "" {
+				opts = append(opts, redis.DialPassword(password))
+			}
+			return redis.Dial("tcp", addr, opts...)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+func family(ip net.IP) string {
+	if ip.To4() != nil {
+		return "4"
+	}
+	return "6"
+}
+
+func (s *peerStore) swarmKey(ih bittorrent.InfoHash, fam string, seeders bool) string {
+	kind := "leechers"
+	if seeders {
+		kind = "seeders"
+	}
+	return s.cfg.Prefix + "swarm:" + hex.EncodeToString(ih[:]) + ":" + fam + ":" + kind
+}
+
+func (s *peerStore) indexKey() string {
+	return s.cfg.Prefix + "swarms"
+}
+
+// encodePeer packs a peer as its ID, port and IP.
+func encodePeer(p bittorrent.Peer) string {
+	b := make([]byte, 22, 22+len(p.IP))
+	copy(b, p.ID[:])
+	binary.BigEndian.PutUint16(b[20:22], p.Port)
+	return string(append(b, p.IP...))
+}
+
+func decodePeer(field []byte) (bittorrent.Peer, error) {
+	if len(field) != 22+net.IPv4len && len(field) != 22+net.IPv6len {
+		return bittorrent.Peer{}, errors.New("malformed peer in redis")
+	}
+
+	var p bittorrent.Peer
+	copy(p.ID[:], field[:20])
+	p.Port = binary.BigEndian.Uint16(field[20:22])
+	p.IP = net.IP(append([]byte(nil), field[22:]...))
+	return p, nil
+}
+
+func (s *peerStore) put(ih bittorrent.InfoHash, p bittorrent.Peer, seeder bool) error {
+	key := s.swarmKey(ih, family(p.IP), seeder)
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("ZADD", key, time.Now().Unix(), encodePeer(p))
+	conn.Send("SADD", s.indexKey(), key)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (s *peerStore) delete(ih bittorrent.InfoHash, p bittorrent.Peer, seeder bool) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	deleted, err := redis.Int(conn.Do("ZREM", s.swarmKey(ih, family(p.IP), seeder), encodePeer(p)))
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return storage.ErrResourceDoesNotExist
+	}
+	return nil
+}
+
+func (s *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.put(ih, p, true)
+}
+
+func (s *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.delete(ih, p, true)
+}
+
+func (s *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.put(ih, p, false)
+}
+
+func (s *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.delete(ih, p, false)
+}
+
+func (s *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	fam := family(p.IP)
+	seeders := s.swarmKey(ih, fam, true)
+	field := encodePeer(p)
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("ZREM", s.swarmKey(ih, fam, false), field)
+	conn.Send("ZADD", seeders, time.Now().Unix(), field)
+	conn.Send("SADD", s.indexKey(), seeders)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// cutoff returns the score below which peers of a swarm set have expired.
+func (s *peerStore) cutoff(now time.Time) string {
+	return strconv.FormatInt(now.Add(-s.cfg.PeerLifetime).Unix(), 10)
+}
+
+// countExpired returns the number of peers in a swarm set that are past the
+// peer lifetime. They have the lowest scores, so they come first in the set.
+func (s *peerStore) countExpired(conn redis.Conn, key string, now time.Time) (int, error) {
+	if s.cfg.PeerLifetime == 0 {
+		return 0, nil
+	}
+	return redis.Int(conn.Do("ZCOUNT", key, "-inf", "("+s.cutoff(now)))
+}
+
+// samplePeers returns up to n peers of a swarm set that have not expired,
+// other than skip. They are read from a random rank, wrapping around past
+// the newest peer, so announcers don't all get the same peers and a large
+// swarm isn't read whole on every announce.
+func (s *peerStore) samplePeers(conn redis.Conn, key string, n int, skip string) ([]bittorrent.Peer, error) {
+	size, err := redis.Int(conn.Do("ZCARD", key))
+	if err != nil {
+		return nil, err
+	}
+	expired, err := s.countExpired(conn, key, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	live := size - expired
+	if live <= 0 || n <= 0 {
+		return nil, nil
+	}
+
+	// Read one more than wanted, in case the announcer is among them
+	want := n + 1
+	if want > live {
+		want = live
+	}
+	first := expired + rand.Intn(live)
+	last := first + want - 1
+
+	var fields [][]byte
+	if last < size {
+		fields, err = redis.ByteSlices(conn.Do("ZRANGE", key, first, last))
+	} else {
+		fields, err = redis.ByteSlices(conn.Do("ZRANGE", key, first, size-1))
+		if err == nil {
+			var wrapped [][]byte
+			wrapped, err = redis.ByteSlices(conn.Do("ZRANGE", key, expired, expired+last-size))
+			fields = append(fields, wrapped...)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []bittorrent.Peer
+	for _, field := range fields {
+		if len(peers) == n {
+			break
+		}
+		if string(field) == skip {
+			continue
+		}
+		p, err := decodePeer(field)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// countPeers returns the number of peers in a swarm set that have not
+// expired.
+func (s *peerStore) countPeers(conn redis.Conn, key string) (int, error) {
+	if s.cfg.PeerLifetime == 0 {
+		return redis.Int(conn.Do("ZCARD", key))
+	}
+	return redis.Int(conn.Do("ZCOUNT", key, s.cutoff(time.Now()), "+inf"))
+}
+
+// AnnouncePeers returns up to numWant peers of the announcer's address
+// family. Seeders only get leechers, leechers get seeders first.
+func (s *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) ([]bittorrent.Peer, error) {
+	fam := family(announcer.IP)
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	exists, err := redis.Bool(conn.Do("SISMEMBER", s.indexKey(), s.swarmKey(ih, fam, true)))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		exists, err = redis.Bool(conn.Do("SISMEMBER", s.indexKey(), s.swarmKey(ih, fam, false)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !exists {
+		return nil, storage.ErrResourceDoesNotExist
+	}
+
+	self := encodePeer(announcer)
+	var peers []bittorrent.Peer
+	if !seeder {
+		peers, err = s.samplePeers(conn, s.swarmKey(ih, fam, true), numWant, self)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(peers) < numWant {
+		leechers, err := s.samplePeers(conn, s.swarmKey(ih, fam, false), numWant-len(peers), self)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, leechers...)
+	}
+	return peers, nil
+}
+
+func (s *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, v6 bool) (resp bittorrent.Scrape) {
+	fam := "4"
+	if v6 {
+		fam = "6"
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	complete, err := s.countPeers(conn, s.swarmKey(ih, fam, true))
+	if err != nil {
+		log.Printf("Failed to scrape %x from redis: %s\n", ih, err.Error())
+		return
+	}
+	incomplete, err := s.countPeers(conn, s.swarmKey(ih, fam, false))
+	if err != nil {
+		log.Printf("Failed to scrape %x from redis: %s\n", ih, err.Error())
+		return
+	}
+
+	resp.Complete = uint32(complete)
+	resp.Incomplete = uint32(incomplete)
+	return
+}
+
+func (s *peerStore) runGC() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.cfg.GarbageCollectionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.collectGarbage(); err != nil {
+				log.Printf("Failed to garbage collect redis peers: %s\n", err.Error())
+			}
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// collectGarbage removes peers that have not announced within the peer
+// lifetime, and forgets swarms left empty. Redis compares the scores itself,
+// so a peer that announces again during collection is kept.
+func (s *peerStore) collectGarbage() error {
+	if s.cfg.PeerLifetime == 0 {
+		return nil
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	keys, err := redis.Strings(conn.Do("SMEMBERS", s.indexKey()))
+	if err != nil {
+		return err
+	}
+
+	cutoff := "(" + s.cutoff(time.Now())
+	for _, key := range keys {
+		if _, err := conn.Do("ZREMRANGEBYSCORE", key, "-inf", cutoff); err != nil {
+			return err
+		}
+		if err := s.forgetIfEmpty(conn, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetIfEmpty removes a swarm set from the index if it has no peers. The
+// set is watched, so a peer put between ZCARD and SREM aborts the removal
+// rather than leave its swarm out of the index.
+func (s *peerStore) forgetIfEmpty(conn redis.Conn, key string) error {
+	if _, err := conn.Do("WATCH", key); err != nil {
+		return err
+	}
+
+	n, err := redis.Int(conn.Do("ZCARD", key))
+	if err != nil || n > 0 {
+		conn.Do("UNWATCH")
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("SREM", s.indexKey(), key)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (s *peerStore) Stop() <-chan error {
+	select {
+	case <-s.closing:
+		return stopper.AlreadyStopped
+	default:
+	}
+
+	c := make(chan error)
+	go func() {
+		close(s.closing)
+		s.wg.Wait()
+		if err := s.pool.Close(); err != nil {
+			c <- err
+		}
+		close(c)
+	}()
+	return c
+}
@@ -0,0 +1,499 @@
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// fakeRedis implements the sorted set, set and transaction commands used by
+// the peer store, in memory.
+type fakeRedis struct {
+	zsets    map[string]map[string]int64
+	sets     map[string]map[string]bool
+	versions map[string]int // bumped on every write, for WATCH
+	calls    map[string]int
+
+	// beforeExec is called once by the next EXEC, to race a transaction
+	beforeExec func()
+	sync.Mutex
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		zsets:    make(map[string]map[string]int64),
+		sets:     make(map[string]map[string]bool),
+		versions: make(map[string]int),
+		calls:    make(map[string]int),
+	}
+}
+
+// fakeConn is a connection to a fakeRedis. Commands sent with Send run on
+// Flush, and their replies are read with Receive.
+type fakeConn struct {
+	r       *fakeRedis
+	sent    [][]interface{}
+	replies []interface{}
+	multi   [][]interface{}
+	inMulti bool
+	watched map[string]int
+}
+
+func (c *fakeConn) Close() error { return nil }
+func (c *fakeConn) Err() error   { return nil }
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error {
+	c.sent = append(c.sent, append([]interface{}{cmd}, args...))
+	return nil
+}
+
+func (c *fakeConn) Flush() error {
+	for _, cmd := range c.sent {
+		c.replies = append(c.replies, c.run(cmd[0].(string), cmd[1:]))
+	}
+	c.sent = nil
+	return nil
+}
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	if len(c.replies) == 0 {
+		return nil, errors.New("no reply")
+	}
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.Flush()
+	c.replies = nil
+	if cmd == "" {
+		return nil, nil
+	}
+	reply := c.run(cmd, args)
+	if err, ok := reply.(error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *fakeConn) run(cmd string, args []interface{}) interface{} {
+	cmd = strings.ToUpper(cmd)
+	switch cmd {
+	case "MULTI":
+		c.inMulti = true
+		return "OK"
+	case "DISCARD":
+		c.inMulti, c.multi, c.watched = false, nil, nil
+		return "OK"
+	case "EXEC":
+		return c.exec()
+	}
+	if c.inMulti {
+		c.multi = append(c.multi, append([]interface{}{cmd}, args...))
+		return "QUEUED"
+	}
+
+	c.r.Lock()
+	defer c.r.Unlock()
+	return c.r.command(c, cmd, args)
+}
+
+func (c *fakeConn) exec() interface{} {
+	queued := c.multi
+	c.inMulti, c.multi = false, nil
+
+	c.r.Lock()
+	if fn := c.r.beforeExec; fn != nil {
+		c.r.beforeExec = nil
+		c.r.Unlock()
+		fn()
+		c.r.Lock()
+	}
+	defer c.r.Unlock()
+
+	for key, version := range c.watched {
+		if c.r.versions[key] != version {
+			c.watched = nil
+			return nil
+		}
+	}
+	c.watched = nil
+
+	replies := make([]interface{}, len(queued))
+	for i, cmd := range queued {
+		replies[i] = c.r.command(c, cmd[0].(string), cmd[1:])
+	}
+	return replies
+}
+
+func str(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(v)
+}
+
+func (r *fakeRedis) command(c *fakeConn, cmd string, args []interface{}) interface{} {
+	r.calls[cmd]++
+	var key string
+	if len(args) > 0 {
+		key = str(args[0])
+	}
+
+	switch cmd {
+	case "PING":
+		return "PONG"
+	case "WATCH":
+		if c.watched == nil {
+			c.watched = make(map[string]int)
+		}
+		c.watched[key] = r.versions[key]
+		return "OK"
+	case "UNWATCH":
+		c.watched = nil
+		return "OK"
+	case "ZADD":
+		z := r.zsets[key]
+		if z == nil {
+			z = make(map[string]int64)
+			r.zsets[key] = z
+		}
+		score, _ := strconv.ParseInt(str(args[1]), 10, 64)
+		_, exists := z[str(args[2])]
+		z[str(args[2])] = score
+		r.versions[key]++
+		if exists {
+			return int64(0)
+		}
+		return int64(1)
+	case "ZREM":
+		n := int64(0)
+		for _, m := range args[1:] {
+			if _, ok := r.zsets[key][str(m)]; ok {
+				delete(r.zsets[key], str(m))
+				n++
+			}
+		}
+		r.forgetIfEmpty(key)
+		r.versions[key]++
+		return n
+	case "ZCARD":
+		return int64(len(r.zsets[key]))
+	case "ZCOUNT":
+		n := int64(0)
+		for _, score := range r.zsets[key] {
+			if inRange(score, str(args[1]), str(args[2])) {
+				n++
+			}
+		}
+		return n
+	case "ZRANGE":
+		start, _ := strconv.Atoi(str(args[1]))
+		stop, _ := strconv.Atoi(str(args[2]))
+		members := r.members(key)
+		if stop >= len(members) {
+			stop = len(members) - 1
+		}
+		var reply []interface{}
+		for i := start; i <= stop; i++ {
+			reply = append(reply, []byte(members[i]))
+		}
+		return reply
+	case "ZREMRANGEBYSCORE":
+		n := int64(0)
+		for m, score := range r.zsets[key] {
+			if inRange(score, str(args[1]), str(args[2])) {
+				delete(r.zsets[key], m)
+				n++
+			}
+		}
+		r.forgetIfEmpty(key)
+		r.versions[key]++
+		return n
+	case "SADD":
+		s := r.sets[key]
+		if s == nil {
+			s = make(map[string]bool)
+			r.sets[key] = s
+		}
+		n := int64(0)
+		for _, m := range args[1:] {
+			if !s[str(m)] {
+				s[str(m)] = true
+				n++
+			}
+		}
+		r.versions[key]++
+		return n
+	case "SREM":
+		n := int64(0)
+		for _, m := range args[1:] {
+			if r.sets[key][str(m)] {
+				delete(r.sets[key], str(m))
+				n++
+			}
+		}
+		r.versions[key]++
+		return n
+	case "SISMEMBER":
+		if r.sets[key][str(args[1])] {
+			return int64(1)
+		}
+		return int64(0)
+	case "SMEMBERS":
+		var reply []interface{}
+		for m := range r.sets[key] {
+			reply = append(reply, []byte(m))
+		}
+		return reply
+	}
+	return redis.Error("ERR unknown command " + cmd)
+}
+
+// members returns the members of a sorted set by score, then member.
+func (r *fakeRedis) members(key string) []string {
+	z := r.zsets[key]
+	var members []string
+	for m := range z {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if z[members[i]] != z[members[j]] {
+			return z[members[i]] < z[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+func (r *fakeRedis) forgetIfEmpty(key string) {
+	if len(r.zsets[key]) == 0 {
+		delete(r.zsets, key)
+	}
+}
+
+// inRange reports whether score is within the ZCOUNT style bounds min and
+// max, which may be infinite or exclusive.
+func inRange(score int64, min, max string) bool {
+	bound := func(b string) (float64, bool) {
+		exclusive := strings.HasPrefix(b, "(")
+		f, _ := strconv.ParseFloat(strings.TrimPrefix(b, "("), 64)
+		return f, exclusive
+	}
+	lo, loEx := bound(min)
+	hi, hiEx := bound(max)
+	s := float64(score)
+	return (s > lo || !loEx && s == lo) && (s < hi || !hiEx && s == hi)
+}
+
+func newTestStore(r *fakeRedis, lifetime time.Duration) *peerStore {
+	return &peerStore{
+		cfg: Config{Prefix: defaultPrefix, PeerLifetime: lifetime},
+		pool: &redis.Pool{Dial: func() (redis.Conn, error) {
+			return &fakeConn{r: r}, nil
+		}},
+		closing: make(chan struct{}),
+	}
+}
+
+func testPeer(i int) bittorrent.Peer {
+	p := bittorrent.Peer{IP: net.IPv4(10, 0, byte(i>>8), byte(i)).To4(), Port: 6881}
+	p.ID[0], p.ID[1] = byte(i>>8), byte(i)
+	return p
+}
+
+var testInfohash = bittorrent.InfoHash{1, 2, 3}
+
+func TestAnnouncePeers(t *testing.T) {
+	r := newFakeRedis()
+	s := newTestStore(r, 0)
+
+	for i := 0; i < 3; i++ {
+		if err := s.PutSeeder(testInfohash, testPeer(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 3; i < 1000; i++ {
+		if err := s.PutLeecher(testInfohash, testPeer(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Leechers get the seeders first, without the whole swarm being read
+	peers, err := s.AnnouncePeers(testInfohash, false, 5, testPeer(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 5 {
+		t.Fatalf("got %d peers, want 5", len(peers))
+	}
+	seeders := 0
+	for _, p := range peers {
+		if encodePeer(p) == encodePeer(testPeer(3)) {
+			t.Error("announcer got itself back")
+		}
+		if p.ID[1] < 3 && p.ID[0] == 0 {
+			seeders++
+		}
+	}
+	if seeders != 3 {
+		t.Errorf("got %d seeders, want 3", seeders)
+	}
+	if r.calls["ZRANGE"] > 4 {
+		t.Errorf("read the swarm with %d ZRANGE", r.calls["ZRANGE"])
+	}
+
+	// Seeders only get leechers
+	peers, err = s.AnnouncePeers(testInfohash, true, 50, testPeer(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 50 {
+		t.Fatalf("got %d peers, want 50", len(peers))
+	}
+	for _, p := range peers {
+		if p.ID[0] == 0 && p.ID[1] < 3 {
+			t.Errorf("seeder got seeder %x", p.ID[:2])
+		}
+	}
+
+	if _, err := s.AnnouncePeers(bittorrent.InfoHash{9}, false, 5, testPeer(3)); err == nil {
+		t.Error("announced to a swarm that doesn't exist")
+	}
+}
+
+func TestSamplePeers(t *testing.T) {
+	r := newFakeRedis()
+	s := newTestStore(r, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		putExpired(r, s, testPeer(i), false)
+	}
+	for i := 10; i < 110; i++ {
+		if err := s.PutLeecher(testInfohash, testPeer(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every announce gets a full window of live peers, starting from a
+	// random one
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		peers, err := s.AnnouncePeers(testInfohash, true, 5, testPeer(200))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(peers) != 5 {
+			t.Fatalf("got %d peers, want 5", len(peers))
+		}
+		for _, p := range peers {
+			if p.ID[0] == 0 && p.ID[1] < 10 {
+				t.Fatalf("got expired peer %x", p.ID[:2])
+			}
+			seen[encodePeer(p)] = true
+		}
+	}
+	if len(seen) < 50 {
+		t.Errorf("50 announces only got %d different peers", len(seen))
+	}
+}
+
+// putExpired adds a peer last seen an hour ago.
+func putExpired(r *fakeRedis, s *peerStore, p bittorrent.Peer, seeder bool) {
+	key := s.swarmKey(testInfohash, family(p.IP), seeder)
+	r.Lock()
+	defer r.Unlock()
+	r.command(nil, "ZADD", []interface{}{key, time.Now().Add(-time.Hour).Unix(), encodePeer(p)})
+	r.command(nil, "SADD", []interface{}{s.indexKey(), key})
+}
+
+func TestExpiredPeers(t *testing.T) {
+	r := newFakeRedis()
+	s := newTestStore(r, time.Minute)
+
+	putExpired(r, s, testPeer(0), true)
+	putExpired(r, s, testPeer(1), false)
+	s.PutSeeder(testInfohash, testPeer(2))
+	s.PutLeecher(testInfohash, testPeer(3))
+	s.PutLeecher(testInfohash, testPeer(4))
+
+	scrape := s.ScrapeSwarm(testInfohash, false)
+	if scrape.Complete != 1 || scrape.Incomplete != 2 {
+		t.Errorf("scraped %d seeders and %d leechers, want 1 and 2", scrape.Complete, scrape.Incomplete)
+	}
+
+	peers, err := s.AnnouncePeers(testInfohash, false, 50, testPeer(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Errorf("got %d peers, want the 2 that haven't expired", len(peers))
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	r := newFakeRedis()
+	s := newTestStore(r, time.Minute)
+	seeders := s.swarmKey(testInfohash, "4", true)
+	leechers := s.swarmKey(testInfohash, "4", false)
+
+	putExpired(r, s, testPeer(0), true)
+	putExpired(r, s, testPeer(1), false)
+	s.PutLeecher(testInfohash, testPeer(2))
+
+	if err := s.collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.zsets[seeders]) != 0 || len(r.zsets[leechers]) != 1 {
+		t.Errorf("left %d seeders and %d leechers, want 0 and 1", len(r.zsets[seeders]), len(r.zsets[leechers]))
+	}
+	if r.sets[s.indexKey()][seeders] || !r.sets[s.indexKey()][leechers] {
+		t.Errorf("index is %v", r.sets[s.indexKey()])
+	}
+
+	// A peer that announced again since it expired is kept
+	putExpired(r, s, testPeer(4), false)
+	s.PutLeecher(testInfohash, testPeer(4))
+	if err := s.collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.zsets[leechers]) != 2 {
+		t.Errorf("left %d leechers, want 2", len(r.zsets[leechers]))
+	}
+
+	// A seeder put while the emptied swarm is being removed keeps it in
+	// the index
+	putExpired(r, s, testPeer(0), true)
+	r.beforeExec = func() {
+		if err := s.PutSeeder(testInfohash, testPeer(3)); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := s.collectGarbage(); err != nil {
+		t.Fatal(err)
+	}
+	if !r.sets[s.indexKey()][seeders] {
+		t.Error("swarm with a new seeder was removed from the index")
+	}
+	peers, err := s.AnnouncePeers(testInfohash, false, 50, testPeer(2))
+	if err != nil || len(peers) != 2 || peers[0].ID != testPeer(3).ID {
+		t.Errorf("got %d peers and %v, want the new seeder and a leecher", len(peers), err)
+	}
+}
@@ -0,0 +1,384 @@
+// Package snapshot implements a storage.PeerStore that keeps peers in a
+// storage/memory PeerStore and saves them to disk, periodically and on
+// shutdown, so swarms survive a tracker restart.
+package snapshot
+
+import (
+	"encoding/gob"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/stopper"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+const defaultInterval = 5 * time.Minute
+
+// maxExpiryInterval is the longest time between two checks for restored
+// peers that expired.
+const maxExpiryInterval = time.Minute
+
+// Config holds the configuration of a snapshot PeerStore.
+type Config struct {
+	Path     string
+	Interval time.Duration
+}
+
+// peerKey identifies a peer in a swarm.
+type peerKey struct {
+	ID   bittorrent.PeerID
+	IP   string
+	Port uint16
+}
+
+type swarm struct {
+	seeders  map[peerKey]time.Time // Peer -> last announce
+	leechers map[peerKey]time.Time
+}
+
+// file is the on-disk format of a snapshot.
+type file struct {
+	Taken  time.Time
+	Swarms []swarmEntry
+}
+
+type swarmEntry struct {
+	InfoHash bittorrent.InfoHash
+	Seeders  []peerEntry
+	Leechers []peerEntry
+}
+
+type peerEntry struct {
+	ID       bittorrent.PeerID
+	IP       []byte
+	Port     uint16
+	LastSeen time.Time
+}
+
+type peerStore struct {
+	storage.PeerStore
+
+	cfg          Config
+	peerLifetime time.Duration
+	swarms       map[bittorrent.InfoHash]*swarm
+	closing      chan struct{}
+	wg           sync.WaitGroup
+	sync.Mutex
+}
+
+// New creates a memory PeerStore from memCfg, restores the peers saved at
+// cfg.Path that have not expired, and saves the peers again every
+// cfg.Interval and when stopped.
+func New(memCfg memory.Config, cfg Config) (storage.PeerStore, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("snapshot storage requires a snapshot_path")
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultInterval
+	}
+
+	mem, err := memory.New(memCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &peerStore{
+		PeerStore:    mem,
+		cfg:          cfg,
+		peerLifetime: memCfg.PeerLifetime,
+		swarms:       make(map[bittorrent.InfoHash]*swarm),
+		closing:      make(chan struct{}),
+	}
+
+	if err := s.restore(); err != nil {
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s, nil
+}
+
+func (s *peerStore) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	// The memory store gives restored peers a full lifetime from the
+	// restart, so they are expired here from when they were last seen.
+	var expiry <-chan time.Time
+	if s.peerLifetime > 0 {
+		interval := s.peerLifetime
+		if interval > maxExpiryInterval {
+			interval = maxExpiryInterval
+		}
+		expiryTicker := time.NewTicker(interval)
+		defer expiryTicker.Stop()
+		expiry = expiryTicker.C
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				log.Printf("Failed to snapshot peer store to %s: %s\n", s.cfg.Path, err.Error())
+			}
+		case <-expiry:
+			s.expire(time.Now())
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+func keyOf(p bittorrent.Peer) peerKey {
+	return peerKey{ID: p.ID, IP: string(p.IP), Port: p.Port}
+}
+
+func (s *peerStore) swarm(ih bittorrent.InfoHash) *swarm {
+	sw, ok := s.swarms[ih]
+	if !ok {
+		sw = &swarm{
+			seeders:  make(map[peerKey]time.Time),
+			leechers: make(map[peerKey]time.Time),
+		}
+		s.swarms[ih] = sw
+	}
+	return sw
+}
+
+func (s *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	if err := s.PeerStore.PutSeeder(ih, p); err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.swarm(ih).seeders[keyOf(p)] = time.Now()
+	s.Unlock()
+	return nil
+}
+
+func (s *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	s.Lock()
+	if sw, ok := s.swarms[ih]; ok {
+		delete(sw.seeders, keyOf(p))
+	}
+	s.Unlock()
+
+	return s.PeerStore.DeleteSeeder(ih, p)
+}
+
+func (s *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	if err := s.PeerStore.PutLeecher(ih, p); err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.swarm(ih).leechers[keyOf(p)] = time.Now()
+	s.Unlock()
+	return nil
+}
+
+func (s *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	s.Lock()
+	if sw, ok := s.swarms[ih]; ok {
+		delete(sw.leechers, keyOf(p))
+	}
+	s.Unlock()
+
+	return s.PeerStore.DeleteLeecher(ih, p)
+}
+
+func (s *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	if err := s.PeerStore.GraduateLeecher(ih, p); err != nil {
+		return err
+	}
+
+	s.Lock()
+	sw := s.swarm(ih)
+	delete(sw.leechers, keyOf(p))
+	sw.seeders[keyOf(p)] = time.Now()
+	s.Unlock()
+	return nil
+}
+
+func (s *peerStore) Stop() <-chan error {
+	select {
+	case <-s.closing:
+		return stopper.AlreadyStopped
+	default:
+	}
+
+	c := make(chan error)
+	go func() {
+		close(s.closing)
+		s.wg.Wait()
+
+		if err := s.save(); err != nil {
+			c <- errors.New("failed to snapshot peer store: " + err.Error())
+		}
+
+		for err := range s.PeerStore.Stop() {
+			if err != nil {
+				c <- err
+			}
+		}
+		close(c)
+	}()
+	return c
+}
+
+// expire deletes the peers not seen within the peer lifetime from the index
+// and the memory store.
+func (s *peerStore) expire(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for ih, sw := range s.swarms {
+		for k, lastSeen := range sw.seeders {
+			if s.peerLifetime > 0 && now.Sub(lastSeen) > s.peerLifetime {
+				delete(sw.seeders, k)
+				s.PeerStore.DeleteSeeder(ih, k.peer())
+			}
+		}
+		for k, lastSeen := range sw.leechers {
+			if s.peerLifetime > 0 && now.Sub(lastSeen) > s.peerLifetime {
+				delete(sw.leechers, k)
+				s.PeerStore.DeleteLeecher(ih, k.peer())
+			}
+		}
+		if len(sw.seeders) == 0 && len(sw.leechers) == 0 {
+			delete(s.swarms, ih)
+		}
+	}
+}
+
+// save expires peers, then writes the others to the snapshot file.
+func (s *peerStore) save() error {
+	now := time.Now()
+	snap := file{Taken: now}
+
+	s.expire(now)
+	s.Lock()
+	for ih, sw := range s.swarms {
+		snap.Swarms = append(snap.Swarms, swarmEntry{
+			InfoHash: ih,
+			Seeders:  collect(sw.seeders),
+			Leechers: collect(sw.leechers),
+		})
+	}
+	s.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.cfg.Path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a crash mid-write leaves the
+	// previous snapshot intact.
+	tmp := s.cfg.Path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(f).Encode(&snap); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.cfg.Path)
+}
+
+// collect returns the entries of peers. It must be called with the lock
+// held.
+func collect(peers map[peerKey]time.Time) []peerEntry {
+	entries := make([]peerEntry, 0, len(peers))
+	for k, lastSeen := range peers {
+		entries = append(entries, peerEntry{
+			ID:       k.ID,
+			IP:       []byte(k.IP),
+			Port:     k.Port,
+			LastSeen: lastSeen,
+		})
+	}
+	return entries
+}
+
+// restore loads the peers from the snapshot file into the memory store,
+// skipping those that expired while the tracker was down. The others keep
+// their last seen time, and are expired from it.
+func (s *peerStore) restore() error {
+	f, err := os.Open(s.cfg.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var snap file
+	if err := gob.NewDecoder(f).Decode(&snap); err != nil {
+		return errors.New("failed to read peer store snapshot " + s.cfg.Path + ": " + err.Error())
+	}
+
+	now := time.Now()
+	restored := 0
+	for _, entry := range snap.Swarms {
+		for _, p := range entry.Seeders {
+			if s.expired(p, now) {
+				continue
+			}
+			if err := s.PeerStore.PutSeeder(entry.InfoHash, p.peer()); err != nil {
+				return err
+			}
+			s.swarm(entry.InfoHash).seeders[keyOf(p.peer())] = p.LastSeen
+			restored++
+		}
+
+		for _, p := range entry.Leechers {
+			if s.expired(p, now) {
+				continue
+			}
+			if err := s.PeerStore.PutLeecher(entry.InfoHash, p.peer()); err != nil {
+				return err
+			}
+			s.swarm(entry.InfoHash).leechers[keyOf(p.peer())] = p.LastSeen
+			restored++
+		}
+	}
+
+	log.Printf("Restored %d peers from snapshot taken %s\n", restored, snap.Taken.Format(time.RFC3339))
+	return nil
+}
+
+func (s *peerStore) expired(p peerEntry, now time.Time) bool {
+	return s.peerLifetime > 0 && now.Sub(p.LastSeen) > s.peerLifetime
+}
+
+func (k peerKey) peer() bittorrent.Peer {
+	return bittorrent.Peer{
+		ID:   k.ID,
+		IP:   net.IP(k.IP),
+		Port: k.Port,
+	}
+}
+
+func (p peerEntry) peer() bittorrent.Peer {
+	return bittorrent.Peer{
+		ID:   p.ID,
+		IP:   net.IP(p.IP),
+		Port: p.Port,
+	}
+}
@@ -0,0 +1,138 @@
+package snapshot
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+var testInfohash = bittorrent.InfoHash{1, 2, 3}
+
+func testPeer(n byte) bittorrent.Peer {
+	return bittorrent.Peer{ID: bittorrent.PeerID{n}, IP: net.IP{10, 0, 0, n}, Port: 6881}
+}
+
+func tempPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "peers.snapshot"), func() { os.RemoveAll(dir) }
+}
+
+func newStore(t *testing.T, path string, lifetime time.Duration) storage.PeerStore {
+	s, err := New(memory.Config{PeerLifetime: lifetime}, Config{Path: path, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func stop(t *testing.T, s storage.PeerStore) {
+	for err := range s.Stop() {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkScrape(t *testing.T, s storage.PeerStore, seeders, leechers uint32) {
+	scrape := s.ScrapeSwarm(testInfohash, false)
+	if scrape.Complete != seeders || scrape.Incomplete != leechers {
+		t.Errorf("%d seeders and %d leechers, want %d and %d", scrape.Complete, scrape.Incomplete, seeders, leechers)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	s := newStore(t, path, time.Hour)
+	s.PutSeeder(testInfohash, testPeer(1))
+	s.PutLeecher(testInfohash, testPeer(2))
+	s.PutLeecher(testInfohash, testPeer(3))
+	s.DeleteLeecher(testInfohash, testPeer(3))
+	stop(t, s)
+
+	s = newStore(t, path, time.Hour)
+	defer stop(t, s)
+	checkScrape(t, s, 1, 1)
+}
+
+func TestRestoreLastSeen(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	now := time.Now()
+	lifetime := time.Hour
+	writeSnapshot(t, path, file{Taken: now, Swarms: []swarmEntry{{
+		InfoHash: testInfohash,
+		Seeders: []peerEntry{
+			entry(testPeer(1), now.Add(-time.Minute)),
+			entry(testPeer(2), now.Add(-lifetime+time.Minute)),
+		},
+		Leechers: []peerEntry{entry(testPeer(3), now.Add(-2*lifetime))},
+	}}})
+
+	s := newStore(t, path, lifetime)
+	defer stop(t, s)
+	checkScrape(t, s, 2, 0)
+
+	// The stale seeder expires a lifetime after it was last seen, not
+	// after the restart
+	s.(*peerStore).expire(now.Add(2 * time.Minute))
+	checkScrape(t, s, 1, 0)
+
+	// Unless it announces again
+	s.PutSeeder(testInfohash, testPeer(1))
+	s.(*peerStore).expire(now.Add(lifetime))
+	checkScrape(t, s, 1, 0)
+}
+
+func TestRestoreCorrupt(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	s := newStore(t, path, time.Hour)
+	s.PutSeeder(testInfohash, testPeer(1))
+	stop(t, s)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, corrupt := range map[string][]byte{
+		"truncated": data[:len(data)/2],
+		"garbage":   []byte("not a snapshot"),
+	} {
+		if err := ioutil.WriteFile(path, corrupt, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(memory.Config{}, Config{Path: path}); err == nil {
+			t.Errorf("%s snapshot restored", name)
+		}
+	}
+}
+
+func entry(p bittorrent.Peer, lastSeen time.Time) peerEntry {
+	return peerEntry{ID: p.ID, IP: p.IP, Port: p.Port, LastSeen: lastSeen}
+}
+
+func writeSnapshot(t *testing.T, path string, snap file) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := gob.NewEncoder(f).Encode(&snap); err != nil {
+		t.Fatal(err)
+	}
+}
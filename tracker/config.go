@@ -0,0 +1,182 @@
+package tracker
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	udpfrontend "github.com/chihaya/chihaya/frontend/udp"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+
+	httpfrontend "github.com/FactomProject/chihaya/frontend/http"
+	"github.com/FactomProject/chihaya/middleware/infohashapproval"
+	"github.com/FactomProject/chihaya/storage/redis"
+	"github.com/FactomProject/chihaya/storage/snapshot"
+)
+
+type storageConfig struct {
+	memory.Config `yaml:",inline"`
+
+	// Type is "memory" (the default), "snapshot" to also save peers to
+	// SnapshotPath every SnapshotInterval and on shutdown, or "redis" to
+	// share peers between trackers through the Redis server at RedisAddr.
+	Type             string        `yaml:"type"`
+	SnapshotPath     string        `yaml:"snapshot_path"`
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+	RedisAddr        string        `yaml:"redis_addr"`
+	RedisPassword    string        `yaml:"redis_password"`
+	RedisPrefix      string        `yaml:"redis_prefix"`
+}
+
+type hookConfig struct {
+	Name   string      `yaml:"name"`
+	Config interface{} `yaml:"config"`
+}
+
+// ConfigFile represents a namespaced YAML configation file.
+type ConfigFile struct {
+	MainConfigBlock struct {
+		middleware.Config `yaml:",inline"`
+		PrometheusAddr    string              `yaml:"prometheus_addr"`
+		HTTPConfig        httpfrontend.Config `yaml:"http"`
+		UDPConfig         udpfrontend.Config  `yaml:"udp"`
+		Storage           storageConfig       `yaml:"storage"`
+		PreHooks          []hookConfig        `yaml:"prehooks"`
+		PostHooks         []hookConfig        `yaml:"posthooks"`
+	} `yaml:"chihaya"`
+
+	// The config with the overrides and secret files applied, to diff on
+	// reload, and the secret files read, which are watched with the file
+	applied     []byte
+	secretFiles []string
+}
+
+// ParseConfigFile returns a new ConfigFile given the path to a YAML
+// configuration file.
+//
+// It supports relative and absolute paths and environment variables. Fields
+// are overridden by CHIHAYA_ environment variables and secret files, see
+// readConfigFile.
+func ParseConfigFile(path string) (*ConfigFile, error) {
+	if path == "" {
+		return nil, errors.New("no config path specified")
+	}
+
+	contents, applied, secretFiles, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfgFile ConfigFile
+	err = yaml.Unmarshal(contents, &cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	cfgFile.applied = applied
+	cfgFile.secretFiles = secretFiles
+
+	return &cfgFile, nil
+}
+
+// CreatePeerStore creates the PeerStore configured in a ConfigFile.
+func (cfg ConfigFile) CreatePeerStore() (storage.PeerStore, error) {
+	storageCfg := cfg.MainConfigBlock.Storage
+
+	switch storageCfg.Type {
+	case "", "memory":
+		return memory.New(storageCfg.Config)
+	case "snapshot":
+		return snapshot.New(storageCfg.Config, snapshot.Config{
+			Path:     os.ExpandEnv(storageCfg.SnapshotPath),
+			Interval: storageCfg.SnapshotInterval,
+		})
+	case "redis":
+		return redis.New(redis.Config{
+			Addr:                      storageCfg.RedisAddr,
+			Password:                  storageCfg.RedisPassword,
+			Prefix:                    storageCfg.RedisPrefix,
+			PeerLifetime:              storageCfg.PeerLifetime,
+			GarbageCollectionInterval: storageCfg.GarbageCollectionInterval,
+		})
+	}
+
+	return nil, errors.New("unknown storage type " + storageCfg.Type)
+}
+
+// InfohashApprovalConfig returns the config of the infohash approval
+// prehook in a ConfigFile.
+func (cfg ConfigFile) InfohashApprovalConfig() (infohashapproval.Config, error) {
+	var iaCfg infohashapproval.Config
+	for _, hookCfg := range cfg.MainConfigBlock.PreHooks {
+		if hookCfg.Name != "infohash approval" {
+			continue
+		}
+
+		cfgBytes, err := yaml.Marshal(hookCfg.Config)
+		if err != nil {
+			panic("failed to remarshal valid YAML")
+		}
+
+		err = yaml.Unmarshal(cfgBytes, &iaCfg)
+		if err != nil {
+			return iaCfg, errors.New("invalid infohash approval middleware config: " + err.Error())
+		}
+		return iaCfg, nil
+	}
+
+	return iaCfg, errors.New("no infohash approval prehook configured")
+}
+
+// WatchedFiles returns the config file at path, its secret files and every
+// file its hooks read from, which are reloaded along with it.
+func (cfg ConfigFile) WatchedFiles(path string) []string {
+	files := append([]string{os.ExpandEnv(path)}, cfg.secretFiles...)
+	if iaCfg, err := cfg.InfohashApprovalConfig(); err == nil {
+		files = append(files, iaCfg.Files()...)
+	}
+	return files
+}
+
+// StorageChanged reports whether newCfg configures a different PeerStore.
+func (cfg ConfigFile) StorageChanged(newCfg *ConfigFile) bool {
+	return !reflect.DeepEqual(cfg.MainConfigBlock.Storage, newCfg.MainConfigBlock.Storage)
+}
+
+// CreateHooks creates instances of Hooks for all of the PreHooks and PostHooks
+// configured in a ConfigFile.
+func (cfg ConfigFile) CreateHooks() (preHooks, postHooks []middleware.Hook, err error) {
+	for _, hookCfg := range cfg.MainConfigBlock.PreHooks {
+		cfgBytes, err := yaml.Marshal(hookCfg.Config)
+		if err != nil {
+			panic("failed to remarshal valid YAML")
+		}
+
+		switch hookCfg.Name {
+		case "infohash approval":
+			var iaCfg infohashapproval.Config
+			err := yaml.Unmarshal(cfgBytes, &iaCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid infohash approval middleware config: " + err.Error())
+			}
+
+			hook, err := infohashapproval.NewHook(iaCfg)
+			if err != nil {
+				return nil, nil, errors.New("invalid infohash approval middleware config: " + err.Error())
+			}
+
+			preHooks = append(preHooks, hook)
+		}
+	}
+
+	for _, hookCfg := range cfg.MainConfigBlock.PostHooks {
+		switch hookCfg.Name {
+		}
+	}
+
+	return
+}
@@ -0,0 +1,166 @@
+package tracker
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix starts the environment variables overriding config fields. The
+// rest of the name is the path to the field below the chihaya block, in
+// upper case with __ between keys and list indexes, e.g.
+// CHIHAYA_UDP__ADDR or CHIHAYA_PREHOOKS__0__CONFIG__DATABASE.
+const envPrefix = "CHIHAYA_"
+
+// secretKeys are the fields that can be read from a file instead, named by
+// the same key with _file appended, e.g. private_key_file. The contents of
+// the file, without a trailing newline, become the value, replacing any
+// value set in the config.
+var secretKeys = []string{"private_key", "username", "password", "redis_password", "sql_dsn", "secret"}
+
+// readConfigFile reads the config file at path and applies the environment
+// overrides and secret files. The contents are re-marshaled only when
+// something was applied, so otherwise yaml errors keep their line numbers.
+// applied is always the re-marshaled config, to compare configs by what
+// they set, and secretFiles the paths of the secret files read.
+func readConfigFile(path string) (contents, applied []byte, secretFiles []string, err error) {
+	raw, err := ioutil.ReadFile(os.ExpandEnv(path))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var tree interface{}
+	if err := yaml.Unmarshal(raw, &tree); err != nil {
+		return nil, nil, nil, err
+	}
+
+	tree, overridden, err := applyEnvOverrides(tree, os.Environ())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	secretFiles, err = readSecretFiles(tree)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	applied, err = yaml.Marshal(tree)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !overridden && len(secretFiles) == 0 {
+		return raw, applied, nil, nil
+	}
+	return applied, applied, secretFiles, nil
+}
+
+// applyEnvOverrides sets the fields named by the CHIHAYA_ variables of
+// environ. Values are parsed as YAML, so durations, numbers, booleans and
+// lists work as in the file; quote a string that would be read otherwise.
+func applyEnvOverrides(tree interface{}, environ []string) (interface{}, bool, error) {
+	// Sorted so the same environment always gives the same config
+	sort.Strings(environ)
+
+	overridden := false
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		eq := strings.Index(kv, "=")
+		if eq < 0 {
+			continue
+		}
+		name, value := kv[:eq], kv[eq+1:]
+
+		var parsed interface{}
+		if err := yaml.Unmarshal([]byte(value), &parsed); err != nil {
+			parsed = value
+		}
+
+		path := append([]string{"chihaya"}, strings.Split(strings.ToLower(name[len(envPrefix):]), "__")...)
+		var err error
+		tree, err = setPath(tree, path, parsed)
+		if err != nil {
+			return nil, false, errors.New(name + ": " + err.Error())
+		}
+		overridden = true
+	}
+	return tree, overridden, nil
+}
+
+// setPath sets the value at path in node, creating mappings as needed.
+func setPath(node interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	key := path[0]
+	if key == "" {
+		return nil, errors.New("empty key")
+	}
+
+	switch n := node.(type) {
+	case []interface{}:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(n) {
+			return nil, errors.New(key + " is not an index of the list")
+		}
+		n[i], err = setPath(n[i], path[1:], value)
+		return n, err
+	case map[interface{}]interface{}:
+		v, err := setPath(n[key], path[1:], value)
+		n[key] = v
+		return n, err
+	case nil:
+		v, err := setPath(nil, path[1:], value)
+		return map[interface{}]interface{}{key: v}, err
+	}
+	return nil, errors.New(key + " is set below a value that is not a mapping")
+}
+
+// readSecretFiles replaces every secret key ending in _file, anywhere in the
+// tree, by the contents of the file it names, and returns the paths read.
+func readSecretFiles(node interface{}) ([]string, error) {
+	var paths []string
+	switch n := node.(type) {
+	case []interface{}:
+		for _, v := range n {
+			found, err := readSecretFiles(v)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, found...)
+		}
+	case map[interface{}]interface{}:
+		for _, v := range n {
+			found, err := readSecretFiles(v)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, found...)
+		}
+
+		for _, key := range secretKeys {
+			pathValue, ok := n[key+"_file"]
+			if !ok {
+				continue
+			}
+			path, ok := pathValue.(string)
+			if !ok {
+				return nil, errors.New(key + "_file must be a path")
+			}
+			path = os.ExpandEnv(path)
+			secret, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, errors.New(key + "_file: " + err.Error())
+			}
+			n[key] = strings.TrimRight(string(secret), "\r\n")
+			delete(n, key+"_file")
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
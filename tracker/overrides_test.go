@@ -0,0 +1,160 @@
+package tracker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const testConfig = `chihaya:
+  announce_interval: 15m
+  udp:
+    addr: 0.0.0.0:6881
+    private_key: from the file
+  prehooks:
+  - name: infohash approval
+    config:
+      database: Map
+`
+
+// writeTestFiles writes the named files in a new directory and returns it.
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "chihaya-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	var tree interface{}
+	if err := yaml.Unmarshal([]byte(testConfig), &tree); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, overridden, err := applyEnvOverrides(tree, []string{
+		"HOME=/root",
+		"CHIHAYA_ANNOUNCE_INTERVAL=30m",
+		"CHIHAYA_UDP__ADDR=127.0.0.1:7000",
+		"CHIHAYA_PREHOOKS__0__CONFIG__DATABASE=Bolt",
+		"CHIHAYA_HTTP__READ_TIMEOUT=5s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !overridden {
+		t.Error("overrides weren't reported")
+	}
+
+	out, _ := yaml.Marshal(tree)
+	var cfg ConfigFile
+	if err := yaml.Unmarshal(out, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	main := cfg.MainConfigBlock
+	if main.AnnounceInterval != 30*time.Minute {
+		t.Errorf("announce_interval is %s", main.AnnounceInterval)
+	}
+	if main.UDPConfig.Addr != "127.0.0.1:7000" {
+		t.Errorf("udp addr is %s", main.UDPConfig.Addr)
+	}
+	if main.HTTPConfig.ReadTimeout != 5*time.Second {
+		t.Errorf("missing http block wasn't created, read_timeout is %s", main.HTTPConfig.ReadTimeout)
+	}
+	if db := main.PreHooks[0].Config.(map[interface{}]interface{})["database"]; db != "Bolt" {
+		t.Errorf("prehook database is %v", db)
+	}
+
+	for _, env := range []string{"CHIHAYA_PREHOOKS__3__NAME=x", "CHIHAYA_UDP__ADDR__PORT=1", "CHIHAYA_UDP____ADDR=x"} {
+		var tree interface{}
+		yaml.Unmarshal([]byte(testConfig), &tree)
+		if _, _, err := applyEnvOverrides(tree, []string{env}); err == nil {
+			t.Errorf("%s was applied", env)
+		}
+	}
+}
+
+func TestReadSecretFiles(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		"config.yaml": testConfig + "      admin:\n        password_file: " + "$CHIHAYA_TEST_DIR/password\n",
+		"password":    "s3cret\n",
+	})
+	defer os.RemoveAll(dir)
+	os.Setenv("CHIHAYA_TEST_DIR", dir)
+	defer os.Unsetenv("CHIHAYA_TEST_DIR")
+
+	cfg, err := ParseConfigFile(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := cfg.MainConfigBlock.PreHooks[0].Config.(map[interface{}]interface{})["admin"].(map[interface{}]interface{})
+	if admin["password"] != "s3cret" {
+		t.Errorf("password is %q, want it without the trailing newline", admin["password"])
+	}
+	if _, ok := admin["password_file"]; ok {
+		t.Error("password_file was left in the config")
+	}
+	if len(cfg.secretFiles) != 1 || cfg.secretFiles[0] != filepath.Join(dir, "password") {
+		t.Errorf("secret files are %v", cfg.secretFiles)
+	}
+
+	os.Remove(filepath.Join(dir, "password"))
+	if _, err := ParseConfigFile(filepath.Join(dir, "config.yaml")); err == nil || !strings.Contains(err.Error(), "password_file") {
+		t.Errorf("missing secret file gave %v", err)
+	}
+}
+
+func TestDiffRedacts(t *testing.T) {
+	old := &ConfigFile{applied: []byte(`chihaya:
+  udp:
+    addr: 0.0.0.0:6881
+    private_key: |
+      oldkey
+  prehooks:
+  - config:
+      redis_addr: old:6379
+      admin:
+        username: old-admin
+        password: old-password
+      webhooks:
+      - url: https://example.com/old-token
+        secret: old-secret
+`)}
+	newCfg := &ConfigFile{applied: []byte(`chihaya:
+  udp:
+    addr: 0.0.0.0:6882
+    private_key: |
+      newkey
+  prehooks:
+  - config:
+      redis_addr: new:6379
+      admin:
+        username: new-admin
+        password: new-password
+      webhooks:
+      - url: https://example.com/new-token
+        secret: new-secret
+`)}
+
+	diff := strings.Join(old.Diff(newCfg), "\n")
+	for _, secret := range []string{"key", ":6379", "-admin", "-password", "-token", "-secret"} {
+		if strings.Contains(diff, "old"+secret) || strings.Contains(diff, "new"+secret) {
+			t.Errorf("%s leaked in diff:\n%s", secret, diff)
+		}
+	}
+	for _, line := range []string{"-    addr: 0.0.0.0:6881", "+    addr: 0.0.0.0:6882", "+      redis_addr: <redacted>", "+      - url: <redacted>", "+        password: <redacted>"} {
+		if !strings.Contains(diff, line) {
+			t.Errorf("diff is missing %q:\n%s", line, diff)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package tracker
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reloadCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "chihaya_config_reload_total_count",
+		Help: "Amount of config reloads, by result (success or failure)",
+	}, []string{"result"})
+
+	lastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_config_last_reload_successful",
+		Help: "Whether the last config reload was applied (1) or not (0)",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(reloadCount)
+	prometheus.MustRegister(lastReloadSuccess)
+}
+
+// redactedKeys are not logged in diffs along with the secretKeys, which may
+// have been read from files: webhook and peer URLs and Redis addresses can
+// carry tokens or credentials.
+var redactedKeys = []string{"url", "redis_addr"}
+
+// secretKey matches the YAML keys whose values are not logged in diffs.
+var secretKey = regexp.MustCompile(`^(\s*-?\s*)([A-Za-z_]*(` + strings.Join(append(redactedKeys, secretKeys...), "|") + `)[A-Za-z_]*):(.*)$`)
+
+// Diff returns the lines changed from cfg to newCfg, prefixed with - or +.
+// Configs are compared with their environment overrides and secret files
+// applied, so a changed secret shows as a redacted line. The values of the
+// secret keys, URLs and Redis addresses are redacted.
+func (cfg ConfigFile) Diff(newCfg *ConfigFile) []string {
+	oldLines, oldShown := redactedLines(cfg.applied)
+	newLines, newShown := redactedLines(newCfg.applied)
+
+	// Longest common subsequence of the lines; configs are small
+	lcs := make([][]int, len(oldLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(newLines)+1)
+	}
+	for i := len(oldLines) - 1; i >= 0; i-- {
+		for j := len(newLines) - 1; j >= 0; j-- {
+			if oldLines[i] == newLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(oldLines) || j < len(newLines) {
+		switch {
+		case i < len(oldLines) && j < len(newLines) && oldLines[i] == newLines[j]:
+			i++
+			j++
+		case i < len(oldLines) && (j == len(newLines) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "-"+oldShown[i])
+			i++
+		default:
+			diff = append(diff, "+"+newShown[j])
+			j++
+		}
+	}
+	return diff
+}
+
+// redactedLines splits a config into its non-blank lines, and the same
+// lines with secret values redacted. Block scalars (| or >) under a secret
+// key are redacted too.
+func redactedLines(raw []byte) (lines, shown []string) {
+	secretIndent := -1
+	for _, line := range strings.Split(string(raw), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		display := line
+		switch m := secretKey.FindStringSubmatch(line); {
+		case secretIndent >= 0 && indent > secretIndent:
+			display = strings.Repeat(" ", indent) + "<redacted>"
+		case m != nil:
+			secretIndent = -1
+			value := strings.TrimSpace(m[4])
+			if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+				secretIndent = indent
+			} else if value != "" {
+				display = m[1] + m[2] + ": <redacted>"
+			}
+		default:
+			secretIndent = -1
+		}
+
+		lines = append(lines, line)
+		shown = append(shown, display)
+	}
+	return lines, shown
+}
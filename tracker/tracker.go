@@ -0,0 +1,340 @@
+// Package tracker runs the Factom chihaya tracker in-process: the peer
+// storage, the middleware hooks and the HTTP and UDP frontends described by
+// a ConfigFile. The chihaya command is a thin wrapper around it.
+package tracker
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	udpfrontend "github.com/chihaya/chihaya/frontend/udp"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/stopper"
+	"github.com/chihaya/chihaya/storage"
+
+	httpfrontend "github.com/FactomProject/chihaya/frontend/http"
+	"github.com/FactomProject/chihaya/middleware/infohashapproval"
+)
+
+// Tracker is a tracker built from a ConfigFile. Create it with New, then
+// Start it; it can be reloaded with another ConfigFile while running.
+type Tracker struct {
+	mu sync.Mutex
+
+	configFile *ConfigFile
+	peerStore  storage.PeerStore
+	preHooks   []middleware.Hook
+	postHooks  []middleware.Hook
+	logic      *middleware.Logic
+
+	httpFrontend *httpfrontend.Frontend
+	udpFrontend  *udpfrontend.Frontend
+	promServer   *http.Server
+
+	// Closed when the running frontends are stopped on purpose, so their
+	// ListenAndServe errors are not reported
+	frontendsStopped chan struct{}
+
+	errs    chan error
+	started bool
+	stopped bool
+}
+
+// New creates the storage and hooks configured in cfg. Nothing is served
+// until Start is called.
+func New(cfg *ConfigFile) (*Tracker, error) {
+	peerStore, err := cfg.CreatePeerStore()
+	if err != nil {
+		return nil, errors.New("failed to create storage: " + err.Error())
+	}
+
+	preHooks, postHooks, err := cfg.CreateHooks()
+	if err != nil {
+		stopPeerStore(peerStore)
+		return nil, errors.New("failed to create hooks: " + err.Error())
+	}
+
+	return &Tracker{
+		configFile: cfg,
+		peerStore:  peerStore,
+		preHooks:   preHooks,
+		postHooks:  postHooks,
+		errs:       make(chan error, 2),
+	}, nil
+}
+
+// Start serves announces and scrapes on the configured frontends, and the
+// metrics on prometheus_addr when it is set.
+func (t *Tracker) Start() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.started {
+		return errors.New("tracker already started")
+	}
+	t.started = true
+
+	cfg := t.configFile.MainConfigBlock
+	if cfg.PrometheusAddr != "" {
+		t.promServer = &http.Server{
+			Addr:    cfg.PrometheusAddr,
+			Handler: prometheus.Handler(),
+		}
+		go func() {
+			log.Infoln("started serving prometheus stats on", cfg.PrometheusAddr)
+			if err := t.promServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				t.report(errors.New("failed to start prometheus server: " + err.Error()))
+			}
+		}()
+	}
+
+	t.logic = middleware.NewLogic(cfg.Config, t.peerStore, t.preHooks, t.postHooks)
+	t.startFrontends()
+	return nil
+}
+
+// Errors receives the errors that stop a frontend or the prometheus server
+// unexpectedly. The tracker should then be stopped.
+func (t *Tracker) Errors() <-chan error {
+	return t.errs
+}
+
+// report passes on an error without blocking; the first ones are enough to
+// know the tracker failed.
+func (t *Tracker) report(err error) {
+	select {
+	case t.errs <- err:
+	default:
+		log.Errorln(err)
+	}
+}
+
+// Stop stops the frontends, the hooks and the storage, returning every
+// error met on the way.
+func (t *Tracker) Stop() []error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return nil
+	}
+	t.stopped = true
+
+	var errs []error
+	if t.started {
+		t.stopFrontends()
+		if t.promServer != nil {
+			t.promServer.Close()
+		}
+
+		log.Debug("Stopping logic")
+		errs = append(errs, t.logic.Stop()...)
+	} else {
+		errs = append(errs, stopHooks(t.preHooks, t.postHooks)...)
+	}
+
+	log.Debug("Stopping storage")
+	errs = append(errs, stopPeerStore(t.peerStore)...)
+	return errs
+}
+
+// Config returns the ConfigFile the tracker currently runs.
+func (t *Tracker) Config() *ConfigFile {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.configFile
+}
+
+// Approvals returns the infohash approval hook, or nil when none is
+// configured. It changes on every reload.
+func (t *Tracker) Approvals() infohashapproval.Approvals {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, hook := range t.preHooks {
+		if approvals, ok := hook.(infohashapproval.Approvals); ok {
+			return approvals
+		}
+	}
+	return nil
+}
+
+// ReloadFile validates the config file at path, then reloads the tracker
+// with it.
+func (t *Tracker) ReloadFile(path string) error {
+	if errs := ValidateConfigFile(path); len(errs) > 0 {
+		problems := make([]string, len(errs))
+		for i, err := range errs {
+			problems[i] = err.Error()
+		}
+		return reloadFailed(errors.New("invalid config:\n" + strings.Join(problems, "\n")))
+	}
+
+	cfg, err := ParseConfigFile(path)
+	if err != nil {
+		return reloadFailed(errors.New("failed to read config: " + err.Error()))
+	}
+	return t.Reload(cfg)
+}
+
+// Reload switches the tracker to cfg. It is transactional: the hooks, and
+// the storage if its config changed, are created before anything running
+// is stopped, so if any of it fails the error is returned and the tracker
+// keeps running untouched. The prometheus address only applies on restart.
+func (t *Tracker) Reload(cfg *ConfigFile) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return reloadFailed(errors.New("tracker is stopped"))
+	}
+
+	newPreHooks, newPostHooks, err := cfg.CreateHooks()
+	if err != nil {
+		return reloadFailed(errors.New("failed to create hooks: " + err.Error()))
+	}
+
+	newPeerStore := t.peerStore
+	if t.configFile.StorageChanged(cfg) {
+		newPeerStore, err = cfg.CreatePeerStore()
+		if err != nil {
+			for _, err := range stopHooks(newPreHooks, newPostHooks) {
+				log.Error("failed to stop hook: " + err.Error())
+			}
+			return reloadFailed(errors.New("failed to create storage: " + err.Error()))
+		}
+	}
+
+	diff := t.configFile.Diff(cfg)
+	oldPeerStore, oldLogic := t.peerStore, t.logic
+	oldPreHooks, oldPostHooks := t.preHooks, t.postHooks
+	t.configFile = cfg
+	t.preHooks, t.postHooks, t.peerStore = newPreHooks, newPostHooks, newPeerStore
+
+	if t.started {
+		t.stopFrontends()
+
+		log.Debug("Stopping logic")
+		for _, err := range oldLogic.Stop() {
+			log.Error("failed to stop logic: " + err.Error())
+		}
+
+		log.Debug("Restarting logic")
+		t.logic = middleware.NewLogic(cfg.MainConfigBlock.Config, t.peerStore, t.preHooks, t.postHooks)
+
+		log.Debug("Restarting frontends")
+		t.startFrontends()
+	} else {
+		for _, err := range stopHooks(oldPreHooks, oldPostHooks) {
+			log.Error("failed to stop hook: " + err.Error())
+		}
+	}
+
+	if t.peerStore != oldPeerStore {
+		log.Debug("Stopping replaced storage")
+		for _, err := range stopPeerStore(oldPeerStore) {
+			log.Error("failed to stop replaced storage: " + err.Error())
+		}
+	}
+
+	reloadCount.WithLabelValues("success").Inc()
+	lastReloadSuccess.Set(1)
+	if len(diff) == 0 {
+		log.Info("Reloaded config, nothing changed")
+	} else {
+		log.Info("Reloaded config, changes:\n" + strings.Join(diff, "\n"))
+	}
+	return nil
+}
+
+func reloadFailed(err error) error {
+	reloadCount.WithLabelValues("failure").Inc()
+	lastReloadSuccess.Set(0)
+	return err
+}
+
+func (t *Tracker) startFrontends() {
+	cfg := t.configFile.MainConfigBlock
+	stopped := make(chan struct{})
+	t.frontendsStopped = stopped
+
+	// serve reports the error of a frontend, unless it was stopped
+	serve := func(name string, listenAndServe func() error) {
+		if err := listenAndServe(); err != nil {
+			select {
+			case <-stopped:
+			default:
+				t.report(errors.New("failed to cleanly shutdown " + name + " frontend: " + err.Error()))
+			}
+		}
+	}
+
+	if cfg.HTTPConfig.Addr != "" {
+		t.httpFrontend = httpfrontend.NewFrontend(t.logic, cfg.HTTPConfig)
+		for _, hook := range append(append([]middleware.Hook(nil), t.preHooks...), t.postHooks...) {
+			if u, ok := hook.(infohashapproval.SwarmsUser); ok {
+				u.UseSwarms(t.peerStore)
+			}
+			if r, ok := hook.(httpfrontend.Router); ok {
+				t.httpFrontend.Mount(r)
+			}
+		}
+		go func(f *httpfrontend.Frontend) {
+			log.Infoln("started serving HTTP on", cfg.HTTPConfig.Addr)
+			serve("HTTP", f.ListenAndServe)
+		}(t.httpFrontend)
+	}
+
+	if cfg.UDPConfig.Addr != "" {
+		t.udpFrontend = udpfrontend.NewFrontend(t.logic, cfg.UDPConfig)
+		go func(f *udpfrontend.Frontend) {
+			log.Infoln("started serving UDP on", cfg.UDPConfig.Addr)
+			serve("UDP", f.ListenAndServe)
+		}(t.udpFrontend)
+	}
+}
+
+func (t *Tracker) stopFrontends() {
+	log.Debug("Stopping frontends")
+	close(t.frontendsStopped)
+
+	if t.udpFrontend != nil {
+		t.udpFrontend.Stop()
+		t.udpFrontend = nil
+	}
+
+	if t.httpFrontend != nil {
+		t.httpFrontend.Stop()
+		t.httpFrontend = nil
+	}
+}
+
+// stopHooks stops hooks that are not part of a running logic.
+func stopHooks(preHooks, postHooks []middleware.Hook) []error {
+	var errs []error
+	for _, hook := range append(append([]middleware.Hook(nil), preHooks...), postHooks...) {
+		if s, ok := hook.(stopper.Stopper); ok {
+			for err := range s.Stop() {
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+func stopPeerStore(peerStore storage.PeerStore) []error {
+	var errs []error
+	for err := range peerStore.Stop() {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,192 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/FactomProject/chihaya/middleware/infohashapproval"
+)
+
+// unknownField rewrites the errors yaml gives for unknown keys, which name
+// the whole Go type they were not found in.
+var unknownField = regexp.MustCompile(`field (\S+) not found in type .*`)
+
+// lineNumber starts yaml errors. Hook configs are re-marshaled before being
+// decoded, so their line numbers don't match the file and are dropped.
+var lineNumber = regexp.MustCompile(`^line \d+: `)
+
+// ValidateConfigFile strictly checks the config file at path: unknown or
+// duplicate keys, values of the wrong type, such as invalid durations, the
+// settings of every hook, and addresses used twice. Unlike ParseConfigFile,
+// it returns every problem found rather than only the first.
+func ValidateConfigFile(path string) []error {
+	if path == "" {
+		return []error{errors.New("no config path specified")}
+	}
+
+	contents, _, _, err := readConfigFile(path)
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	addYAML := func(prefix string, err error) {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			add("%s%s", prefix, err.Error())
+			return
+		}
+		for _, e := range typeErr.Errors {
+			e = unknownField.ReplaceAllString(e, "unknown key $1")
+			if prefix != "" {
+				e = lineNumber.ReplaceAllString(e, "")
+			}
+			add("%s%s", prefix, e)
+		}
+	}
+
+	var cfgFile ConfigFile
+	if err := yaml.UnmarshalStrict(contents, &cfgFile); err != nil {
+		addYAML("", err)
+		if _, ok := err.(*yaml.TypeError); !ok {
+			// Not even valid YAML, there is nothing more to check
+			return errs
+		}
+	}
+	cfg := cfgFile.MainConfigBlock
+
+	if cfg.AnnounceInterval <= 0 {
+		add("announce_interval must be positive")
+	}
+	if cfg.DefaultNumWant > cfg.MaxNumWant {
+		add("default_numwant is more than max_numwant")
+	}
+	if cfg.HTTPConfig.Addr == "" && cfg.UDPConfig.Addr == "" {
+		add("neither http.addr nor udp.addr is set, no announce would be served")
+	}
+	if cfg.UDPConfig.Addr != "" && cfg.UDPConfig.PrivateKey == "" {
+		add("udp.private_key is required to serve UDP")
+	}
+
+	storageCfg := cfg.Storage
+	switch storageCfg.Type {
+	case "", "memory":
+	case "snapshot":
+		if storageCfg.SnapshotPath == "" {
+			add("storage type snapshot requires snapshot_path")
+		}
+	case "redis":
+		if storageCfg.RedisAddr == "" {
+			add("storage type redis requires redis_addr")
+		}
+	default:
+		add("unknown storage type %q, must be memory, snapshot or redis", storageCfg.Type)
+	}
+	if storageCfg.PeerLifetime <= 0 || storageCfg.GarbageCollectionInterval <= 0 {
+		add("storage.peer_lifetime and storage.gc_interval must be positive")
+	}
+
+	// TCP addresses, by config key
+	addrs := map[string]string{}
+	if cfg.PrometheusAddr != "" {
+		addrs["prometheus_addr"] = cfg.PrometheusAddr
+	}
+	if cfg.HTTPConfig.Addr != "" {
+		addrs["http.addr"] = cfg.HTTPConfig.Addr
+	}
+
+	approval := false
+	for i, hookCfg := range cfg.PreHooks {
+		prefix := fmt.Sprintf("prehooks[%d] (%s): ", i, hookCfg.Name)
+		switch hookCfg.Name {
+		case "infohash approval":
+			approval = true
+			cfgBytes, err := yaml.Marshal(hookCfg.Config)
+			if err != nil {
+				panic("failed to remarshal valid YAML")
+			}
+
+			var iaCfg infohashapproval.Config
+			if err := yaml.UnmarshalStrict(cfgBytes, &iaCfg); err != nil {
+				addYAML(prefix, err)
+			}
+			for _, err := range iaCfg.Validate() {
+				add("%s%s", prefix, err.Error())
+			}
+			if iaCfg.MetadataUpload && cfg.HTTPConfig.Addr == "" {
+				add("%smetadata_upload is served on the HTTP frontend, which needs http.addr", prefix)
+			}
+			if iaCfg.Downloads.Enabled && cfg.HTTPConfig.Addr == "" {
+				add("%sdownloads are served on the HTTP frontend, which needs http.addr", prefix)
+			}
+			if iaCfg.Status.Enabled && cfg.HTTPConfig.Addr == "" {
+				add("%sstatus is served on the HTTP frontend, which needs http.addr", prefix)
+			}
+			for key, addr := range iaCfg.Addrs() {
+				addrs[fmt.Sprintf("prehooks[%d].%s", i, key)] = addr
+			}
+		default:
+			add("%sunknown hook", prefix)
+		}
+	}
+	for i, hookCfg := range cfg.PostHooks {
+		add("posthooks[%d] (%s): unknown hook", i, hookCfg.Name)
+	}
+	if !approval {
+		add("no infohash approval prehook, every infohash would be allowed")
+	}
+
+	for _, conflict := range conflictingAddrs(addrs) {
+		add("%s", conflict)
+	}
+	return errs
+}
+
+// conflictingAddrs reports the addresses that would listen on the same port
+// of the same interface.
+func conflictingAddrs(addrs map[string]string) []string {
+	type listener struct {
+		key, host, port string
+	}
+
+	keys := make([]string, 0, len(addrs))
+	for key := range addrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var listeners []listener
+	var conflicts []string
+	for _, key := range keys {
+		addr := addrs[key]
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			conflicts = append(conflicts, key+": invalid address "+addr)
+			continue
+		}
+		listeners = append(listeners, listener{key, host, port})
+	}
+
+	for i, a := range listeners {
+		for _, b := range listeners[i+1:] {
+			if a.port == b.port && (a.host == b.host || anyHost(a.host) || anyHost(b.host)) {
+				conflicts = append(conflicts, fmt.Sprintf("%s and %s both listen on %s", a.key, b.key, addrs[a.key]))
+			}
+		}
+	}
+	return conflicts
+}
+
+// anyHost reports whether a listener on host takes the port on every
+// interface.
+func anyHost(host string) bool {
+	return host == "" || host == "0.0.0.0" || host == "::"
+}
@@ -0,0 +1,46 @@
+package tracker
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfigFile(t *testing.T) {
+	valid := strings.Replace(testConfig, "  udp:", "  storage:\n    peer_lifetime: 31m\n    gc_interval: 3m\n  udp:", 1)
+	tests := []struct {
+		name   string
+		config string
+		errs   []string
+	}{
+		{"valid", valid, nil},
+		{
+			"unknown key",
+			strings.Replace(valid, "  storage:", "  storage:\n    peer_lifetim: 31m", 1),
+			[]string{"line 4: unknown key peer_lifetim"},
+		},
+		{
+			"invalid hook config",
+			valid + "      approval_ttl: -1h\n",
+			[]string{"prehooks[0] (infohash approval): approval_ttl must not be negative"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeTestFiles(t, map[string]string{"config.yaml": test.config})
+			defer os.RemoveAll(dir)
+
+			errs := ValidateConfigFile(filepath.Join(dir, "config.yaml"))
+			if len(errs) != len(test.errs) {
+				t.Fatalf("got errors %v, want %d", errs, len(test.errs))
+			}
+			for i, err := range errs {
+				if !strings.HasPrefix(err.Error(), test.errs[i]) {
+					t.Errorf("error %d is %q, want it to start with %q", i, err, test.errs[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// fileWatcher polls files for changes. Changes are debounced: they are only
+// reported once the files have stayed the same for a whole interval, so an
+// editor saving in several writes causes a single reload.
+type fileWatcher struct {
+	interval time.Duration
+	changed  chan struct{}
+
+	// The files, their states when last reported, and at the last poll
+	mu      sync.Mutex
+	paths   []string
+	applied map[string]fileState
+	last    map[string]fileState
+}
+
+func newFileWatcher(paths []string, interval time.Duration) *fileWatcher {
+	w := &fileWatcher{
+		interval: interval,
+		changed:  make(chan struct{}, 1),
+	}
+	w.SetPaths(paths)
+	return w
+}
+
+// SetPaths replaces the watched files, e.g. once a reloaded config
+// references other files. Their current states are the applied ones, so
+// the files the reload read aren't reported as changed.
+func (w *fileWatcher) SetPaths(paths []string) {
+	states := statFiles(paths)
+	w.mu.Lock()
+	w.paths = paths
+	w.applied = states
+	w.last = states
+	w.mu.Unlock()
+}
+
+// Changed receives a value after the watched files changed.
+func (w *fileWatcher) Changed() <-chan struct{} {
+	return w.changed
+}
+
+// fileState is what is compared between polls. A missing file has the zero
+// state, so creating or deleting it is a change too.
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFiles(paths []string) map[string]fileState {
+	states := make(map[string]fileState, len(paths))
+	for _, path := range paths {
+		var state fileState
+		if fi, err := os.Stat(path); err == nil {
+			state = fileState{modTime: fi.ModTime(), size: fi.Size()}
+		}
+		states[path] = state
+	}
+	return states
+}
+
+// poll returns true if the files changed since they were last reported,
+// and then stayed the same since the previous poll.
+func (w *fileWatcher) poll() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	current := statFiles(w.paths)
+	changed := !sameStates(current, w.applied) && sameStates(current, w.last)
+	if changed {
+		w.applied = current
+	}
+	w.last = current
+	return changed
+}
+
+// Run polls until done is closed.
+func (w *fileWatcher) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if w.poll() {
+				select {
+				case w.changed <- struct{}{}:
+				default:
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func sameStates(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, state := range a {
+		other, ok := b[path]
+		if !ok || !other.modTime.Equal(state.modTime) || other.size != state.size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config, secret := filepath.Join(dir, "config.yaml"), filepath.Join(dir, "secret")
+	write := func(path, contents string) {
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(config, "chihaya:\n")
+
+	w := newFileWatcher([]string{config, secret}, time.Second)
+	if w.poll() {
+		t.Error("unchanged files were reported")
+	}
+
+	// Reported once they stayed the same for a poll, and only once
+	write(config, "chihaya:\n  announce_interval: 30m\n")
+	if w.poll() {
+		t.Error("change was reported before it settled")
+	}
+	write(config, "chihaya:\n  announce_interval: 15m\n  min_announce_interval: 15m\n")
+	if w.poll() {
+		t.Error("change was reported while it was still being written")
+	}
+	if !w.poll() {
+		t.Error("settled change wasn't reported")
+	}
+	if w.poll() {
+		t.Error("change was reported twice")
+	}
+
+	write(secret, "s3cret")
+	w.poll()
+	if !w.poll() {
+		t.Error("creating a watched file wasn't reported")
+	}
+
+	os.Remove(secret)
+	w.poll()
+	if !w.poll() {
+		t.Error("deleting a watched file wasn't reported")
+	}
+}
+
+func TestFileWatcherSetPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config, secret := filepath.Join(dir, "config.yaml"), filepath.Join(dir, "secret")
+	ioutil.WriteFile(config, []byte("chihaya:\n"), 0600)
+
+	w := newFileWatcher([]string{config}, time.Second)
+	w.poll()
+
+	// A reload that read a new file doesn't report it
+	ioutil.WriteFile(secret, []byte("s3cret"), 0600)
+	w.SetPaths([]string{config, secret})
+	w.poll()
+	if w.poll() {
+		t.Error("file added by a reload was reported as changed")
+	}
+
+	// Nor a change the reload already read
+	ioutil.WriteFile(config, []byte("chihaya:\n  announce_interval: 30m\n"), 0600)
+	w.poll()
+	w.SetPaths([]string{config, secret})
+	if w.poll() || w.poll() {
+		t.Error("change read by a reload was reported")
+	}
+}